@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// entities and actions that are recorded in the audit log
+const (
+	EntityItem = "item"
+	EntityShop = "shop"
+
+	ActionCreated = "created"
+	ActionUpdated = "updated"
+	ActionDeleted = "deleted"
+)
+
+// ErrRevertConflict is returned when an entity of a changeset to revert has been changed again since
+var ErrRevertConflict = errors.New("changed again since")
+
+// Change is a single modification of one item or shop.
+// Before is empty for created entities, After is empty for deleted ones.
+type Change struct {
+	Entity string          `json:"entity"`
+	UId    string          `json:"uid"`
+	Action string          `json:"action"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// Changeset groups all changes that were applied in one operation
+type Changeset struct {
+	ID        int64    `json:"id"`
+	CreatedAt int64    `json:"created_at"`
+	Source    string   `json:"source"`
+	User      string   `json:"user,omitempty"`
+	RevertOf  int64    `json:"revert_of,omitempty"`
+	Changes   []Change `json:"changes"`
+}
+
+// ********************************** //
+//          diff functions:           //
+// ********************************** //
+
+// newChange builds a change for one entity, the action is derived from
+// which of the two states is present
+func newChange(entity, uid string, before, after interface{}) (Change, error) {
+	change := Change{Entity: entity, UId: uid}
+	var err error
+	if before != nil {
+		change.Before, err = json.Marshal(before)
+		if err != nil {
+			return change, err
+		}
+	}
+	if after != nil {
+		change.After, err = json.Marshal(after)
+		if err != nil {
+			return change, err
+		}
+	}
+	switch {
+	case before == nil:
+		change.Action = ActionCreated
+	case after == nil:
+		change.Action = ActionDeleted
+	default:
+		change.Action = ActionUpdated
+	}
+	return change, nil
+}
+
+// DiffItems compares two item lists and returns the changes needed to get from before to after.
+// Items are compared by the uid of their shop only, renaming a shop is a change of the shop alone.
+func DiffItems(before, after []Item) ([]Change, error) {
+	return diffEntities(EntityItem, before, after, func(item Item) string { return item.UId }, itemState)
+}
+
+// DiffShops compares two shop lists and returns the changes needed to get from before to after
+func DiffShops(before, after []Shop) ([]Change, error) {
+	return diffEntities(EntityShop, before, after, func(shop Shop) string { return shop.UId }, func(shop Shop) Shop { return shop })
+}
+
+// itemState is what is compared of an item to find changes: the item with the uid of its shop
+func itemState(item Item) Item {
+	if item.Shop != nil {
+		item.Shop = &Shop{UId: item.Shop.UId}
+	}
+	return item
+}
+
+// diffEntities compares two lists of one entity, matched by the uid of their elements.
+// Elements count as changed if what state returns of them differs, the changes hold the complete elements.
+func diffEntities[T any](entity string, before, after []T, uid func(T) string, state func(T) T) ([]Change, error) {
+	var changes []Change
+	beforeMap := make(map[string]T)
+	for _, orig := range before {
+		beforeMap[uid(orig)] = orig
+	}
+	for _, elem := range after {
+		elem := elem
+		orig, ok := beforeMap[uid(elem)]
+		delete(beforeMap, uid(elem))
+		if !ok {
+			change, err := newChange(entity, uid(elem), nil, &elem)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, change)
+			continue
+		}
+		origState, elemState := state(orig), state(elem)
+		compared, err := newChange(entity, uid(elem), &origState, &elemState)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(compared.Before, compared.After) {
+			continue
+		}
+		change, err := newChange(entity, uid(elem), &orig, &elem)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	// whatever is left over has been deleted, keep the order of the original list
+	for _, elem := range before {
+		elem := elem
+		if _, ok := beforeMap[uid(elem)]; ok {
+			change, err := newChange(entity, uid(elem), &elem, nil)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+// ********************************** //
+//     database access functions:     //
+// ********************************** //
+
+// RecordChangeset writes a changeset with all its changes to the database and returns its id.
+// The user is who made the changes, if known. Empty changesets are not recorded, the returned id is 0 then.
+func RecordChangeset(db queryer, source, user string, revertOf int64, changes []Change) (int64, error) {
+	if len(changes) == 0 {
+		return 0, nil
+	}
+
+	var revert sql.NullInt64
+	if revertOf > 0 {
+		revert = sql.NullInt64{Int64: revertOf, Valid: true}
+	}
+	result, err := db.Exec("INSERT INTO changesets(created_at, source, user, revert_of) VALUES(?, ?, ?, ?)",
+		time.Now().Unix(), source, user, revert)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	// Create a prepared SQL statement for the single changes
+	stmt, err := db.Prepare("INSERT INTO changes(changeset_id, entity, uid, action, before_state, after_state) VALUES(?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return id, err
+	}
+	// Make sure to cleanup after the program exits
+	defer stmt.Close()
+
+	for _, change := range changes {
+		_, err = stmt.Exec(id, change.Entity, change.UId, change.Action, nullableJSON(change.Before), nullableJSON(change.After))
+		if err != nil {
+			return id, err
+		}
+	}
+	return id, nil
+}
+
+// nullableJSON stores empty json as NULL in the database
+func nullableJSON(data json.RawMessage) sql.NullString {
+	if len(data) == 0 {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: string(data), Valid: true}
+}
+
+// GetChangesets loads the most recent changesets, newest first
+func GetChangesets(db *sql.DB, limit int) ([]Changeset, error) {
+	result := make([]Changeset, 0)
+
+	sql := "SELECT id, created_at, source, user, revert_of FROM changesets ORDER BY id DESC LIMIT ?"
+	rows, err := db.Query(sql, limit)
+	// Exit if the SQL doesn't work for some reason
+	if err != nil {
+		return result, err
+	}
+	// make sure to cleanup when the program exits
+	defer rows.Close()
+
+	for rows.Next() {
+		changeset, err := scanChangeset(rows)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, changeset)
+	}
+	if err = rows.Err(); err != nil {
+		return result, err
+	}
+	rows.Close()
+
+	// load the changes of every changeset:
+	for i := range result {
+		result[i].Changes, err = getChanges(db, result[i].ID)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// GetChangesetByID loads one changeset with all its changes, identified by its id
+func GetChangesetByID(db queryer, id int64) (Changeset, error) {
+	sql := "SELECT id, created_at, source, user, revert_of FROM changesets WHERE id = ?"
+	changeset, err := scanChangeset(db.QueryRow(sql, id))
+	if err != nil {
+		return changeset, err
+	}
+	changeset.Changes, err = getChanges(db, id)
+	return changeset, err
+}
+
+// scanner is implemented by both sql.Row and sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanChangeset(row scanner) (Changeset, error) {
+	changeset := Changeset{}
+	var revertOf sql.NullInt64
+	err := row.Scan(&changeset.ID, &changeset.CreatedAt, &changeset.Source, &changeset.User, &revertOf)
+	changeset.RevertOf = revertOf.Int64
+	return changeset, err
+}
+
+// getChanges loads all changes of a changeset in the order they were recorded
+func getChanges(db queryer, changesetID int64) ([]Change, error) {
+	result := make([]Change, 0)
+
+	query := "SELECT entity, uid, action, before_state, after_state FROM changes WHERE changeset_id = ? ORDER BY id"
+	rows, err := db.Query(query, changesetID)
+	// Exit if the SQL doesn't work for some reason
+	if err != nil {
+		return result, err
+	}
+	// make sure to cleanup when the program exits
+	defer rows.Close()
+
+	for rows.Next() {
+		change := Change{}
+		var before, after sql.NullString
+		err = rows.Scan(&change.Entity, &change.UId, &change.Action, &before, &after)
+		// Exit if we get an error
+		if err != nil {
+			return result, err
+		}
+		if before.Valid {
+			change.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			change.After = json.RawMessage(after.String)
+		}
+		result = append(result, change)
+	}
+	return result, rows.Err()
+}
+
+// RevertChangeset restores the state of all items and shops touched by a changeset
+// to what they were before it was applied, in one transaction, see changeLists.
+// If any of them changed again since, nothing is reverted and ErrRevertConflict is returned,
+// unless force is set, which overwrites the later changes.
+// The revert itself is recorded as a new changeset of the given author, whose id is returned,
+// 0 if the revert did not change anything.
+func RevertChangeset(db *sql.DB, notifier *Notifier, id int64, force bool, by Author) (int64, error) {
+	revertID, _, err := changeLists(db, notifier, "revert", by, id, func(tx *sql.Tx) error {
+		changeset, err := GetChangesetByID(tx, id)
+		if err != nil {
+			return err
+		}
+		if !force {
+			if err = checkRevertConflicts(tx, changeset); err != nil {
+				return err
+			}
+		}
+
+		// shops first, so that restored items can reference restored shops.
+		// Walk backwards so that multiple changes on the same entity end up in the oldest state.
+		var touchedItems, touchedShops bool
+		for _, entity := range []string{EntityShop, EntityItem} {
+			for i := len(changeset.Changes) - 1; i >= 0; i-- {
+				change := changeset.Changes[i]
+				if change.Entity != entity {
+					continue
+				}
+				switch entity {
+				case EntityShop:
+					touchedShops = true
+					err = revertShopChange(tx, change)
+				case EntityItem:
+					touchedItems = true
+					err = revertItemChange(tx, change)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		// bump versions so that clients pick up the restored state
+		version := NewVersion()
+		if touchedShops {
+			if err = SetShopVersion(tx, version); err != nil {
+				return err
+			}
+		}
+		if touchedItems {
+			return SetItemVersion(tx, version)
+		}
+		return nil
+	})
+	return revertID, err
+}
+
+// checkRevertConflicts returns ErrRevertConflict if an item or shop of the changeset is no longer
+// in the state the changeset left it in. Items are compared like DiffItems does.
+// All of them are checked before anything is reverted.
+func checkRevertConflicts(db queryer, changeset Changeset) error {
+	// the last change of an entity holds the state the changeset left it in
+	checked := make(map[string]bool)
+	for i := len(changeset.Changes) - 1; i >= 0; i-- {
+		change := changeset.Changes[i]
+		if checked[change.Entity+" "+change.UId] {
+			continue
+		}
+		checked[change.Entity+" "+change.UId] = true
+
+		var current, left interface{}
+		switch change.Entity {
+		case EntityItem:
+			item, err := GetItemByID(db, change.UId)
+			if err != nil {
+				return err
+			}
+			if item.UId != "" {
+				item = itemState(item)
+				current = &item
+			}
+			if len(change.After) > 0 {
+				after := Item{}
+				if err = json.Unmarshal(change.After, &after); err != nil {
+					return fmt.Errorf("can not decode item %s: %w", change.UId, err)
+				}
+				after = itemState(after)
+				left = &after
+			}
+		case EntityShop:
+			shop, err := GetShopByID(db, change.UId)
+			if err != nil {
+				return err
+			}
+			if shop.UId != "" {
+				current = &shop
+			}
+			if len(change.After) > 0 {
+				after := Shop{}
+				if err = json.Unmarshal(change.After, &after); err != nil {
+					return fmt.Errorf("can not decode shop %s: %w", change.UId, err)
+				}
+				left = &after
+			}
+		}
+		compared, err := newChange(change.Entity, change.UId, left, current)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(compared.Before, compared.After) {
+			return fmt.Errorf("%w: %s %s", ErrRevertConflict, change.Entity, change.UId)
+		}
+	}
+	return nil
+}
+
+// revertItemChange puts an item back into the state before the change
+func revertItemChange(db queryer, change Change) error {
+	if len(change.Before) == 0 {
+		_, err := DeleteItemByID(db, change.UId)
+		return err
+	}
+	item := Item{}
+	if err := json.Unmarshal(change.Before, &item); err != nil {
+		return fmt.Errorf("can not decode item %s: %w", change.UId, err)
+	}
+	return UpsertItem(db, &item)
+}
+
+// revertShopChange puts a shop back into the state before the change
+func revertShopChange(db queryer, change Change) error {
+	if len(change.Before) == 0 {
+		_, err := DeleteShopByID(db, change.UId)
+		return err
+	}
+	shop := Shop{}
+	if err := json.Unmarshal(change.Before, &shop); err != nil {
+		return fmt.Errorf("can not decode shop %s: %w", change.UId, err)
+	}
+	return UpsertShop(db, &shop)
+}
+
+// ********************************** //
+//             handlers:              //
+// ********************************** //
+
+// GET /changesets lists the most recent changesets
+func showChangesets(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		limit := 20
+		if param := ctx.QueryParam("limit"); param != "" {
+			var err error
+			limit, err = strconv.Atoi(param)
+			if err != nil || limit < 1 {
+				return echo.NewHTTPError(http.StatusBadRequest, "limit must be a positive number")
+			}
+		}
+		changesets, err := GetChangesets(db, limit)
+		if err != nil {
+			ctx.Logger().Infof("showChangesets: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read changesets")
+		}
+		return ctx.JSON(http.StatusOK, changesets)
+	}
+}
+
+// POST /changesets/:id/revert undoes one changeset, ?force=true also overwrites later changes
+func revertChangeset(db *sql.DB, notifier *Notifier) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+		}
+
+		force := ctx.QueryParam("force") == "true"
+		revertID, err := RevertChangeset(db, notifier, id, force, author(ctx))
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusNotFound, "No such changeset")
+		}
+		if errors.Is(err, ErrRevertConflict) {
+			return echo.NewHTTPError(http.StatusConflict, "The changeset has been changed again since, revert with force=true to overwrite that")
+		}
+		if err != nil {
+			ctx.Logger().Infof("revertChangeset: Database Error on revert %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not revert changeset")
+		}
+		if revertID == 0 {
+			// the revert did not change anything
+			return ctx.NoContent(http.StatusNoContent)
+		}
+
+		changeset, err := GetChangesetByID(db, revertID)
+		if err != nil {
+			ctx.Logger().Infof("revertChangeset: Database Error on get %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read changeset")
+		}
+		return ctx.JSON(http.StatusOK, changeset)
+	}
+}
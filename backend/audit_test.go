@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestDiffItems(t *testing.T) {
+	shop := &Shop{UId: "s1", Name: "Bakery"}
+	tests := []struct {
+		name    string
+		before  []Item
+		after   []Item
+		actions []string
+	}{
+		{name: "nothing changed",
+			before: []Item{{UId: "i1", Title: "Bread", Status: StatusOpen}},
+			after:  []Item{{UId: "i1", Title: "Bread", Status: StatusOpen}}},
+		{name: "created",
+			after:   []Item{{UId: "i1", Title: "Bread", Status: StatusOpen}},
+			actions: []string{ActionCreated}},
+		{name: "deleted in the original order",
+			before:  []Item{{UId: "i1", Title: "Bread"}, {UId: "i2", Title: "Milk"}, {UId: "i3", Title: "Eggs"}},
+			after:   []Item{{UId: "i2", Title: "Milk"}},
+			actions: []string{ActionDeleted, ActionDeleted}},
+		{name: "updated",
+			before:  []Item{{UId: "i1", Title: "Bread", Status: StatusOpen}},
+			after:   []Item{{UId: "i1", Title: "Bread", Status: StatusChecked}},
+			actions: []string{ActionUpdated}},
+		{name: "shop renamed",
+			before: []Item{{UId: "i1", Title: "Bread", Shop: shop}},
+			after:  []Item{{UId: "i1", Title: "Bread", Shop: &Shop{UId: "s1", Name: "Corner Bakery"}}}},
+		{name: "moved to a shop",
+			before:  []Item{{UId: "i1", Title: "Bread"}, {UId: "i2", Title: "Milk"}},
+			after:   []Item{{UId: "i2", Title: "Milk"}, {UId: "i1", Title: "Bread", Shop: shop}, {UId: "i3", Title: "Eggs"}},
+			actions: []string{ActionUpdated, ActionCreated}},
+	}
+	for _, test := range tests {
+		changes, err := DiffItems(test.before, test.after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != len(test.actions) {
+			t.Errorf("%s: %+v", test.name, changes)
+			continue
+		}
+		for i, change := range changes {
+			if change.Entity != EntityItem || change.Action != test.actions[i] {
+				t.Errorf("%s: change %d is %s %s instead of %s", test.name, i, change.Entity, change.Action, test.actions[i])
+			}
+			if (change.Action == ActionCreated) != (len(change.Before) == 0) || (change.Action == ActionDeleted) != (len(change.After) == 0) {
+				t.Errorf("%s: change %d has before %s and after %s", test.name, i, change.Before, change.After)
+			}
+		}
+	}
+}
+
+func TestDiffShops(t *testing.T) {
+	before := []Shop{{UId: "s1", Name: "Bakery"}, {UId: "s2", Name: "Market"}}
+	after := []Shop{{UId: "s1", Name: "Corner Bakery"}, {UId: "s3", Name: "Butcher"}}
+	changes, err := DiffShops(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ uid, action string }{{"s1", ActionUpdated}, {"s3", ActionCreated}, {"s2", ActionDeleted}}
+	if len(changes) != len(want) {
+		t.Fatalf("%+v", changes)
+	}
+	for i, change := range changes {
+		if change.Entity != EntityShop || change.UId != want[i].uid || change.Action != want[i].action {
+			t.Errorf("change %d is %s %s %s instead of %s %s", i, change.Entity, change.UId, change.Action, want[i].uid, want[i].action)
+		}
+	}
+}
+
+// TestRevertConflict makes sure a revert does not overwrite later changes unless forced
+func TestRevertConflict(t *testing.T) {
+	db := newTestDB(t)
+	setTitle := func(title string) int64 {
+		t.Helper()
+		id, _, err := changeLists(db, nil, "test", Author{}, 0, func(tx *sql.Tx) error {
+			return UpsertItem(tx, &Item{UId: "i1", Title: title, Status: StatusOpen})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	title := func() string {
+		t.Helper()
+		item, err := GetItemByID(db, "i1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return item.Title
+	}
+
+	setTitle("Bread")
+	renamed := setTitle("Rolls")
+	setTitle("Buns")
+
+	if _, err := RevertChangeset(db, nil, renamed, false, Author{}); !errors.Is(err, ErrRevertConflict) {
+		t.Fatalf("revert of an item changed again answered %v", err)
+	}
+	if title() != "Buns" {
+		t.Errorf("conflicting revert changed the item to %q", title())
+	}
+	if _, err := RevertChangeset(db, nil, renamed, true, Author{}); err != nil {
+		t.Fatal(err)
+	}
+	if title() != "Bread" {
+		t.Errorf("forced revert left the item at %q", title())
+	}
+
+	// the last changeset can be reverted without force, also when it restores a deleted item
+	deleted, _, err := changeLists(db, nil, "test", Author{}, 0, func(tx *sql.Tx) error {
+		_, err := DeleteItemByID(tx, "i1")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = RevertChangeset(db, nil, deleted, false, Author{}); err != nil {
+		t.Fatal(err)
+	}
+	if title() != "Bread" {
+		t.Errorf("revert of the deletion left the item at %q", title())
+	}
+}
+
+// TestRevertAfterShopRename makes sure renaming the shop of an item does not count as a change of the item
+func TestRevertAfterShopRename(t *testing.T) {
+	db := newTestDB(t)
+	shop := Shop{UId: "s1", Name: "Bakery"}
+	if err := UpsertShop(db, &shop); err != nil {
+		t.Fatal(err)
+	}
+	created, _, err := changeLists(db, nil, "test", Author{}, 0, func(tx *sql.Tx) error {
+		return UpsertItem(tx, &Item{UId: "i1", Title: "Bread", Status: StatusOpen, Shop: &shop})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, changes, err := changeLists(db, nil, "test", Author{}, 0, func(tx *sql.Tx) error {
+		return UpsertShop(tx, &Shop{UId: "s1", Name: "Corner Bakery"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Entity != EntityShop {
+		t.Errorf("renaming the shop changed %+v", changes)
+	}
+	if _, err = RevertChangeset(db, nil, created, false, Author{}); err != nil {
+		t.Fatalf("revert of the item after renaming its shop: %v", err)
+	}
+	if item, err := GetItemByID(db, "i1"); err != nil || item.UId != "" {
+		t.Errorf("item after the revert is %+v %v", item, err)
+	}
+}
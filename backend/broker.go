@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+// brokers that can be chosen on the command line
+const (
+	BrokerMemory = "memory"
+	BrokerSQLite = "sqlite"
+)
+
+// AllowedBrokers for checking the broker option
+var AllowedBrokers = []string{BrokerMemory, BrokerSQLite}
+
+// how long published events are kept in the database for instances that poll late
+const brokerRetention = time.Hour
+
+// Publication is an event on its way through a broker, before a notifier numbers it.
+// Topic and Lists are used for routing it, see Subscription.
+type Publication struct {
+	Topic string
+	Lists []string
+	Data  string
+}
+
+// Broker passes the events of all instances of the server to the notifier of each of them.
+// The notifier publishes its events to the broker and gets them back, together
+// with those of the other instances, through the function given to Subscribe.
+type Broker interface {
+	// Publish sends a publication to all subscribers
+	Publish(publication Publication) error
+	// Subscribe sets the function that gets all publications
+	Subscribe(deliver func(Publication))
+	// Close stops the broker
+	Close() error
+}
+
+// MemoryBroker passes the publications straight back, for a single instance
+type MemoryBroker struct {
+	mutex   sync.Mutex
+	deliver func(Publication)
+}
+
+// NewMemoryBroker creates and returns an in-process broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+// Publish delivers the publication to the subscriber, if there is one
+func (b *MemoryBroker) Publish(publication Publication) error {
+	b.mutex.Lock()
+	deliver := b.deliver
+	b.mutex.Unlock()
+	if deliver != nil {
+		deliver(publication)
+	}
+	return nil
+}
+
+// Subscribe sets the function that gets all publications
+func (b *MemoryBroker) Subscribe(deliver func(Publication)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.deliver = deliver
+}
+
+// Close does nothing, there is nothing to stop
+func (b *MemoryBroker) Close() error {
+	return nil
+}
+
+// SQLiteBroker passes publications between instances of the server that share the database file.
+// Publications are written to the broker_events table and delivered to the own subscriber
+// right away, those of other instances are found by polling the table.
+type SQLiteBroker struct {
+	db       *sql.DB
+	origin   string
+	interval time.Duration
+
+	mutex   sync.Mutex
+	deliver func(Publication)
+	lastID  int64
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// NewSQLiteBroker creates a broker on the given database, that polls it in the given interval.
+// Publications from before it was created are not delivered.
+func NewSQLiteBroker(db *sql.DB, interval time.Duration) (*SQLiteBroker, error) {
+	broker := &SQLiteBroker{
+		db:       db,
+		origin:   NewUID(),
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+	err := db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM broker_events").Scan(&broker.lastID)
+	if err != nil {
+		return nil, err
+	}
+	go broker.poll()
+	return broker, nil
+}
+
+// Publish stores the publication for the other instances and delivers it to the own subscriber
+func (b *SQLiteBroker) Publish(publication Publication) error {
+	sql := "INSERT INTO broker_events (created_at, origin, topic, lists, data) VALUES (?, ?, ?, ?, ?)"
+	_, err := b.db.Exec(sql, time.Now().UnixMilli(), b.origin, publication.Topic, strings.Join(publication.Lists, "\n"), publication.Data)
+	if err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	deliver := b.deliver
+	b.mutex.Unlock()
+	if deliver != nil {
+		deliver(publication)
+	}
+	return nil
+}
+
+// Subscribe sets the function that gets all publications
+func (b *SQLiteBroker) Subscribe(deliver func(Publication)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.deliver = deliver
+}
+
+// Close stops polling
+func (b *SQLiteBroker) Close() error {
+	b.once.Do(func() { close(b.stop) })
+	return nil
+}
+
+// poll delivers the publications of the other instances and removes old ones, until the broker is closed
+func (b *SQLiteBroker) poll() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	lastPurge := time.Now()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+		if err := b.fetch(); err != nil {
+			log.Errorf("SQLiteBroker: Could not read events %v", err)
+		}
+		if time.Since(lastPurge) > brokerRetention/10 {
+			lastPurge = time.Now()
+			_, err := b.db.Exec("DELETE FROM broker_events WHERE created_at < ?", time.Now().Add(-brokerRetention).UnixMilli())
+			if err != nil {
+				log.Errorf("SQLiteBroker: Could not purge events %v", err)
+			}
+		}
+	}
+}
+
+// fetch delivers the publications of other instances stored since the last call
+func (b *SQLiteBroker) fetch() error {
+	sql := "SELECT id, origin, topic, lists, data FROM broker_events WHERE id > ? ORDER BY id"
+	rows, err := b.db.Query(sql, b.lastID)
+	if err != nil {
+		return err
+	}
+	var publications []Publication
+	for rows.Next() {
+		var origin, lists string
+		var publication Publication
+		if err = rows.Scan(&b.lastID, &origin, &publication.Topic, &lists, &publication.Data); err != nil {
+			rows.Close()
+			return err
+		}
+		if origin == b.origin {
+			continue
+		}
+		if lists != "" {
+			publication.Lists = strings.Split(lists, "\n")
+		}
+		publications = append(publications, publication)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	deliver := b.deliver
+	b.mutex.Unlock()
+	if deliver == nil {
+		return nil
+	}
+	for _, publication := range publications {
+		deliver(publication)
+	}
+	return nil
+}
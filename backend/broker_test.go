@@ -0,0 +1,128 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fanoutBroker stands in for a broker shared by several instances, it delivers every publication to all of them
+type fanoutBroker struct {
+	mutex       sync.Mutex
+	subscribers []func(Publication)
+}
+
+func (b *fanoutBroker) Publish(publication Publication) error {
+	b.mutex.Lock()
+	subscribers := append([]func(Publication){}, b.subscribers...)
+	b.mutex.Unlock()
+	for _, deliver := range subscribers {
+		deliver(publication)
+	}
+	return nil
+}
+
+func (b *fanoutBroker) Subscribe(deliver func(Publication)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscribers = append(b.subscribers, deliver)
+}
+
+func (b *fanoutBroker) Close() error {
+	return nil
+}
+
+// receive waits for the next message of a receiver
+func receive(t *testing.T, receiver *Receiver) Message {
+	t.Helper()
+	select {
+	case msg := <-receiver.Messages():
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message arrived")
+	}
+	return Message{}
+}
+
+func TestBrokerTwoNotifiers(t *testing.T) {
+	broker := &fanoutBroker{}
+	first := NewNotifier(NotifierConfig{Backlog: 16, QueueSize: 8, Broker: broker})
+	second := NewNotifier(NotifierConfig{Backlog: 16, QueueSize: 8, Broker: broker})
+	onFirst, _ := first.NewReceiver(Subscription{})
+	onSecond, _ := second.NewReceiver(Subscription{Topics: []string{TopicPresence}})
+
+	if err := first.Join("phone", "Phone", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.SendEvent(Event{Cmd: "UPDATE", Type: EntityItem + "." + ActionCreated}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := receive(t, onFirst); !strings.Contains(msg.Data, EventPresenceJoined) {
+		t.Errorf("first instance got %s instead of the join", msg.Data)
+	}
+	if msg := receive(t, onFirst); !strings.Contains(msg.Data, EntityItem+"."+ActionCreated) {
+		t.Errorf("first instance got %s instead of the item of the second", msg.Data)
+	}
+	if msg := receive(t, onSecond); !strings.Contains(msg.Data, EventPresenceJoined) {
+		t.Errorf("second instance got %s instead of the join of the first", msg.Data)
+	}
+	if len(onSecond.Messages()) != 0 {
+		t.Error("second instance got the item although it only subscribed to presence")
+	}
+	if presence := second.Presence(); len(presence) != 1 || presence[0].Client != "phone" {
+		t.Errorf("second instance does not know the client of the first: %+v", presence)
+	}
+
+	// both count the same messages, but a client can only continue where it was connected
+	if _, ok := first.Replay(first.EventID(Message{ID: 1})); !ok {
+		t.Error("first instance can not replay its own messages")
+	}
+	if _, ok := second.Replay(first.EventID(Message{ID: 1})); ok {
+		t.Error("second instance replays after an event id of the first instead of resyncing")
+	}
+}
+
+func TestSQLiteBrokerTwoNotifiers(t *testing.T) {
+	db := newTestDB(t)
+	before := runtime.NumGoroutine()
+	brokers := make([]*SQLiteBroker, 2)
+	notifiers := make([]*Notifier, 2)
+	receivers := make([]*Receiver, 2)
+	for i := range brokers {
+		var err error
+		if brokers[i], err = NewSQLiteBroker(db, 10*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		notifiers[i] = NewNotifier(NotifierConfig{Backlog: 16, QueueSize: 8, Broker: brokers[i]})
+		receivers[i], _ = notifiers[i].NewReceiver(Subscription{})
+	}
+
+	if err := notifiers[0].Send("UPDATE"); err != nil {
+		t.Fatal(err)
+	}
+	if err := notifiers[1].Send("UPDATE"); err != nil {
+		t.Fatal(err)
+	}
+	for i, receiver := range receivers {
+		for j := uint64(1); j <= 2; j++ {
+			if msg := receive(t, receiver); msg.ID != j {
+				t.Errorf("instance %d numbered message %d as %d", i, j, msg.ID)
+			}
+		}
+	}
+	// an instance does not get its own messages a second time from the database
+	time.Sleep(50 * time.Millisecond)
+	for i, receiver := range receivers {
+		if len(receiver.Messages()) != 0 {
+			t.Errorf("instance %d got %d messages too many", i, len(receiver.Messages()))
+		}
+	}
+
+	for _, broker := range brokers {
+		broker.Close()
+	}
+	waitForGoroutines(t, before)
+}
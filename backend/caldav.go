@@ -0,0 +1,669 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// minimal CalDAV (RFC 4791) server, exposing the items as VTODOs, one calendar per list.
+// The layout is:
+//
+//	/dav/                           root, points to the principal
+//	/dav/principal/                 the one and only user, points to the calendar home
+//	/dav/calendars/                 calendar home
+//	/dav/calendars/LIST/            the items of one shop, or of none, as calendar collection
+//	/dav/calendars/LIST/UID.ics     one item
+const (
+	davPrefix       = "/dav"
+	davPrincipal    = davPrefix + "/principal/"
+	davHome         = davPrefix + "/calendars/"
+	davListTitle    = "Shopping list"
+	davContentType  = "text/calendar; charset=utf-8"
+	davItemSuffix   = ".ics"
+	davMaxBodyBytes = 1 << 20
+
+	nsDAV    = "DAV:"
+	nsCalDAV = "urn:ietf:params:xml:ns:caldav"
+	nsCS     = "http://calendarserver.org/ns/"
+)
+
+// errors of item modifications that are reported to the client
+var (
+	errDavPrecondition = errors.New("precondition failed")
+	errDavNotFound     = errors.New("no such item")
+	errDavInvalid      = errors.New("invalid item")
+	errDavConflict     = errors.New("item on another list")
+)
+
+// prefixes used when rendering properties
+var davPrefixes = map[string]string{nsDAV: "d", nsCalDAV: "c", nsCS: "cs"}
+
+// the kinds of resources we serve
+const (
+	davKindRoot = iota
+	davKindPrincipal
+	davKindHome
+	davKindList
+	davKindItem
+)
+
+// davResource is a parsed request path, list is the shop uid or ListNone
+type davResource struct {
+	kind int
+	href string
+	list string
+	uid  string
+}
+
+// parseDavPath maps a request path to a resource, ok is false for unknown paths
+func parseDavPath(path string) (davResource, bool) {
+	path = strings.Trim(strings.TrimPrefix(path, davPrefix), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "":
+		return davResource{kind: davKindRoot, href: davPrefix + "/"}, true
+	case path == "principal":
+		return davResource{kind: davKindPrincipal, href: davPrincipal}, true
+	case path == "calendars":
+		return davResource{kind: davKindHome, href: davHome}, true
+	case len(parts) == 2 && parts[0] == "calendars" && parts[1] != "":
+		return davResource{kind: davKindList, href: davListHref(parts[1]), list: parts[1]}, true
+	case len(parts) == 3 && parts[0] == "calendars" && parts[1] != "" && strings.HasSuffix(parts[2], davItemSuffix):
+		uid := strings.TrimSuffix(parts[2], davItemSuffix)
+		return davResource{kind: davKindItem, href: davItemHref(parts[1], uid), list: parts[1], uid: uid}, uid != ""
+	}
+	return davResource{}, false
+}
+
+func davListHref(list string) string {
+	return davHome + list + "/"
+}
+
+func davItemHref(list, uid string) string {
+	return davListHref(list) + uid + davItemSuffix
+}
+
+// davLists returns the lists there are, the one without shop first
+func davLists(db *sql.DB) ([]davResource, error) {
+	shops, err := GetAllShops(db)
+	if err != nil {
+		return nil, err
+	}
+	lists := []davResource{{kind: davKindList, href: davListHref(ListNone), list: ListNone}}
+	for _, shop := range shops.Shops {
+		lists = append(lists, davResource{kind: davKindList, href: davListHref(shop.UId), list: shop.UId})
+	}
+	return lists, nil
+}
+
+// davShop loads the shop of a list, nil for ListNone. ok is false if there is no such list.
+func davShop(db *sql.DB, list string) (*Shop, bool, error) {
+	if list == ListNone {
+		return nil, true, nil
+	}
+	shop, err := GetShopByID(db, list)
+	return &shop, err == nil && shop.UId != "", err
+}
+
+// davTitle is the name of the calendar of a shop
+func davTitle(shop *Shop) string {
+	if shop == nil {
+		return davListTitle
+	}
+	return davListTitle + ": " + shop.Name
+}
+
+// davListItems returns the items of one list
+func davListItems(db *sql.DB, list string) ([]Item, error) {
+	items, err := GetAllItems(db)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Item, 0, len(items.Items))
+	for _, item := range items.Items {
+		if itemList(&item) == list {
+			result = append(result, item)
+		}
+	}
+	return result, nil
+}
+
+// davETag derives the entity tag of an item from its revision
+func davETag(item *Item) string {
+	return fmt.Sprintf(`"%d"`, item.Revision)
+}
+
+// davHref renders a href element
+func davHref(href string) string {
+	return "<d:href>" + xmlEscape(href) + "</d:href>"
+}
+
+func xmlEscape(value string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(value))
+	return b.String()
+}
+
+// davProps maps property names to their rendered content
+type davProps map[xml.Name]string
+
+// collectionProps returns all properties of a collection
+func collectionProps(db *sql.DB, resource davResource) (davProps, error) {
+	props := davProps{
+		{Space: nsDAV, Local: "current-user-principal"}: davHref(davPrincipal),
+		{Space: nsCalDAV, Local: "calendar-home-set"}:   davHref(davHome),
+		{Space: nsDAV, Local: "current-user-privilege-set"}: "<d:privilege><d:read/></d:privilege><d:privilege><d:write/></d:privilege>" +
+			"<d:privilege><d:write-content/></d:privilege><d:privilege><d:bind/></d:privilege><d:privilege><d:unbind/></d:privilege>",
+	}
+	switch resource.kind {
+	case davKindRoot:
+		props[xml.Name{Space: nsDAV, Local: "resourcetype"}] = "<d:collection/>"
+		props[xml.Name{Space: nsDAV, Local: "displayname"}] = "shoppinglist"
+	case davKindPrincipal:
+		props[xml.Name{Space: nsDAV, Local: "resourcetype"}] = "<d:collection/><d:principal/>"
+		props[xml.Name{Space: nsDAV, Local: "displayname"}] = "shoppinglist"
+		props[xml.Name{Space: nsDAV, Local: "principal-URL"}] = davHref(davPrincipal)
+	case davKindHome:
+		props[xml.Name{Space: nsDAV, Local: "resourcetype"}] = "<d:collection/>"
+		props[xml.Name{Space: nsDAV, Local: "displayname"}] = "calendars"
+	case davKindList:
+		shop, ok, err := davShop(db, resource.list)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errDavNotFound
+		}
+		versions, err := GetVersions(db)
+		if err != nil {
+			return nil, err
+		}
+		ctag := fmt.Sprintf(`"%d"`, versions.ItemVersion)
+		props[xml.Name{Space: nsDAV, Local: "resourcetype"}] = "<d:collection/><c:calendar/>"
+		props[xml.Name{Space: nsDAV, Local: "displayname"}] = xmlEscape(davTitle(shop))
+		props[xml.Name{Space: nsCalDAV, Local: "supported-calendar-component-set"}] = `<c:comp name="VTODO"/>`
+		props[xml.Name{Space: nsCS, Local: "getctag"}] = xmlEscape(ctag)
+		props[xml.Name{Space: nsDAV, Local: "getetag"}] = xmlEscape(ctag)
+		props[xml.Name{Space: nsDAV, Local: "supported-report-set"}] = "<d:supported-report><d:report><c:calendar-query/></d:report></d:supported-report>" +
+			"<d:supported-report><d:report><c:calendar-multiget/></d:report></d:supported-report>"
+	}
+	return props, nil
+}
+
+// itemProps returns all properties of an item, the calendar data only if asked for
+func itemProps(item *Item, withData bool) davProps {
+	props := davProps{
+		{Space: nsDAV, Local: "resourcetype"}:   "",
+		{Space: nsDAV, Local: "getetag"}:        xmlEscape(davETag(item)),
+		{Space: nsDAV, Local: "getcontenttype"}: xmlEscape(davContentType + "; component=vtodo"),
+	}
+	if withData {
+		props[xml.Name{Space: nsCalDAV, Local: "calendar-data"}] = xmlEscape(RenderVTodo(item))
+	}
+	return props
+}
+
+// davPropRequest holds the property names of a PROPFIND or REPORT body
+type davPropRequest struct {
+	XMLName xml.Name
+	AllProp *struct{} `xml:"DAV: allprop"`
+	Prop    struct {
+		Names []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+	Hrefs []string `xml:"DAV: href"`
+}
+
+// requested returns the names of the requested properties, nil means all of them
+func (r *davPropRequest) requested() []xml.Name {
+	if r.AllProp != nil || len(r.Prop.Names) == 0 {
+		return nil
+	}
+	names := make([]xml.Name, 0, len(r.Prop.Names))
+	for _, name := range r.Prop.Names {
+		names = append(names, name.XMLName)
+	}
+	return names
+}
+
+// wantsCalendarData tells whether calendar-data is among the requested properties
+func (r *davPropRequest) wantsCalendarData() bool {
+	for _, name := range r.Prop.Names {
+		if name.XMLName.Space == nsCalDAV && name.XMLName.Local == "calendar-data" {
+			return true
+		}
+	}
+	return false
+}
+
+// multistatus collects the responses of a PROPFIND or REPORT
+type multistatus struct {
+	b strings.Builder
+}
+
+func newMultistatus() *multistatus {
+	m := &multistatus{}
+	m.b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	m.b.WriteString(`<d:multistatus xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav" xmlns:cs="http://calendarserver.org/ns/">`)
+	return m
+}
+
+// add writes the response for one resource, requested nil means all properties.
+// Requested properties we do not have are reported as not found.
+func (m *multistatus) add(href string, props davProps, requested []xml.Name) {
+	var found, missing strings.Builder
+	if requested == nil {
+		for name := range props {
+			requested = append(requested, name)
+		}
+	}
+	for _, name := range requested {
+		value, ok := props[name]
+		if ok {
+			writeProp(&found, name, value)
+		} else {
+			writeProp(&missing, name, "")
+		}
+	}
+
+	m.b.WriteString("<d:response>" + davHref(href))
+	if found.Len() > 0 {
+		m.b.WriteString("<d:propstat><d:prop>" + found.String() + "</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>")
+	}
+	if missing.Len() > 0 {
+		m.b.WriteString("<d:propstat><d:prop>" + missing.String() + "</d:prop><d:status>HTTP/1.1 404 Not Found</d:status></d:propstat>")
+	}
+	m.b.WriteString("</d:response>")
+}
+
+// addStatus writes a response without properties, e.g. for hrefs that do not exist
+func (m *multistatus) addStatus(href string, status int) {
+	m.b.WriteString(fmt.Sprintf("<d:response>%s<d:status>HTTP/1.1 %d %s</d:status></d:response>", davHref(href), status, http.StatusText(status)))
+}
+
+func (m *multistatus) String() string {
+	return m.b.String() + "</d:multistatus>"
+}
+
+func writeProp(b *strings.Builder, name xml.Name, value string) {
+	prefix, ok := davPrefixes[name.Space]
+	tag := prefix + ":" + name.Local
+	if !ok {
+		tag = "x:" + name.Local
+	}
+	b.WriteString("<" + tag)
+	if !ok {
+		b.WriteString(` xmlns:x="` + xmlEscape(name.Space) + `"`)
+	}
+	if value == "" {
+		b.WriteString("/>")
+		return
+	}
+	b.WriteString(">" + value + "</" + tag + ">")
+}
+
+// readDavRequest parses the xml body of PROPFIND and REPORT requests, an empty body is fine
+func readDavRequest(ctx echo.Context) (*davPropRequest, error) {
+	request := &davPropRequest{}
+	body, err := io.ReadAll(io.LimitReader(ctx.Request().Body, davMaxBodyBytes))
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(body))) == 0 {
+		return request, nil
+	}
+	err = xml.Unmarshal(body, request)
+	return request, err
+}
+
+// findItem loads an item of a list, ok is false if it does not exist there
+func findItem(db *sql.DB, list, uid string) (Item, bool, error) {
+	item, err := GetItemByID(db, uid)
+	return item, err == nil && item.UId != "" && itemList(&item) == list, err
+}
+
+// itemFromVTodo applies the properties of a VTODO to an item, the shop is the one of its list.
+// The summary is only read as quantity and title if it is not the label the item already has,
+// so that a title starting with a number like "7 Up" stays as it is when the task is ticked off.
+func itemFromVTodo(item Item, todo VTodo, shop *Shop) Item {
+	if todo.Summary != item.Label() {
+		item.Quantity, item.Unit, item.Title = ParseQuantity(todo.Summary)
+	}
+	item.Status = StatusOpen
+	if todo.Completed {
+		item.Status = StatusChecked
+	}
+	item.Category = ""
+	if len(todo.Categories) > 0 {
+		item.Category = todo.Categories[0]
+	}
+	item.Shop = shop
+	return item
+}
+
+// ********************************** //
+//             handlers:              //
+// ********************************** //
+
+// davHandler serves all requests below /dav
+func davHandler(db *sql.DB, notifier *Notifier) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		resource, ok := parseDavPath(ctx.Request().URL.Path)
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Not found")
+		}
+		// share links only see their list in the web app, CalDAV clients log in as users
+		if _, ok := currentShare(ctx); ok {
+			return echo.NewHTTPError(http.StatusForbidden, "Share links can not use CalDAV")
+		}
+		ctx.Response().Header().Set("DAV", "1, 3, calendar-access")
+
+		switch ctx.Request().Method {
+		case http.MethodOptions:
+			ctx.Response().Header().Set(echo.HeaderAllow, "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT")
+			return ctx.NoContent(http.StatusOK)
+		case echo.PROPFIND:
+			return davPropfind(ctx, db, resource)
+		case echo.REPORT:
+			return davReport(ctx, db, resource)
+		case http.MethodGet, http.MethodHead:
+			return davGet(ctx, db, resource)
+		case http.MethodPut:
+			return davPut(ctx, db, notifier, resource)
+		case http.MethodDelete:
+			return davDelete(ctx, db, notifier, resource)
+		}
+		return echo.NewHTTPError(http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// redirect for service discovery, RFC 6764
+func davWellKnown() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		return ctx.Redirect(http.StatusMovedPermanently, davPrefix+"/")
+	}
+}
+
+func davPropfind(ctx echo.Context, db *sql.DB, resource davResource) error {
+	request, err := readDavRequest(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid XML")
+	}
+	requested := request.requested()
+	depth := ctx.Request().Header.Get("Depth")
+	response := newMultistatus()
+
+	if resource.kind == davKindItem {
+		item, ok, err := findItem(db, resource.list, resource.uid)
+		if err != nil {
+			ctx.Logger().Infof("davPropfind: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read item")
+		}
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "No such item")
+		}
+		response.add(resource.href, itemProps(&item, request.wantsCalendarData()), requested)
+		return ctx.Blob(http.StatusMultiStatus, echo.MIMEApplicationXMLCharsetUTF8, []byte(response.String()))
+	}
+
+	props, err := collectionProps(db, resource)
+	if errors.Is(err, errDavNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "No such list")
+	}
+	if err != nil {
+		ctx.Logger().Infof("davPropfind: Database Error %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not read versions")
+	}
+	response.add(resource.href, props, requested)
+
+	// children
+	if depth != "0" {
+		var children []davResource
+		switch resource.kind {
+		case davKindRoot:
+			children = []davResource{{kind: davKindPrincipal, href: davPrincipal}, {kind: davKindHome, href: davHome}}
+		case davKindHome:
+			children, err = davLists(db)
+			if err != nil {
+				ctx.Logger().Infof("davPropfind: Database Error %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Could not read shops")
+			}
+		case davKindList:
+			items, err := davListItems(db, resource.list)
+			if err != nil {
+				ctx.Logger().Infof("davPropfind: Database Error %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Could not read items")
+			}
+			for i := range items {
+				response.add(davItemHref(resource.list, items[i].UId), itemProps(&items[i], request.wantsCalendarData()), requested)
+			}
+		}
+		for _, child := range children {
+			props, err := collectionProps(db, child)
+			if err != nil {
+				ctx.Logger().Infof("davPropfind: Database Error %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Could not read versions")
+			}
+			response.add(child.href, props, requested)
+		}
+	}
+	return ctx.Blob(http.StatusMultiStatus, echo.MIMEApplicationXMLCharsetUTF8, []byte(response.String()))
+}
+
+// davReport answers calendar-query with all items and calendar-multiget with the requested ones.
+// Filters of calendar-query are not evaluated, clients filter on their side.
+func davReport(ctx echo.Context, db *sql.DB, resource davResource) error {
+	if resource.kind != davKindList {
+		return echo.NewHTTPError(http.StatusForbidden, "Reports are only supported on the calendar")
+	}
+	request, err := readDavRequest(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid XML")
+	}
+	if request.XMLName.Space != nsCalDAV || (request.XMLName.Local != "calendar-query" && request.XMLName.Local != "calendar-multiget") {
+		return echo.NewHTTPError(http.StatusForbidden, "Unsupported report")
+	}
+	if _, ok, err := davShop(db, resource.list); err != nil || !ok {
+		return davListError(ctx, "davReport", err)
+	}
+
+	items, err := davListItems(db, resource.list)
+	if err != nil {
+		ctx.Logger().Infof("davReport: Database Error %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not read items")
+	}
+	requested := request.requested()
+	response := newMultistatus()
+
+	if request.XMLName.Local == "calendar-query" {
+		for i := range items {
+			response.add(davItemHref(resource.list, items[i].UId), itemProps(&items[i], true), requested)
+		}
+		return ctx.Blob(http.StatusMultiStatus, echo.MIMEApplicationXMLCharsetUTF8, []byte(response.String()))
+	}
+
+	itemMap := make(map[string]*Item)
+	for i := range items {
+		itemMap[items[i].UId] = &items[i]
+	}
+	for _, href := range request.Hrefs {
+		href = strings.TrimSpace(href)
+		child, ok := parseDavPath(href)
+		if !ok || child.kind != davKindItem || child.list != resource.list || itemMap[child.uid] == nil {
+			response.addStatus(href, http.StatusNotFound)
+			continue
+		}
+		response.add(child.href, itemProps(itemMap[child.uid], true), requested)
+	}
+	return ctx.Blob(http.StatusMultiStatus, echo.MIMEApplicationXMLCharsetUTF8, []byte(response.String()))
+}
+
+// davGet returns one item, or the complete list as one calendar
+func davGet(ctx echo.Context, db *sql.DB, resource davResource) error {
+	switch resource.kind {
+	case davKindList:
+		shop, ok, err := davShop(db, resource.list)
+		if err != nil || !ok {
+			return davListError(ctx, "davGet", err)
+		}
+		items, err := davListItems(db, resource.list)
+		if err != nil {
+			ctx.Logger().Infof("davGet: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read items")
+		}
+		return ctx.Blob(http.StatusOK, davContentType, []byte(RenderCalendar(davTitle(shop), items)))
+	case davKindItem:
+		item, ok, err := findItem(db, resource.list, resource.uid)
+		if err != nil {
+			ctx.Logger().Infof("davGet: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read item")
+		}
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "No such item")
+		}
+		ctx.Response().Header().Set("ETag", davETag(&item))
+		return ctx.Blob(http.StatusOK, davContentType, []byte(RenderVTodo(&item)))
+	}
+	return echo.NewHTTPError(http.StatusMethodNotAllowed, "Method not allowed")
+}
+
+// davListError answers requests for lists that do not exist, or could not be read
+func davListError(ctx echo.Context, fn string, err error) error {
+	if err != nil {
+		ctx.Logger().Infof("%s: Database Error on get %v", fn, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not read shops")
+	}
+	return echo.NewHTTPError(http.StatusNotFound, "No such list")
+}
+
+// davPreconditions checks If-Match and If-None-Match against the current state of an item
+func davPreconditions(ctx echo.Context, item *Item, exists bool) bool {
+	if match := ctx.Request().Header.Get("If-Match"); match != "" {
+		if !exists || (match != "*" && match != davETag(item)) {
+			return false
+		}
+	}
+	if noneMatch := ctx.Request().Header.Get("If-None-Match"); noneMatch != "" && exists {
+		if noneMatch == "*" || noneMatch == davETag(item) {
+			return false
+		}
+	}
+	return true
+}
+
+// davPut creates or updates an item, the uid is taken from the path
+func davPut(ctx echo.Context, db *sql.DB, notifier *Notifier, resource davResource) error {
+	if resource.kind != davKindItem {
+		return echo.NewHTTPError(http.StatusMethodNotAllowed, "Method not allowed")
+	}
+	body, err := io.ReadAll(io.LimitReader(ctx.Request().Body, davMaxBodyBytes))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+	}
+	todo, err := ParseVTodo(string(body))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, "Only calendar objects with a VTODO are supported")
+	}
+
+	shop, ok, err := davShop(db, resource.list)
+	if err != nil || !ok {
+		return davListError(ctx, "davPut", err)
+	}
+
+	created := false
+	_, _, err = UpdateItems(db, notifier, "caldav", author(ctx), func(items []Item) ([]Item, error) {
+		index, orderno := -1, 0
+		for i := range items {
+			if items[i].UId == resource.uid {
+				index = i
+			}
+			if items[i].Orderno >= orderno {
+				orderno = items[i].Orderno + 1
+			}
+		}
+		var item Item
+		if index >= 0 {
+			// the same uid on another list is another resource, a client can not take it over
+			if itemList(&items[index]) != resource.list {
+				return nil, errDavConflict
+			}
+			if !davPreconditions(ctx, &items[index], true) {
+				return nil, errDavPrecondition
+			}
+			item = itemFromVTodo(items[index], todo, shop)
+		} else {
+			if !davPreconditions(ctx, nil, false) {
+				return nil, errDavPrecondition
+			}
+			created = true
+			item = itemFromVTodo(Item{UId: resource.uid, Orderno: orderno}, todo, shop)
+		}
+		if ok, messages := item.Valid(); !ok {
+			return nil, fmt.Errorf("%w: %s", errDavInvalid, strings.Join(messages, ", "))
+		}
+		if index >= 0 {
+			items[index] = item
+			return items, nil
+		}
+		return append(items, item), nil
+	})
+	switch {
+	case errors.Is(err, errDavPrecondition):
+		return echo.NewHTTPError(http.StatusPreconditionFailed, "Precondition failed")
+	case errors.Is(err, errDavConflict):
+		return echo.NewHTTPError(http.StatusConflict, "The item is on another list")
+	case errors.Is(err, errDavInvalid):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case err != nil:
+		ctx.Logger().Infof("davPut: Database Error on update %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not change item")
+	}
+
+	item, _, err := findItem(db, resource.list, resource.uid)
+	if err != nil {
+		ctx.Logger().Infof("davPut: Database Error on get %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not read item")
+	}
+	ctx.Response().Header().Set("ETag", davETag(&item))
+	if created {
+		return ctx.NoContent(http.StatusCreated)
+	}
+	return ctx.NoContent(http.StatusNoContent)
+}
+
+// davDelete moves an item to the trash
+func davDelete(ctx echo.Context, db *sql.DB, notifier *Notifier, resource davResource) error {
+	if resource.kind != davKindItem {
+		return echo.NewHTTPError(http.StatusMethodNotAllowed, "Method not allowed")
+	}
+
+	_, _, err := UpdateItems(db, notifier, "caldav", author(ctx), func(items []Item) ([]Item, error) {
+		for i := range items {
+			if items[i].UId == resource.uid && itemList(&items[i]) == resource.list {
+				if !davPreconditions(ctx, &items[i], true) {
+					return nil, errDavPrecondition
+				}
+				return append(items[:i], items[i+1:]...), nil
+			}
+		}
+		return nil, errDavNotFound
+	})
+	switch {
+	case errors.Is(err, errDavNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "No such item")
+	case errors.Is(err, errDavPrecondition):
+		return echo.NewHTTPError(http.StatusPreconditionFailed, "Precondition failed")
+	case err != nil:
+		ctx.Logger().Infof("davDelete: Database Error on update %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not delete item")
+	}
+	return ctx.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// newDavServer serves CalDAV like main does, with an item without shop and one on the list of a shop
+func newDavServer(t *testing.T) (*sql.DB, *echo.Echo) {
+	db := newTestDB(t)
+	if _, err := CreateUser(db, "alice", "secret123", false); err != nil {
+		t.Fatal(err)
+	}
+	shop := Shop{UId: "s1", Name: "Kiosk"}
+	if err := UpsertShop(db, &shop); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpsertItem(db, &Item{UId: "i1", Title: "Bread", Status: StatusOpen}); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpsertItem(db, &Item{UId: "i2", Title: "7 Up", Status: StatusOpen, Shop: &shop}); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	dav := e.Group(davPrefix, userAuth(db, SessionConfig{Lifetime: time.Hour}, true), listAccess(db))
+	dav.Any("", davHandler(db, nil))
+	dav.Any("/*", davHandler(db, nil))
+	return db, e
+}
+
+func davRequest(e *echo.Echo, method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.SetBasicAuth("alice", "secret123")
+	for name, value := range header {
+		request.Header.Set(name, value)
+	}
+	answer := httptest.NewRecorder()
+	e.ServeHTTP(answer, request)
+	return answer
+}
+
+func TestParseDavPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		ok       bool
+		resource davResource
+	}{
+		{"/dav", true, davResource{kind: davKindRoot, href: "/dav/"}},
+		{"/dav/", true, davResource{kind: davKindRoot, href: "/dav/"}},
+		{"/dav/principal/", true, davResource{kind: davKindPrincipal, href: davPrincipal}},
+		{"/dav/calendars", true, davResource{kind: davKindHome, href: davHome}},
+		{"/dav/calendars/none/", true, davResource{kind: davKindList, href: "/dav/calendars/none/", list: ListNone}},
+		{"/dav/calendars/s1", true, davResource{kind: davKindList, href: "/dav/calendars/s1/", list: "s1"}},
+		{"/dav/calendars/s1/i2.ics", true, davResource{kind: davKindItem, href: "/dav/calendars/s1/i2.ics", list: "s1", uid: "i2"}},
+		{"/dav/calendars/s1/.ics", false, davResource{}},
+		{"/dav/calendars/s1/i2.txt", false, davResource{}},
+		{"/dav/calendars/s1/i2.ics/more", false, davResource{}},
+		{"/dav/other", false, davResource{}},
+	}
+	for _, test := range tests {
+		resource, ok := parseDavPath(test.path)
+		if ok != test.ok || (ok && resource != test.resource) {
+			t.Errorf("%q: parsed %+v %v instead of %+v %v", test.path, resource, ok, test.resource, test.ok)
+		}
+	}
+}
+
+// TestItemFromVTodo makes sure that titles starting with a number survive a round trip
+func TestItemFromVTodo(t *testing.T) {
+	tests := []struct {
+		name    string
+		item    Item
+		summary string
+		want    Item
+	}{
+		{"number in title", Item{Title: "7 Up"}, "7 Up", Item{Title: "7 Up"}},
+		{"unchanged quantity", Item{Title: "Flour", Quantity: 2, Unit: "kg"}, "2 kg Flour", Item{Title: "Flour", Quantity: 2, Unit: "kg"}},
+		{"changed quantity", Item{Title: "Flour", Quantity: 2, Unit: "kg"}, "3 kg Flour", Item{Title: "Flour", Quantity: 3, Unit: "kg"}},
+		{"new item", Item{}, "2 Apples", Item{Title: "Apples", Quantity: 2}},
+	}
+	for _, test := range tests {
+		item := itemFromVTodo(test.item, VTodo{Summary: test.summary, Completed: true}, nil)
+		if item.Title != test.want.Title || item.Quantity != test.want.Quantity || item.Unit != test.want.Unit || item.Status != StatusChecked {
+			t.Errorf("%q: item is %+v", test.name, item)
+		}
+	}
+}
+
+func TestDavPropfind(t *testing.T) {
+	_, e := newDavServer(t)
+	tests := []struct {
+		path, depth string
+		status      int
+		responses   int
+		contains    string
+	}{
+		{"/dav/calendars/", "0", http.StatusMultiStatus, 1, "<d:href>/dav/calendars/</d:href>"},
+		{"/dav/calendars/", "1", http.StatusMultiStatus, 3, "<d:href>/dav/calendars/s1/</d:href>"},
+		{"/dav/calendars/s1/", "0", http.StatusMultiStatus, 1, "<d:displayname>Shopping list: Kiosk</d:displayname>"},
+		{"/dav/calendars/s1/", "1", http.StatusMultiStatus, 2, "<d:href>/dav/calendars/s1/i2.ics</d:href>"},
+		{"/dav/calendars/none/", "1", http.StatusMultiStatus, 2, "<d:href>/dav/calendars/none/i1.ics</d:href>"},
+		{"/dav/calendars/s1/i2.ics", "0", http.StatusMultiStatus, 1, "<d:getetag>"},
+		{"/dav/calendars/s1/i1.ics", "0", http.StatusNotFound, 0, ""},
+		{"/dav/calendars/nope/", "0", http.StatusNotFound, 0, ""},
+	}
+	for _, test := range tests {
+		answer := davRequest(e, echo.PROPFIND, test.path, "", map[string]string{"Depth": test.depth})
+		if answer.Code != test.status {
+			t.Errorf("%q depth %s: answered %d instead of %d", test.path, test.depth, answer.Code, test.status)
+			continue
+		}
+		body := answer.Body.String()
+		if responses := strings.Count(body, "<d:response>"); responses != test.responses {
+			t.Errorf("%q depth %s: %d responses instead of %d: %s", test.path, test.depth, responses, test.responses, body)
+		}
+		if !strings.Contains(body, test.contains) {
+			t.Errorf("%q depth %s: answer does not contain %s: %s", test.path, test.depth, test.contains, body)
+		}
+	}
+}
+
+func TestDavReportMultiget(t *testing.T) {
+	_, e := newDavServer(t)
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<c:calendar-multiget xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">
+  <d:prop><d:getetag/><c:calendar-data/></d:prop>
+  <d:href>/dav/calendars/s1/i2.ics</d:href>
+  <d:href>/dav/calendars/s1/nope.ics</d:href>
+  <d:href>/dav/calendars/s1/i1.ics</d:href>
+  <d:href>/dav/elsewhere</d:href>
+</c:calendar-multiget>`
+	answer := davRequest(e, echo.REPORT, "/dav/calendars/s1/", body, nil)
+	if answer.Code != http.StatusMultiStatus {
+		t.Fatalf("report answered %d: %s", answer.Code, answer.Body)
+	}
+	result := answer.Body.String()
+	if !strings.Contains(result, "SUMMARY:7 Up") {
+		t.Errorf("report has no calendar data for the known item: %s", result)
+	}
+	for _, href := range []string{"/dav/calendars/s1/nope.ics", "/dav/calendars/s1/i1.ics", "/dav/elsewhere"} {
+		if !strings.Contains(result, "<d:response><d:href>"+href+"</d:href><d:status>HTTP/1.1 404 Not Found</d:status></d:response>") {
+			t.Errorf("report does not say that %s was not found: %s", href, result)
+		}
+	}
+
+	if answer = davRequest(e, echo.REPORT, "/dav/calendars/", body, nil); answer.Code != http.StatusForbidden {
+		t.Errorf("report on the calendar home answered %d", answer.Code)
+	}
+}
+
+func TestDavPutDelete(t *testing.T) {
+	db, e := newDavServer(t)
+	todo := func(summary, status string) string {
+		return "BEGIN:VCALENDAR\r\nBEGIN:VTODO\r\nUID:x\r\nSUMMARY:" + summary + "\r\nSTATUS:" + status + "\r\nEND:VTODO\r\nEND:VCALENDAR\r\n"
+	}
+	etag := func(path string) string {
+		answer := davRequest(e, http.MethodGet, path, "", nil)
+		if answer.Code != http.StatusOK {
+			t.Fatalf("GET %s answered %d", path, answer.Code)
+		}
+		return answer.Header().Get("ETag")
+	}
+
+	// ticking off an item keeps a title that starts with a number
+	answer := davRequest(e, http.MethodPut, "/dav/calendars/s1/i2.ics", todo("7 Up", "COMPLETED"), map[string]string{"If-Match": etag("/dav/calendars/s1/i2.ics")})
+	if answer.Code != http.StatusNoContent {
+		t.Fatalf("ticking off answered %d: %s", answer.Code, answer.Body)
+	}
+	if item, err := GetItemByID(db, "i2"); err != nil || item.Title != "7 Up" || item.Quantity != 0 || item.Status != StatusChecked {
+		t.Errorf("ticked off item is %+v %v", item, err)
+	}
+
+	tests := []struct {
+		name, method, path, body string
+		header                   map[string]string
+		status                   int
+	}{
+		{"create", http.MethodPut, "/dav/calendars/s1/n1.ics", todo("Milk", "NEEDS-ACTION"), map[string]string{"If-None-Match": "*"}, http.StatusCreated},
+		{"create again", http.MethodPut, "/dav/calendars/s1/n1.ics", todo("Milk", "NEEDS-ACTION"), map[string]string{"If-None-Match": "*"}, http.StatusPreconditionFailed},
+		{"update missing", http.MethodPut, "/dav/calendars/s1/n2.ics", todo("Milk", "NEEDS-ACTION"), map[string]string{"If-Match": "*"}, http.StatusPreconditionFailed},
+		{"update old etag", http.MethodPut, "/dav/calendars/s1/n1.ics", todo("Oat milk", "NEEDS-ACTION"), map[string]string{"If-Match": `"0"`}, http.StatusPreconditionFailed},
+		{"update any", http.MethodPut, "/dav/calendars/s1/n1.ics", todo("Oat milk", "NEEDS-ACTION"), map[string]string{"If-Match": "*"}, http.StatusNoContent},
+		{"uid on another list", http.MethodPut, "/dav/calendars/s1/i1.ics", todo("Bread", "NEEDS-ACTION"), nil, http.StatusConflict},
+		{"unknown list", http.MethodPut, "/dav/calendars/nope/n3.ics", todo("Bread", "NEEDS-ACTION"), nil, http.StatusNotFound},
+		{"no todo", http.MethodPut, "/dav/calendars/s1/n3.ics", "BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n", nil, http.StatusUnsupportedMediaType},
+		{"delete old etag", http.MethodDelete, "/dav/calendars/s1/n1.ics", "", map[string]string{"If-Match": `"0"`}, http.StatusPreconditionFailed},
+		{"delete if none match", http.MethodDelete, "/dav/calendars/s1/n1.ics", "", map[string]string{"If-None-Match": "*"}, http.StatusPreconditionFailed},
+		{"delete from another list", http.MethodDelete, "/dav/calendars/s1/i1.ics", "", nil, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if answer := davRequest(e, test.method, test.path, test.body, test.header); answer.Code != test.status {
+			t.Errorf("%q: answered %d instead of %d: %s", test.name, answer.Code, test.status, answer.Body)
+		}
+	}
+
+	path := "/dav/calendars/s1/n1.ics"
+	if answer = davRequest(e, http.MethodDelete, path, "", map[string]string{"If-Match": etag(path)}); answer.Code != http.StatusNoContent {
+		t.Errorf("delete answered %d: %s", answer.Code, answer.Body)
+	}
+	if answer = davRequest(e, http.MethodDelete, path, "", nil); answer.Code != http.StatusNotFound {
+		t.Errorf("deleting again answered %d", answer.Code)
+	}
+}
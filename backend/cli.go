@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Command is a CLI subcommand that is run instead of starting the web server
+type Command struct {
+	Usage       string
+	Description string
+	Run         func(args []string) error
+}
+
+// Commands maps the subcommand names to their implementation
+var Commands map[string]Command
+
+// the map is filled in init, because the commands refer back to it for their usage
+func init() {
+	Commands = map[string]Command{
+		"export": {
+			Usage:       "export [-db FILE] [-o FILE]",
+			Description: "Write all items, shops, recipes and meals as JSON document to stdout or a file",
+			Run:         runExport,
+		},
+		"import": {
+			Usage:       "import [-db FILE] [-mode replace|merge] FILE",
+			Description: "Read a JSON document created by export, - reads from stdin. Running servers are not notified.",
+			Run:         runImport,
+		},
+		"todotxt-export": {
+			Usage:       "todotxt-export [-db FILE] [-o FILE] [-open]",
+			Description: "Write all items in todo.txt format to stdout or a file",
+			Run:         runTodoTxtExport,
+		},
+		"users": {
+			Usage:       "users [-db FILE] [-admin] list|add|passwd|grant-admin|revoke-admin|delete [NAME]",
+			Description: "Manage the users, add and passwd read the password from stdin",
+			Run:         runUsers,
+		},
+		"todotxt-import": {
+			Usage:       "todotxt-import [-db FILE] [-preview] FILE",
+			Description: "Merge the tasks of a todo.txt file into the items, - reads from stdin. Running servers are not notified.",
+			Run:         runTodoTxtImport,
+		},
+	}
+}
+
+// runCommand executes the subcommand given on the command line.
+// Returns false if the arguments do not start with a known subcommand.
+func runCommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	cmd, ok := Commands[args[0]]
+	if !ok {
+		return false, nil
+	}
+	return true, cmd.Run(args[1:])
+}
+
+// commandUsage prints all available subcommands, it is appended to the usage of the server flags
+func commandUsage() {
+	names := make([]string, 0, len(Commands))
+	for name := range Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "\nSubcommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(out, "  %s\n    \t%s\n", Commands[name].Usage, Commands[name].Description)
+	}
+}
+
+// newCommandFlags creates the flag set for a subcommand with the options all of them share
+func newCommandFlags(name string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s\n", os.Args[0], Commands[name].Usage)
+		flags.PrintDefaults()
+	}
+	dbFile := flags.String("db", "storage.db", "The file to store the sqlite3 database")
+	return flags, dbFile
+}
+
+// openInput opens the named file for reading, - is stdin
+func openInput(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(name)
+}
+
+// openOutput opens the named file for writing, empty or - is stdout
+func openOutput(name string) (io.WriteCloser, error) {
+	if name == "" || name == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	return os.Create(name)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func runExport(args []string) error {
+	flags, dbFile := newCommandFlags("export")
+	outFile := flags.String("o", "", "The file to write to, defaults to stdout")
+	flags.Parse(args)
+
+	db := initDB(*dbFile)
+	defer db.Close()
+	migrate(db)
+
+	export, err := ExportAll(db)
+	if err != nil {
+		return err
+	}
+
+	out, err := openOutput(*outFile)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(export); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func runImport(args []string) error {
+	flags, dbFile := newCommandFlags("import")
+	mode := flags.String("mode", ImportMerge, "How to import: replace deletes everything not in the file, merge keeps it")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("need exactly one file to import")
+	}
+	if !isAllowedImportMode(*mode) {
+		return fmt.Errorf("mode must be %s or %s", ImportReplace, ImportMerge)
+	}
+
+	in, err := openInput(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	export := &Export{}
+	if err = json.NewDecoder(in).Decode(export); err != nil {
+		return fmt.Errorf("can not read %s: %w", flags.Arg(0), err)
+	}
+	if ok, errors := export.Valid(); !ok {
+		return fmt.Errorf("invalid document: %s", strings.Join(errors, "; "))
+	}
+
+	db := initDB(*dbFile)
+	defer db.Close()
+	migrate(db)
+
+	changes, err := ImportAll(db, nil, export, *mode, Author{})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "imported %d items, %d shops, %d recipes and %d meals, %d changes\n",
+		len(export.Items.Items), len(export.Shops.Shops), len(export.Recipes), len(export.Meals), len(changes))
+	return nil
+}
+
+func runTodoTxtExport(args []string) error {
+	flags, dbFile := newCommandFlags("todotxt-export")
+	outFile := flags.String("o", "", "The file to write to, defaults to stdout")
+	openOnly := flags.Bool("open", false, "Only export OPEN items")
+	flags.Parse(args)
+
+	db := initDB(*dbFile)
+	defer db.Close()
+	migrate(db)
+
+	items, err := GetAllItems(db)
+	if err != nil {
+		return err
+	}
+	shops, err := GetAllShops(db)
+	if err != nil {
+		return err
+	}
+
+	out, err := openOutput(*outFile)
+	if err != nil {
+		return err
+	}
+	if err = RenderTodoTxt(out, GroupItemsByShop(items.Items, shops.Shops, *openOnly)); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func runTodoTxtImport(args []string) error {
+	flags, dbFile := newCommandFlags("todotxt-import")
+	preview := flags.Bool("preview", false, "Only show what would be imported")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("need exactly one file to import")
+	}
+	in, err := openInput(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	text, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+
+	db := initDB(*dbFile)
+	defer db.Close()
+	migrate(db)
+
+	shops, err := GetAllShops(db)
+	if err != nil {
+		return err
+	}
+	parsed, warnings := ParseTodoTxt(string(text), shops.Shops)
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, warning)
+	}
+
+	if *preview {
+		return RenderTodoTxt(os.Stdout, []ShopGroup{{Items: parsed}})
+	}
+	result, _, err := ImportItems(db, nil, parsed, false, "todotxt-import", Author{})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "imported %d items\n", len(result))
+	return nil
+}
+
+func runUsers(args []string) error {
+	flags, dbFile := newCommandFlags("users")
+	admin := flags.Bool("admin", false, "Make the added user an admin")
+	flags.Parse(args)
+
+	action := flags.Arg(0)
+	name := flags.Arg(1)
+	if action == "" || (action != "list" && name == "") {
+		flags.Usage()
+		return fmt.Errorf("need an action and, except for list, a user name")
+	}
+
+	db := initDB(*dbFile)
+	defer db.Close()
+	migrate(db)
+
+	var num int
+	var err error
+	switch action {
+	case "list":
+		users, err := GetUsers(db)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			role := "user"
+			if user.Admin {
+				role = "admin"
+			}
+			fmt.Printf("%s\t%s\t%s\n", user.Name, role, time.Unix(user.CreatedAt, 0).Format(time.DateTime))
+		}
+		return nil
+	case "add":
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		input := UserInput{Name: name, Password: password}
+		if ok, errors := input.Valid(); !ok {
+			return fmt.Errorf("invalid user: %s", strings.Join(errors, "; "))
+		}
+		if _, err = GetUserByName(db, name); err == nil {
+			return fmt.Errorf("user %s exists already", name)
+		}
+		count, err := CountUsers(db)
+		if err != nil {
+			return err
+		}
+		// the first user has to be admin, or nobody could manage the others
+		_, err = CreateUser(db, name, password, *admin || count == 0)
+		return err
+	case "passwd":
+		var password string
+		password, err = readPassword()
+		if err != nil {
+			return err
+		}
+		input := UserInput{Name: name, Password: password}
+		if ok, errors := input.Valid(); !ok {
+			return fmt.Errorf("invalid password: %s", strings.Join(errors, "; "))
+		}
+		num, err = SetPassword(db, name, password)
+	case "grant-admin":
+		num, err = SetAdmin(db, name, true)
+	case "revoke-admin":
+		num, err = SetAdmin(db, name, false)
+	case "delete":
+		num, err = DeleteUserByName(db, name)
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown action %s", action)
+	}
+	if err != nil {
+		return err
+	}
+	if num == 0 {
+		return fmt.Errorf("no user %s", name)
+	}
+	return nil
+}
+
+// readPassword reads a password from the first line of stdin, without echoing it on a terminal
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -3,12 +3,25 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// queryer is what the database access functions need, so that they work on the database
+// as well as within a transaction
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 func initDB(filepath string) *sql.DB {
-	db, err := sql.Open("sqlite3", filepath)
+	// transactions take the write lock right away and wait for each other,
+	// also when several instances share the file
+	db, err := sql.Open("sqlite3", filepath+"?_busy_timeout=5000&_txlock=immediate")
 
 	// Here we check for any db errors then exit
 	if err != nil {
@@ -45,6 +58,110 @@ func migrate(db *sql.DB) {
 	);
 	INSERT INTO versions (id, items, shops) VALUES (1, 0, 0)
   		ON CONFLICT(id) DO NOTHING;
+	CREATE TABLE IF NOT EXISTS changesets (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at INTEGER NOT NULL,
+		source VARCHAR NOT NULL,
+		revert_of INTEGER REFERENCES changesets(id)
+	);
+	CREATE TABLE IF NOT EXISTS changes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		changeset_id INTEGER NOT NULL REFERENCES changesets(id),
+		entity VARCHAR NOT NULL,
+		uid VARCHAR NOT NULL,
+		action VARCHAR NOT NULL,
+		before_state TEXT,
+		after_state TEXT
+	);
+	CREATE TABLE IF NOT EXISTS snapshots (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at INTEGER NOT NULL,
+		label VARCHAR NOT NULL,
+		automatic BOOLEAN NOT NULL,
+		item_version INTEGER NOT NULL,
+		shop_version INTEGER NOT NULL,
+		items TEXT NOT NULL,
+		shops TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS recipes (
+		uid VARCHAR NOT NULL PRIMARY KEY,
+		name VARCHAR NOT NULL,
+		servings REAL NOT NULL DEFAULT 0,
+		source VARCHAR NOT NULL DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS recipe_ingredients (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		recipe_id VARCHAR NOT NULL REFERENCES recipes(uid),
+		position INTEGER NOT NULL,
+		title VARCHAR NOT NULL,
+		quantity REAL NOT NULL DEFAULT 0,
+		unit VARCHAR NOT NULL DEFAULT '',
+		text VARCHAR NOT NULL DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS meals (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		day VARCHAR NOT NULL,
+		recipe_id VARCHAR NOT NULL REFERENCES recipes(uid),
+		servings REAL NOT NULL DEFAULT 0
+	);
+	CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name VARCHAR NOT NULL UNIQUE,
+		password_hash BLOB NOT NULL,
+		admin BOOLEAN NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS members (
+		user_id INTEGER NOT NULL PRIMARY KEY REFERENCES users(id),
+		role VARCHAR NOT NULL,
+		joined_at INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS sessions (
+		id VARCHAR NOT NULL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		token_hash VARCHAR NOT NULL UNIQUE,
+		previous_hash VARCHAR NOT NULL DEFAULT '',
+		csrf_token VARCHAR NOT NULL,
+		user_agent VARCHAR NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		rotated_at INTEGER NOT NULL,
+		last_seen INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS tokens (
+		id VARCHAR NOT NULL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		name VARCHAR NOT NULL,
+		scope VARCHAR NOT NULL,
+		token_hash VARCHAR NOT NULL UNIQUE,
+		created_at INTEGER NOT NULL,
+		last_used INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE IF NOT EXISTS shares (
+		id VARCHAR NOT NULL PRIMARY KEY,
+		name VARCHAR NOT NULL,
+		scope VARCHAR NOT NULL,
+		token_hash VARCHAR NOT NULL UNIQUE,
+		created_by VARCHAR NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE IF NOT EXISTS identities (
+		issuer VARCHAR NOT NULL,
+		subject VARCHAR NOT NULL,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		email VARCHAR NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (issuer, subject)
+	);
+	CREATE TABLE IF NOT EXISTS broker_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at INTEGER NOT NULL,
+		origin VARCHAR NOT NULL,
+		topic VARCHAR NOT NULL,
+		lists TEXT NOT NULL,
+		data TEXT NOT NULL
+	);
     `
 
 	_, err := db.Exec(sql)
@@ -52,6 +169,57 @@ func migrate(db *sql.DB) {
 	if err != nil {
 		panic(err)
 	}
+
+	// columns added after the tables were created
+	addColumn(db, "items", "deleted_at", "INTEGER")
+	addColumn(db, "shops", "deleted_at", "INTEGER")
+	addColumn(db, "items", "quantity", "REAL NOT NULL DEFAULT 0")
+	addColumn(db, "items", "unit", "VARCHAR NOT NULL DEFAULT ''")
+	addColumn(db, "items", "category", "VARCHAR NOT NULL DEFAULT ''")
+	addColumn(db, "items", "revision", "INTEGER NOT NULL DEFAULT 1")
+	addColumn(db, "items", "recipes", "VARCHAR NOT NULL DEFAULT ''")
+	addColumn(db, "changesets", "user", "VARCHAR NOT NULL DEFAULT ''")
+	addColumn(db, "versions", "revision", "INTEGER NOT NULL DEFAULT 0")
+	addColumn(db, "users", "oidc", "BOOLEAN NOT NULL DEFAULT 0")
+	addColumn(db, "shares", "list", "VARCHAR NOT NULL DEFAULT ''")
+
+	// versions.revision is the highest item revision ever written, so that an item that is
+	// purged and created again does not get a revision it already had before
+	_, err = db.Exec(`UPDATE versions SET revision = MAX(revision, (SELECT COALESCE(MAX(revision), 0) FROM items)) WHERE id = 1;
+	CREATE TRIGGER IF NOT EXISTS items_revision_insert AFTER INSERT ON items BEGIN
+		UPDATE versions SET revision = MAX(revision, NEW.revision) WHERE id = 1;
+	END;
+	CREATE TRIGGER IF NOT EXISTS items_revision_update AFTER UPDATE OF revision ON items BEGIN
+		UPDATE versions SET revision = MAX(revision, NEW.revision) WHERE id = 1;
+	END;`)
+	if err != nil {
+		panic(err)
+	}
+
+	// users from before the household keep their access, admins own it
+	_, err = db.Exec(`INSERT INTO members(user_id, role, joined_at)
+		SELECT id, CASE admin WHEN 1 THEN 'owner' ELSE 'editor' END, created_at FROM users
+		WHERE NOT EXISTS (SELECT 1 FROM members)`)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// addColumn adds a column to an existing table, unless it is already there
+func addColumn(db *sql.DB, table, column, definition string) {
+	rows, err := db.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s') WHERE name = ?", table), column)
+	if err != nil {
+		panic(err)
+	}
+	exists := rows.Next()
+	rows.Close()
+	if exists {
+		return
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		panic(err)
+	}
 }
 
 // ********************************** //
@@ -59,7 +227,7 @@ func migrate(db *sql.DB) {
 // ********************************** //
 
 // versions:
-func GetVersions(db *sql.DB) (Versions, error) {
+func GetVersions(db queryer) (Versions, error) {
 	result := Versions{}
 	sql := "SELECT items, shops FROM versions"
 	rows, err := db.Query(sql)
@@ -80,14 +248,30 @@ func GetVersions(db *sql.DB) (Versions, error) {
 	return result, nil
 }
 
+// SetItemVersion stores a new version for the item list
+func SetItemVersion(db queryer, version int64) error {
+	_, err := db.Exec("UPDATE versions SET items = ? WHERE id = 1", version)
+	return err
+}
+
+// SetShopVersion stores a new version for the shop list
+func SetShopVersion(db queryer, version int64) error {
+	_, err := db.Exec("UPDATE versions SET shops = ? WHERE id = 1", version)
+	return err
+}
+
 // items
 
+// nextRevision is the SQL expression for the revision of a changed item. The revisions only
+// ever grow, even across purging an item from the trash, they serve as CalDAV ETags.
+const nextRevision = "(SELECT revision + 1 FROM versions WHERE id = 1)"
+
 // GetAllItems from database
-func GetAllItems(db *sql.DB) (ItemCollection, error) {
+func GetAllItems(db queryer) (ItemCollection, error) {
 	result := ItemCollection{}
 	result.Items = make([]Item, 0)
 
-	sql := "SELECT uid, title, status, orderno, shop_id FROM items ORDER BY orderno, uid"
+	sql := "SELECT uid, title, status, orderno, quantity, unit, category, recipes, revision, shop_id FROM items WHERE deleted_at IS NULL ORDER BY orderno, uid"
 	rows, err := db.Query(sql)
 	// Exit if the SQL doesn't work for some reason
 	if err != nil {
@@ -98,18 +282,22 @@ func GetAllItems(db *sql.DB) (ItemCollection, error) {
 
 	for rows.Next() {
 		item := Item{}
-		var shopId string
-		err = rows.Scan(&item.UId, &item.Title, &item.Status, &item.Orderno, &shopId)
+		var shopId, recipes string
+		err = rows.Scan(&item.UId, &item.Title, &item.Status, &item.Orderno, &item.Quantity, &item.Unit, &item.Category, &recipes, &item.Revision, &shopId)
 		// Exit if we get an error
 		if err != nil {
 			return result, err
 		}
+		item.Recipes = splitRecipeNames(recipes)
+		// a shop in the trash is left out, see GetShopByID
 		if len(shopId) > 0 {
 			shop, err := GetShopByID(db, shopId)
 			if err != nil {
 				return result, err
 			}
-			item.Shop = &shop
+			if shop.UId != "" {
+				item.Shop = &shop
+			}
 		}
 		result.Items = append(result.Items, item)
 	}
@@ -125,10 +313,10 @@ func GetAllItems(db *sql.DB) (ItemCollection, error) {
 }
 
 // GetItemByID loads one item from database, identified by its id
-func GetItemByID(db *sql.DB, uid string) (Item, error) {
+func GetItemByID(db queryer, uid string) (Item, error) {
 	result := Item{}
-	var shopId string
-	sql := "SELECT uid, title, status, orderno, shop_id FROM items WHERE uid = ?"
+	var shopId, recipes string
+	sql := "SELECT uid, title, status, orderno, quantity, unit, category, recipes, revision, shop_id FROM items WHERE uid = ? AND deleted_at IS NULL"
 	rows, err := db.Query(sql, uid)
 	// Exit if the SQL doesn't work for some reason
 	if err != nil {
@@ -138,17 +326,21 @@ func GetItemByID(db *sql.DB, uid string) (Item, error) {
 	defer rows.Close()
 
 	for rows.Next() {
-		err = rows.Scan(&result.UId, &result.Title, &result.Status, &result.Orderno, &shopId)
+		err = rows.Scan(&result.UId, &result.Title, &result.Status, &result.Orderno, &result.Quantity, &result.Unit, &result.Category, &recipes, &result.Revision, &shopId)
 		// Exit if we get an error
 		if err != nil {
 			return result, err
 		}
+		result.Recipes = splitRecipeNames(recipes)
+		// a shop in the trash is left out, see GetShopByID
 		if len(shopId) > 0 {
 			shop, err := GetShopByID(db, shopId)
 			if err != nil {
 				return result, err
 			}
-			result.Shop = &shop
+			if shop.UId != "" {
+				result.Shop = &shop
+			}
 		}
 
 	}
@@ -157,12 +349,18 @@ func GetItemByID(db *sql.DB, uid string) (Item, error) {
 
 // UpsertItem writes an item to database.
 // Whether to INSRT or UPDATE is determined by the existence if its ID field
-// modifies the item, adds the ID on creates.
-func UpsertItem(db *sql.DB, item *Item) error {
-
-	DeleteItemByID(db, item.UId)
-
-	var query = "INSERT INTO items(uid, title, status, orderno, shop_id ) VALUES(?, ?, ?, ?, ?)"
+// modifies the item, adds the ID on creates. Items in the trash are restored.
+// The item gets the next revision only if anything changed.
+func UpsertItem(db queryer, item *Item) error {
+
+	var query = `INSERT INTO items(uid, title, status, orderno, quantity, unit, category, recipes, shop_id, revision ) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ` + nextRevision + `)
+		ON CONFLICT(uid) DO UPDATE SET title = excluded.title, status = excluded.status,
+		orderno = excluded.orderno, quantity = excluded.quantity, unit = excluded.unit,
+		category = excluded.category, recipes = excluded.recipes, shop_id = excluded.shop_id,
+		deleted_at = NULL, revision = excluded.revision
+		WHERE title IS NOT excluded.title OR status IS NOT excluded.status OR orderno IS NOT excluded.orderno
+		OR quantity IS NOT excluded.quantity OR unit IS NOT excluded.unit OR category IS NOT excluded.category
+		OR recipes IS NOT excluded.recipes OR shop_id IS NOT excluded.shop_id OR deleted_at IS NOT NULL`
 
 	// Create a prepared SQL statement
 	stmt, err := db.Prepare(query)
@@ -179,13 +377,21 @@ func UpsertItem(db *sql.DB, item *Item) error {
 		shopId = item.Shop.UId
 	}
 
-	_, err = stmt.Exec(item.UId, item.Title, item.Status, item.Orderno, shopId)
+	_, err = stmt.Exec(item.UId, item.Title, item.Status, item.Orderno, item.Quantity, item.Unit, item.Category, strings.Join(item.Recipes, "\n"), shopId)
 
 	return err
 }
 
+// splitRecipeNames reads the recipes column, which holds one recipe name per line
+func splitRecipeNames(recipes string) []string {
+	if recipes == "" {
+		return nil
+	}
+	return strings.Split(recipes, "\n")
+}
+
 // ReplaceItemList completely replaces the List in the database
-func ReplaceItemList(db *sql.DB, list *ItemCollection) error {
+func ReplaceItemList(db queryer, list *ItemCollection) error {
 	var errList []error
 	// get the original list:
 	orig, err := GetAllItems(db)
@@ -221,13 +427,7 @@ func ReplaceItemList(db *sql.DB, list *ItemCollection) error {
 	}
 
 	// set version:
-	var query = "UPDATE versions SET items = ? WHERE id = 1"
-	stmt, err := db.Prepare(query)
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-	_, err = stmt.Exec(list.Version)
+	err = SetItemVersion(db, list.Version)
 	if err != nil {
 		errList = append(errList, err)
 	}
@@ -243,10 +443,10 @@ func ReplaceItemList(db *sql.DB, list *ItemCollection) error {
 	return nil
 }
 
-// DeleteItemByID deletes one item from the database, identified by its id
-func DeleteItemByID(db *sql.DB, id string) (int, error) {
+// DeleteItemByID moves one item to the trash, identified by its id
+func DeleteItemByID(db queryer, id string) (int, error) {
 
-	sql := "DELETE FROM items WHERE uid = ?"
+	sql := "UPDATE items SET deleted_at = ?, revision = " + nextRevision + " WHERE uid = ? AND deleted_at IS NULL"
 
 	// Create a prepared SQL statement
 	stmt, err := db.Prepare(sql)
@@ -258,7 +458,7 @@ func DeleteItemByID(db *sql.DB, id string) (int, error) {
 	defer stmt.Close()
 
 	// Execute
-	result, err := stmt.Exec(id)
+	result, err := stmt.Exec(time.Now().Unix(), id)
 	// Exit if we get an error
 	if err != nil {
 		return 0, err
@@ -275,11 +475,11 @@ func DeleteItemByID(db *sql.DB, id string) (int, error) {
 // shops
 
 // GetAllShops from database
-func GetAllShops(db *sql.DB) (ShopCollection, error) {
+func GetAllShops(db queryer) (ShopCollection, error) {
 	result := ShopCollection{}
 	result.Shops = make([]Shop, 0)
 
-	sql := "SELECT uid, name, color, orderno FROM shops ORDER BY  orderno, uid"
+	sql := "SELECT uid, name, color, orderno FROM shops WHERE deleted_at IS NULL ORDER BY  orderno, uid"
 	rows, err := db.Query(sql)
 	// Exit if the SQL doesn't work for some reason
 	if err != nil {
@@ -308,10 +508,11 @@ func GetAllShops(db *sql.DB) (ShopCollection, error) {
 	return result, nil
 }
 
-// GetShopByID loads one item from database, identified by its id
-func GetShopByID(db *sql.DB, uid string) (Shop, error) {
+// GetShopByID loads one shop from database, identified by its id.
+// Returns an empty shop if there is none or it is in the trash.
+func GetShopByID(db queryer, uid string) (Shop, error) {
 	result := Shop{}
-	sql := "SELECT uid, name, color, orderno FROM shops WHERE uid = ?"
+	sql := "SELECT uid, name, color, orderno FROM shops WHERE uid = ? AND deleted_at IS NULL"
 	rows, err := db.Query(sql, uid)
 	// Exit if the SQL doesn't work for some reason
 	if err != nil {
@@ -332,11 +533,11 @@ func GetShopByID(db *sql.DB, uid string) (Shop, error) {
 
 // UpsertShop writes an item to database.
 // Whether to INSERT or UPDATE is determined by the existence if its ID field
-// modifies the item, adds the ID on creates.
-func UpsertShop(db *sql.DB, shop *Shop) error {
-	DeleteShopByID(db, shop.UId)
-
-	query := "INSERT INTO shops(uid, name, color, orderno ) VALUES(?, ?, ?, ?)"
+// modifies the item, adds the ID on creates. Shops in the trash are restored.
+func UpsertShop(db queryer, shop *Shop) error {
+	query := `INSERT INTO shops(uid, name, color, orderno ) VALUES(?, ?, ?, ?)
+		ON CONFLICT(uid) DO UPDATE SET name = excluded.name, color = excluded.color,
+		orderno = excluded.orderno, deleted_at = NULL`
 
 	// Create a prepared SQL statement
 	stmt, err := db.Prepare(query)
@@ -354,7 +555,7 @@ func UpsertShop(db *sql.DB, shop *Shop) error {
 }
 
 // ReplaceItemList completely replaces the List in the database
-func ReplaceShopList(db *sql.DB, list *ShopCollection) error {
+func ReplaceShopList(db queryer, list *ShopCollection) error {
 	var errList []error
 	// get the original list:
 	orig, err := GetAllShops(db)
@@ -389,13 +590,7 @@ func ReplaceShopList(db *sql.DB, list *ShopCollection) error {
 		}
 	}
 	// set version:
-	var query = "UPDATE versions SET shops = ? WHERE id = 1"
-	stmt, err := db.Prepare(query)
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-	_, err = stmt.Exec(list.Version)
+	err = SetShopVersion(db, list.Version)
 	if err != nil {
 		errList = append(errList, err)
 	}
@@ -411,10 +606,10 @@ func ReplaceShopList(db *sql.DB, list *ShopCollection) error {
 	return nil
 }
 
-// DeleteItemByID deletes one item from the database, identified by its id
-func DeleteShopByID(db *sql.DB, id string) (int, error) {
+// DeleteShopByID moves one shop to the trash, identified by its id
+func DeleteShopByID(db queryer, id string) (int, error) {
 
-	sql := "DELETE FROM shops WHERE uid = ?"
+	sql := "UPDATE shops SET deleted_at = ? WHERE uid = ? AND deleted_at IS NULL"
 
 	// Create a prepared SQL statement
 	stmt, err := db.Prepare(sql)
@@ -426,7 +621,7 @@ func DeleteShopByID(db *sql.DB, id string) (int, error) {
 	defer stmt.Close()
 
 	// Execute
-	result, err := stmt.Exec(id)
+	result, err := stmt.Exec(time.Now().Unix(), id)
 	// Exit if we get an error
 	if err != nil {
 		return 0, err
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// newTestDB returns a migrated database in a temporary directory, closed when the test ends
+func newTestDB(t *testing.T) *sql.DB {
+	db := initDB(filepath.Join(t.TempDir(), "test.db"))
+	t.Cleanup(func() { db.Close() })
+	migrate(db)
+	return db
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+// EventResync tells a client that it missed events and has to reload its lists
+const EventResync = "resync"
+
+// HeaderClientID is sent by the clients with their requests,
+// events caused by a request carry it so that clients can ignore their own echoes
+const HeaderClientID = "X-Client-ID"
+
+// Event tells the listening clients what changed.
+// Cmd is always UPDATE, clients that only know about it reload their lists.
+// Type is entity and action, e.g. item.created, Items and Shops hold the entities
+// after the change, or before it for deleted ones.
+type Event struct {
+	Cmd     string            `json:"cmd"`
+	Type    string            `json:"type,omitempty"`
+	Version int64             `json:"version,omitempty"`
+	Client  string            `json:"client,omitempty"`
+	User    string            `json:"user,omitempty"`
+	Items   []json.RawMessage `json:"items,omitempty"`
+	Shops   []json.RawMessage `json:"shops,omitempty"`
+	// Presence is the client that joined, left or changed its presence
+	Presence *Presence `json:"presence,omitempty"`
+	// Clients are the clients still connected to an instance, for presence heartbeats
+	Clients []string `json:"clients,omitempty"`
+	// Instance is the instance that sent a presence event, a client can be connected to several
+	Instance string `json:"instance,omitempty"`
+	// the lists the event is about, only used for routing it
+	lists []string
+}
+
+// Topic is the topic receivers subscribe to for the event, empty for events that are for everybody
+func (e Event) Topic() string {
+	switch {
+	case strings.HasPrefix(e.Type, EntityItem+"."):
+		return TopicItems
+	case strings.HasPrefix(e.Type, EntityShop+"."):
+		return TopicShops
+	case strings.HasPrefix(e.Type, "presence."):
+		return TopicPresence
+	}
+	return ""
+}
+
+// Lists returns the lists the event is about, see Subscription
+func (e Event) Lists() []string {
+	return e.lists
+}
+
+// addLists adds the lists a change is about: the shop of an item, before and after
+// the change so that the list it left learns about it too, or the shop itself
+func (e *Event) addLists(change Change) {
+	for _, data := range []json.RawMessage{change.Before, change.After} {
+		if len(data) == 0 {
+			continue
+		}
+		list := change.UId
+		if change.Entity == EntityItem {
+			var item Item
+			if err := json.Unmarshal(data, &item); err != nil {
+				continue
+			}
+			list = itemList(&item)
+		}
+		if !contains(e.lists, list) {
+			e.lists = append(e.lists, list)
+		}
+	}
+}
+
+// eventOrder is the order in which the events of one changeset are sent:
+// shops are created before and deleted after the items referencing them
+var eventOrder = []string{
+	EntityShop + "." + ActionCreated,
+	EntityShop + "." + ActionUpdated,
+	EntityItem + "." + ActionCreated,
+	EntityItem + "." + ActionUpdated,
+	EntityItem + "." + ActionDeleted,
+	EntityShop + "." + ActionDeleted,
+}
+
+// EventsFromChanges groups changes into one event per entity and action
+func EventsFromChanges(changes []Change, versions Versions, by Author) []Event {
+	events := make(map[string]*Event)
+	for _, change := range changes {
+		eventType := change.Entity + "." + change.Action
+		event, ok := events[eventType]
+		if !ok {
+			event = &Event{Cmd: "UPDATE", Type: eventType, Client: by.Client, User: by.User}
+			events[eventType] = event
+		}
+		state := change.After
+		if change.Action == ActionDeleted {
+			state = change.Before
+		}
+		event.addLists(change)
+		if change.Entity == EntityShop {
+			event.Version = versions.ShopVersion
+			event.Shops = append(event.Shops, state)
+		} else {
+			event.Version = versions.ItemVersion
+			event.Items = append(event.Items, state)
+		}
+	}
+
+	result := make([]Event, 0, len(events))
+	for _, eventType := range eventOrder {
+		if event, ok := events[eventType]; ok {
+			result = append(result, *event)
+		}
+	}
+	return result
+}
+
+// PublishChanges sends the events for the given changes to all listening clients.
+// The changes are already applied at this point, so errors only get logged.
+func PublishChanges(db *sql.DB, notifier *Notifier, by Author, changes []Change) {
+	if notifier == nil || len(changes) == 0 {
+		return
+	}
+	versions, err := GetVersions(db)
+	if err != nil {
+		log.Errorf("PublishChanges: Cannot get versions from DB %v", err)
+	}
+	for _, event := range EventsFromChanges(changes, versions, by) {
+		if err = notifier.SendEvent(event); err != nil {
+			log.Errorf("PublishChanges: Could not send event %v", err)
+		}
+	}
+}
+
+// Author is who made a change: the logged in user and the client it was made with, if known
+type Author struct {
+	User   string
+	Client string
+}
+
+// author returns the author of the changes made by a request
+func author(ctx echo.Context) Author {
+	by := Author{Client: clientID(ctx)}
+	if user, ok := currentUser(ctx); ok {
+		by.User = user.Name
+	} else if share, ok := currentShare(ctx); ok {
+		by.User = SharePrefix + share.Name
+	}
+	return by
+}
+
+// clientID returns the id the client sent with the request, if any
+func clientID(ctx echo.Context) string {
+	return ctx.Request().Header.Get(HeaderClientID)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ExportFormatVersion is the version of the export document format,
+// increase it on incompatible changes
+const ExportFormatVersion = 2
+
+// minExportFormatVersion is the oldest format that can still be imported.
+// Version 1 has no recipes and meals, importing it leaves them alone.
+const minExportFormatVersion = 1
+
+// import modes
+const (
+	ImportReplace = "replace"
+	ImportMerge   = "merge"
+)
+
+// Export is a complete copy of the database that can be imported into another instance
+type Export struct {
+	FormatVersion int            `json:"format_version"`
+	ExportedAt    int64          `json:"exported_at"`
+	Items         ItemCollection `json:"items"`
+	Shops         ShopCollection `json:"shops"`
+	Recipes       []Recipe       `json:"recipes"`
+	Meals         []Meal         `json:"meals"`
+}
+
+// Valid tells you whether an export document can be imported.
+// Items may only reference shops and meals only recipes contained in the document.
+func (e *Export) Valid() (bool, []string) {
+	var errors []string
+	if e.FormatVersion < minExportFormatVersion || e.FormatVersion > ExportFormatVersion {
+		errors = append(errors, fmt.Sprintf("Unsupported format version %d, expected %d to %d", e.FormatVersion, minExportFormatVersion, ExportFormatVersion))
+	}
+	shops := make(map[string]bool)
+	for _, shop := range e.Shops.Shops {
+		if ok, shopErrors := shop.Valid(); !ok {
+			errors = append(errors, fmt.Sprintf("Shop %s: %s", shop.UId, strings.Join(shopErrors, ", ")))
+		}
+		if shops[shop.UId] {
+			errors = append(errors, fmt.Sprintf("Shop %s: UId is used twice", shop.UId))
+		}
+		shops[shop.UId] = true
+	}
+	items := make(map[string]bool)
+	for _, item := range e.Items.Items {
+		if ok, itemErrors := item.Valid(); !ok {
+			errors = append(errors, fmt.Sprintf("Item %s: %s", item.UId, strings.Join(itemErrors, ", ")))
+		}
+		if item.UId == "" {
+			errors = append(errors, fmt.Sprintf("Item %s: UId is missing", item.Title))
+		} else if items[item.UId] {
+			errors = append(errors, fmt.Sprintf("Item %s: UId is used twice", item.UId))
+		}
+		items[item.UId] = true
+		if item.Shop != nil && !shops[item.Shop.UId] {
+			errors = append(errors, fmt.Sprintf("Item %s: Shop %s is not part of the export", item.UId, item.Shop.UId))
+		}
+	}
+	recipes := make(map[string]bool)
+	for _, recipe := range e.Recipes {
+		if ok, recipeErrors := recipe.Valid(); !ok {
+			errors = append(errors, fmt.Sprintf("Recipe %s: %s", recipe.UId, strings.Join(recipeErrors, ", ")))
+		}
+		if recipe.UId == "" {
+			errors = append(errors, fmt.Sprintf("Recipe %s: UId is missing", recipe.Name))
+		} else if recipes[recipe.UId] {
+			errors = append(errors, fmt.Sprintf("Recipe %s: UId is used twice", recipe.UId))
+		}
+		recipes[recipe.UId] = true
+	}
+	for _, meal := range e.Meals {
+		if ok, mealErrors := meal.Valid(); !ok {
+			errors = append(errors, fmt.Sprintf("Meal %s: %s", meal.Day, strings.Join(mealErrors, ", ")))
+		} else if !recipes[meal.RecipeUId] {
+			errors = append(errors, fmt.Sprintf("Meal %s: Recipe %s is not part of the export", meal.Day, meal.RecipeUId))
+		}
+	}
+	return len(errors) == 0, errors
+}
+
+func isAllowedImportMode(mode string) bool {
+	return mode == ImportReplace || mode == ImportMerge
+}
+
+// ExportAll reads all items, shops, recipes and meals into an export document.
+// They are read in one transaction, so that items only reference shops and meals only recipes of the document.
+func ExportAll(db *sql.DB) (Export, error) {
+	export := Export{
+		FormatVersion: ExportFormatVersion,
+		ExportedAt:    time.Now().Unix(),
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return export, err
+	}
+	defer tx.Rollback()
+
+	export.Items, err = GetAllItems(tx)
+	if err != nil {
+		return export, err
+	}
+	export.Shops, err = GetAllShops(tx)
+	if err != nil {
+		return export, err
+	}
+	export.Recipes, err = GetAllRecipes(tx)
+	if err != nil {
+		return export, err
+	}
+	export.Meals, err = GetAllMeals(tx)
+	if err != nil {
+		return export, err
+	}
+	return export, tx.Commit()
+}
+
+// ImportAll writes an export document into the database in one transaction, see changeLists.
+// In replace mode everything not contained in the document is deleted,
+// in merge mode the document is added on top of what exists, entries with the same id are overwritten
+// and meals already planned for the same day are skipped.
+// Both lists get a new version, the versions in the document are not restored, so that
+// clients holding an older copy of the lists notice the import.
+// Returns the changes that were applied to the lists.
+func ImportAll(db *sql.DB, notifier *Notifier, export *Export, mode string, by Author) ([]Change, error) {
+	if !isAllowedImportMode(mode) {
+		return nil, fmt.Errorf("unknown import mode %s", mode)
+	}
+	_, changes, err := changeLists(db, notifier, "import/"+mode, by, 0, func(tx *sql.Tx) error {
+		version := NewVersion()
+		items := ItemCollection{Version: version, Items: export.Items.Items}
+		shops := ShopCollection{Version: version, Shops: export.Shops.Shops}
+		if mode == ImportMerge {
+			origItems, err := GetAllItems(tx)
+			if err != nil {
+				return err
+			}
+			origShops, err := GetAllShops(tx)
+			if err != nil {
+				return err
+			}
+			items.Items = mergeItems(origItems.Items, items.Items)
+			shops.Shops = mergeShops(origShops.Shops, shops.Shops)
+		}
+
+		// shops first, so that imported items can reference imported shops
+		if err := ReplaceShopList(tx, &shops); err != nil {
+			return err
+		}
+		if err := ReplaceItemList(tx, &items); err != nil {
+			return err
+		}
+		if export.FormatVersion < 2 {
+			return nil
+		}
+		return importRecipes(tx, export, mode)
+	})
+	return changes, err
+}
+
+// importRecipes writes the recipes and meals of an export document within the transaction of ImportAll
+func importRecipes(tx *sql.Tx, export *Export, mode string) error {
+	if mode == ImportReplace {
+		for _, table := range []string{"meals", "recipe_ingredients", "recipes"} {
+			if _, err := tx.Exec("DELETE FROM " + table); err != nil {
+				return err
+			}
+		}
+	}
+	for i := range export.Recipes {
+		if err := upsertRecipe(tx, &export.Recipes[i]); err != nil {
+			return err
+		}
+	}
+
+	existing, err := GetAllMeals(tx)
+	if err != nil {
+		return err
+	}
+	planned := make(map[string]bool)
+	for _, meal := range existing {
+		planned[meal.Day+"\x00"+meal.RecipeUId] = true
+	}
+	for _, meal := range export.Meals {
+		if planned[meal.Day+"\x00"+meal.RecipeUId] {
+			continue
+		}
+		if err = AddMeal(tx, &meal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeItems adds the imported items to the existing ones, imported items win on equal ids
+func mergeItems(existing, imported []Item) []Item {
+	result := make([]Item, 0, len(existing)+len(imported))
+	index := make(map[string]int)
+	for _, item := range existing {
+		index[item.UId] = len(result)
+		result = append(result, item)
+	}
+	for _, item := range imported {
+		if i, ok := index[item.UId]; ok {
+			result[i] = item
+			continue
+		}
+		index[item.UId] = len(result)
+		result = append(result, item)
+	}
+	return result
+}
+
+// mergeShops adds the imported shops to the existing ones, imported shops win on equal ids
+func mergeShops(existing, imported []Shop) []Shop {
+	result := make([]Shop, 0, len(existing)+len(imported))
+	index := make(map[string]int)
+	for _, shop := range existing {
+		index[shop.UId] = len(result)
+		result = append(result, shop)
+	}
+	for _, shop := range imported {
+		if i, ok := index[shop.UId]; ok {
+			result[i] = shop
+			continue
+		}
+		index[shop.UId] = len(result)
+		result = append(result, shop)
+	}
+	return result
+}
+
+// ********************************** //
+//             handlers:              //
+// ********************************** //
+
+// GET /export downloads the complete database as one JSON document
+func exportAll(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		export, err := ExportAll(db)
+		if err != nil {
+			ctx.Logger().Infof("exportAll: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not export data")
+		}
+		filename := fmt.Sprintf("shoppinglist-%s.json", time.Unix(export.ExportedAt, 0).Format("20060102-150405"))
+		ctx.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+		return ctx.JSON(http.StatusOK, export)
+	}
+}
+
+// POST /import?mode=replace|merge loads an export document into the database
+func importAll(db *sql.DB, notifier *Notifier) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		mode := ctx.QueryParam("mode")
+		if mode == "" {
+			mode = ImportMerge
+		}
+		if !isAllowedImportMode(mode) {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("mode must be %s or %s", ImportReplace, ImportMerge))
+		}
+
+		// bind body into struct
+		export := &Export{}
+		err := ctx.Bind(export)
+		if err != nil {
+			ctx.Logger().Infof("importAll: Bind Error with request %v: %v", ctx.Request().Body, err)
+			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+		}
+		if ok, errors := export.Valid(); !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, strings.Join(errors, "; "))
+		}
+
+		// notifies the listening clients and writes the audit log, so that the import can be undone
+		if _, err = ImportAll(db, notifier, export, mode, author(ctx)); err != nil {
+			ctx.Logger().Infof("importAll: Database Error on import %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not import data")
+		}
+
+		result, err := ExportAll(db)
+		if err != nil {
+			ctx.Logger().Infof("importAll: Database Error on get %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read data")
+		}
+		return ctx.JSON(http.StatusOK, result)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// TestExportImport makes sure a document exported from one database imports into another as it was
+func TestExportImport(t *testing.T) {
+	shop := &Shop{UId: "s1", Name: "Bakery", Color: "#aa0000", Orderno: 1}
+	document := &Export{
+		FormatVersion: ExportFormatVersion,
+		Shops:         ShopCollection{Shops: []Shop{*shop}},
+		Items: ItemCollection{Items: []Item{
+			{UId: "i1", Title: "Bread", Status: StatusOpen, Orderno: 1, Shop: shop},
+			{UId: "i2", Title: "Milk", Status: StatusChecked, Orderno: 2, Quantity: 2, Unit: "l", Recipes: []string{"Pancakes"}},
+		}},
+		Recipes: []Recipe{{UId: "r1", Name: "Pancakes", Servings: 4, Ingredients: []Ingredient{{Title: "Milk", Quantity: 0.5, Unit: "l"}}}},
+		Meals:   []Meal{{Day: "2024-01-29", RecipeUId: "r1", Servings: 2}},
+	}
+	source := newTestDB(t)
+	if _, err := ImportAll(source, nil, document, ImportReplace, Author{}); err != nil {
+		t.Fatal(err)
+	}
+	exported, err := ExportAll(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// through JSON, as it is downloaded and uploaded again
+	data, err := json.Marshal(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := &Export{}
+	if err = json.Unmarshal(data, imported); err != nil {
+		t.Fatal(err)
+	}
+	if ok, errors := imported.Valid(); !ok {
+		t.Fatalf("exported document is invalid: %v", errors)
+	}
+	target := newTestDB(t)
+	if err = UpsertItem(target, &Item{UId: "i9", Title: "Eggs", Status: StatusOpen}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ImportAll(target, nil, imported, ImportReplace, Author{}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := ExportAll(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(result.Shops.Shops, exported.Shops.Shops) {
+		t.Errorf("shops are %+v instead of %+v", result.Shops.Shops, exported.Shops.Shops)
+	}
+	if len(result.Items.Items) != len(document.Items.Items) {
+		t.Fatalf("items are %+v", result.Items.Items)
+	}
+	for i, item := range result.Items.Items {
+		item.Revision = exported.Items.Items[i].Revision
+		if !reflect.DeepEqual(item, exported.Items.Items[i]) {
+			t.Errorf("item is %+v instead of %+v", item, exported.Items.Items[i])
+		}
+	}
+	if !reflect.DeepEqual(result.Recipes, exported.Recipes) {
+		t.Errorf("recipes are %+v instead of %+v", result.Recipes, exported.Recipes)
+	}
+	if len(result.Meals) != 1 || result.Meals[0].Day != "2024-01-29" || result.Meals[0].RecipeUId != "r1" || result.Meals[0].Servings != 2 {
+		t.Errorf("meals are %+v", result.Meals)
+	}
+
+	// merging keeps what is there and does not plan a meal twice
+	if _, err = ImportAll(target, nil, &Export{FormatVersion: ExportFormatVersion,
+		Items: ItemCollection{Items: []Item{{UId: "i9", Title: "Eggs", Status: StatusOpen}}},
+		Meals: document.Meals, Recipes: document.Recipes}, ImportMerge, Author{}); err != nil {
+		t.Fatal(err)
+	}
+	if result, err = ExportAll(target); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Items.Items) != 3 || len(result.Shops.Shops) != 1 || len(result.Meals) != 1 {
+		t.Errorf("after merging: %+v", result)
+	}
+}
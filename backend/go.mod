@@ -3,10 +3,13 @@ module github.com/akoeb/shoppinglist
 go 1.21
 
 require (
+	github.com/golang-jwt/jwt/v5 v5.2.2
 	github.com/labstack/echo/v4 v4.11.3
 	github.com/labstack/gommon v0.4.1
 	github.com/mattn/go-sqlite3 v1.14.18
 	golang.org/x/crypto v0.16.0
+	golang.org/x/net v0.19.0
+	golang.org/x/term v0.15.0
 )
 
 require (
@@ -15,7 +18,6 @@ require (
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v1.2.2 // indirect
-	golang.org/x/net v0.19.0 // indirect
 	golang.org/x/sys v0.15.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	golang.org/x/time v0.3.0 // indirect
@@ -2,8 +2,12 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
@@ -18,6 +22,7 @@ func showAllItems(db *sql.DB) echo.HandlerFunc {
 			ctx.Logger().Infof("showAllItems: Database Error %v", err)
 			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read items")
 		}
+		items.Items = shareItems(ctx, items.Items)
 		return ctx.JSON(http.StatusOK, items)
 	}
 }
@@ -33,75 +38,208 @@ func syncItems(db *sql.DB, notifier *Notifier) echo.HandlerFunc {
 			ctx.Logger().Infof("replaceItemList: Bind Error with request %v: %v", ctx.Request().Body, err)
 			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
 		}
-		// Compare version from input with version from DB
-		versions, err := GetVersions(db)
-		if err != nil {
-			ctx.Logger().Infof("replaceItemList: Cannot get versions from DB %v", err)
-			return echo.NewHTTPError(http.StatusBadRequest, "DB Error")
-		}
-
-		// if version from API is newer as version from DB => replace
-		if list.Version > versions.ItemVersion {
-
-			// do database operation
-			err = ReplaceItemList(db, list)
+		// replace the list if the version from the API is newer than the one in the DB,
+		// checked within the transaction so that no other change slips in between
+		var items ItemCollection
+		_, _, err = changeLists(db, notifier, "items/sync", author(ctx), 0, func(tx *sql.Tx) error {
+			versions, err := GetVersions(tx)
 			if err != nil {
-				ctx.Logger().Infof("syncItems: Database Error on replace %v", err)
-				return echo.NewHTTPError(http.StatusInternalServerError, "Could not change item")
+				return err
 			}
-
-			// looks fine, notify all the listening clients:
-			notifier.Send("UPDATE")
-
-		}
-
-		items, err := GetAllItems(db)
+			if list.Version > versions.ItemVersion {
+				if err = ReplaceItemList(tx, list); err != nil {
+					return err
+				}
+			}
+			items, err = GetAllItems(tx)
+			return err
+		})
 		if err != nil {
-			ctx.Logger().Infof("syncItem: Database Error on get %v", err)
+			ctx.Logger().Infof("syncItems: Database Error on replace %v", err)
 			return echo.NewHTTPError(http.StatusInternalServerError, "Could not change item")
 		}
 		return ctx.JSON(http.StatusOK, items)
 	}
 }
 
+// StreamConfig holds the timing of event streams
+type StreamConfig struct {
+	// Heartbeat is how often to send a comment on idle streams, so that proxies keep them open, 0 disables it
+	Heartbeat time.Duration
+	// Retry tells clients how long to wait before reconnecting, 0 leaves it to them
+	Retry time.Duration
+	// WriteTimeout is how long a write may stall before the receiver is dropped, 0 waits forever
+	WriteTimeout time.Duration
+}
+
 // handle event streams:
-func eventsStream(notifier *Notifier) echo.HandlerFunc {
+func eventsStream(notifier *Notifier, config StreamConfig) echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		ctx.Logger().Infof("eventsStream called")
-		receiverID, err := notifier.NewReceiver()
+		receiver, err := newReceiver(ctx, notifier, config)
 		if err != nil {
-			ctx.Logger().Errorf("eventsStream Error creating receiver: %v", err)
-			return echo.NewHTTPError(http.StatusInternalServerError, err)
-
+			return err
 		}
-
-		go func() {
-			<-ctx.Request().Context().Done()
-			// connection close, do cleanup
-			ctx.Logger().Infof("eventsStream: close notify triggered")
-			notifier.RemoveReceiver(receiverID)
-		}()
+		// connection closed or stalled, do cleanup
+		defer notifier.RemoveReceiver(receiver)
+		defer joinPresence(ctx, notifier)()
 
 		ctx.Response().Header().Set(echo.HeaderContentType, "text/event-stream")
 		ctx.Response().WriteHeader(http.StatusOK)
-		ctx.Response().Flush()
+		stream := http.NewResponseController(ctx.Response().Writer)
+
+		if config.Retry > 0 {
+			if err = writeStream(ctx, stream, config, fmt.Sprintf("retry: %d\n\n", config.Retry.Milliseconds())); err != nil {
+				ctx.Logger().Infof("eventsStream: Error writing to stream: %v", err)
+				return nil
+			}
+		}
+
+		// a reconnecting client gets what it missed. The receiver is already listening,
+		// so messages sent meanwhile come in twice and are skipped below
+		var lastID uint64
+		for _, msg := range missedMessages(ctx, notifier, receiver, ctx.Request().Header.Get("Last-Event-ID")) {
+			if err = writeStream(ctx, stream, config, formatMessage(notifier, msg)); err != nil {
+				ctx.Logger().Infof("eventsStream: Error writing to stream: %v", err)
+				return nil
+			}
+			lastID = msg.ID
+		}
+		if err = stream.Flush(); err != nil {
+			ctx.Logger().Infof("eventsStream: Error writing to stream: %v", err)
+			return nil
+		}
+
+		var heartbeat <-chan time.Time
+		if config.Heartbeat > 0 {
+			ticker := time.NewTicker(config.Heartbeat)
+			defer ticker.Stop()
+			heartbeat = ticker.C
+		}
+
 		for {
-			// listen on channel:
-			cmd := notifier.Listen(receiverID)
+			var data string
+			select {
+			case <-ctx.Request().Context().Done():
+				ctx.Logger().Infof("eventsStream: close notify triggered")
+				return nil
+			case <-receiver.Done():
+				ctx.Logger().Infof("eventsStream: receiver dropped, it did not keep up")
+				return nil
+			case <-heartbeat:
+				data = ": heartbeat\n\n"
+			case msg := <-receiver.Messages():
+				if msg.ID <= lastID {
+					continue
+				}
+				data = formatMessage(notifier, msg)
+			}
 
-			// write message to client
-			_, err := ctx.Response().Write([]byte(fmt.Sprintf("data: {\"cmd\": \"%s\"}\n\n", cmd)))
-			if err != nil {
-				notifier.RemoveReceiver(receiverID)
-				msg := fmt.Sprintf("Error writing to stream: %v", err)
-				ctx.Logger().Infof("eventsStream: Error %v", msg)
-				return echo.NewHTTPError(http.StatusInternalServerError, msg)
+			// write message to client, a client that does not take it in time is dropped
+			if err = writeStream(ctx, stream, config, data); err != nil {
+				ctx.Logger().Infof("eventsStream: Error writing to stream: %v", err)
+				return nil
 			}
-			ctx.Response().Flush()
 		}
 	}
 }
 
+// newReceiver registers a receiver for a client, or answers with 503 if there are too many already
+func newReceiver(ctx echo.Context, notifier *Notifier, config StreamConfig) (*Receiver, error) {
+	subscription, err := parseSubscription(ctx)
+	if err != nil {
+		return nil, err
+	}
+	receiver, err := notifier.NewReceiver(subscription)
+	if errors.Is(err, ErrTooManyReceivers) {
+		ctx.Logger().Warnf("newReceiver: %v", err)
+		// tell the client when to try again, as it would reconnect anyway
+		retryAfter := config.Retry
+		if retryAfter < time.Second {
+			retryAfter = 30 * time.Second
+		}
+		ctx.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(retryAfter.Seconds())))
+		return nil, echo.NewHTTPError(http.StatusServiceUnavailable, "Too many listening clients, try again later")
+	}
+	if err != nil {
+		ctx.Logger().Errorf("newReceiver: Error creating receiver: %v", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	return receiver, nil
+}
+
+// parseSubscription reads the topics and lists a client subscribes to from the comma separated
+// topics and lists query parameters, without them it gets everything. Share links only get their list.
+func parseSubscription(ctx echo.Context) (Subscription, error) {
+	var subscription Subscription
+	for _, topic := range splitParam(ctx.QueryParam("topics")) {
+		if !contains(AllowedTopics, topic) {
+			return subscription, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unknown topic %s, only following are allowed: %s", topic, strings.Join(AllowedTopics, ", ")))
+		}
+		subscription.Topics = append(subscription.Topics, topic)
+	}
+	subscription.Lists = splitParam(ctx.QueryParam("lists"))
+	if list, ok := shareList(ctx); ok {
+		subscription.Lists = []string{list}
+	}
+	return subscription, nil
+}
+
+// splitParam splits a comma separated query parameter, leaving out empty values
+func splitParam(param string) []string {
+	var values []string
+	for _, value := range strings.Split(param, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// missedMessages returns what a receiver reconnecting after the given event id missed
+// and is subscribed to, or a resync message if that is not known anymore
+func missedMessages(ctx echo.Context, notifier *Notifier, receiver *Receiver, lastEventID string) []Message {
+	if lastEventID == "" {
+		return nil
+	}
+	missed, ok := notifier.Replay(lastEventID)
+	if !ok {
+		ctx.Logger().Infof("missedMessages: cannot replay after %s, sending resync", lastEventID)
+		return []Message{notifier.Resync()}
+	}
+	wanted := missed[:0]
+	for _, msg := range missed {
+		if receiver.Subscription.Wants(msg) {
+			wanted = append(wanted, msg)
+		}
+	}
+	return wanted
+}
+
+// GET /events/stats shows how many clients listen to events
+func showEventStats(notifier *Notifier) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		return ctx.JSON(http.StatusOK, notifier.Stats())
+	}
+}
+
+// formatMessage formats one message as server-sent event with its id
+func formatMessage(notifier *Notifier, msg Message) string {
+	return fmt.Sprintf("id: %s\ndata: %s\n\n", notifier.EventID(msg), msg.Data)
+}
+
+// writeStream writes to an event stream and flushes it, within the write timeout
+func writeStream(ctx echo.Context, stream *http.ResponseController, config StreamConfig, data string) error {
+	if config.WriteTimeout > 0 {
+		// not every connection supports deadlines, those just wait
+		stream.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+	}
+	if _, err := ctx.Response().Write([]byte(data)); err != nil {
+		return err
+	}
+	return stream.Flush()
+}
+
 // GET /shops - show all shops registered
 func showAllShops(db *sql.DB) echo.HandlerFunc {
 	return func(ctx echo.Context) error {
@@ -110,6 +248,7 @@ func showAllShops(db *sql.DB) echo.HandlerFunc {
 			ctx.Logger().Infof("showAllShops: Database Error %v", err)
 			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read shops")
 		}
+		shop.Shops = shareShops(ctx, shop.Shops)
 		return ctx.JSON(http.StatusOK, shop)
 	}
 }
@@ -126,34 +265,26 @@ func syncShops(db *sql.DB, notifier *Notifier) echo.HandlerFunc {
 			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
 		}
 
-		// Compare version from input with version from DB
-		versions, err := GetVersions(db)
-		if err != nil {
-			ctx.Logger().Infof("replaceItemList: Cannot get versions from DB %v", err)
-			return echo.NewHTTPError(http.StatusBadRequest, "DB Error")
-		}
-
-		// if version from API is newer as version from DB => replace
-		if list.Version > versions.ShopVersion {
-
-			// do database operation
-			err = ReplaceShopList(db, list)
+		// replace the list if the version from the API is newer than the one in the DB,
+		// checked within the transaction so that no other change slips in between
+		var shops ShopCollection
+		_, _, err = changeLists(db, notifier, "shops/sync", author(ctx), 0, func(tx *sql.Tx) error {
+			versions, err := GetVersions(tx)
 			if err != nil {
-				ctx.Logger().Infof("syncShop: Database Error on replace %v", err)
-				return echo.NewHTTPError(http.StatusInternalServerError, "DB Error")
-
+				return err
 			}
-
-			// looks fine, notify all the listening clients:
-			notifier.Send("UPDATE")
-		}
-
-		shops, err := GetAllShops(db)
+			if list.Version > versions.ShopVersion {
+				if err = ReplaceShopList(tx, list); err != nil {
+					return err
+				}
+			}
+			shops, err = GetAllShops(tx)
+			return err
+		})
 		if err != nil {
-			ctx.Logger().Infof("syncShop: Database Error on get %v", err)
+			ctx.Logger().Infof("syncShops: Database Error on replace %v", err)
 			return echo.NewHTTPError(http.StatusInternalServerError, "DB Error")
 		}
 		return ctx.JSON(http.StatusOK, shops)
-
 	}
 }
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The household is the group of users sharing the list. Owners manage the members,
+// editors change the list and viewers only read it.
+
+// roles of the members of the household, from most to least allowed
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+// AllowedRoles for checking that roles are always correct
+var AllowedRoles = []string{RoleOwner, RoleEditor, RoleViewer}
+
+// the key under which the role of the user of a request is stored in the echo context
+const contextRole = "role"
+
+// ErrLastOwner is returned when a change would leave the household without owner
+var ErrLastOwner = errors.New("can not remove the last owner")
+
+func isAllowedRole(role string) bool {
+	for _, allowed := range AllowedRoles {
+		if role == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// roleRank orders the roles, so that they can be compared
+func roleRank(role string) int {
+	switch role {
+	case RoleOwner:
+		return 3
+	case RoleEditor:
+		return 2
+	case RoleViewer:
+		return 1
+	}
+	return 0
+}
+
+// Member is a user in the household
+type Member struct {
+	User     string `json:"user"`
+	Role     string `json:"role"`
+	JoinedAt int64  `json:"joined_at"`
+}
+
+// MemberInput is what owners send to invite a user or change its role
+type MemberInput struct {
+	Role string `json:"role"`
+}
+
+// readOnlyMethods are the request methods viewers may use, including the reading ones of CalDAV
+var readOnlyMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	"PROPFIND":         true,
+	"REPORT":           true,
+}
+
+// userRole returns the role of the user who sent the request. Without users everybody owns the list.
+func userRole(db *sql.DB, ctx echo.Context) (string, error) {
+	user, ok := currentUser(ctx)
+	if !ok {
+		count, err := CountUsers(db)
+		if err != nil || count > 0 {
+			return "", err
+		}
+		return RoleOwner, nil
+	}
+	member, err := GetMember(db, user.Name)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return member.Role, err
+}
+
+// canEdit tells whether the user of a request may change the list, listAccess has to run before
+func canEdit(ctx echo.Context) bool {
+	role, _ := ctx.Get(contextRole).(string)
+	return roleRank(role) >= roleRank(RoleEditor)
+}
+
+// memberAccess only lets members of the household through and remembers their role
+func memberAccess(db *sql.DB) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if err := checkMember(db, ctx); err != nil {
+				return err
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// apiOwnAccess are the routes below /api that are not about the list and check access themselves
+var apiOwnAccess = []string{"/api/login", "/api/logout", "/api/sessions", "/api/tokens", "/api/me", "/api/users", "/api/household"}
+
+// listAccess lets only members of the household and share links use the list, viewers only read it.
+// Routes that are not about the list are skipped by their path, including those below it.
+func listAccess(db *sql.DB, skip ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if pathBelow(ctx.Path(), skip) {
+				return next(ctx)
+			}
+			if share, ok := currentShare(ctx); ok {
+				ctx.Set(contextRole, share.role())
+			} else if err := checkMember(db, ctx); err != nil {
+				return err
+			}
+			if !readOnlyMethods[ctx.Request().Method] && !canEdit(ctx) {
+				return echo.NewHTTPError(http.StatusForbidden, "Viewers can not change the list")
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// checkMember stores the role of the user of a request, if it is a member of the household
+func checkMember(db *sql.DB, ctx echo.Context) error {
+	role, err := userRole(db, ctx)
+	if err != nil {
+		ctx.Logger().Errorf("checkMember: Database Error %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not check membership")
+	}
+	if role == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "Only members of the household can use the list")
+	}
+	ctx.Set(contextRole, role)
+	return nil
+}
+
+// ********************************** //
+//     database access functions:     //
+// ********************************** //
+
+// GetMembers loads all members of the household, owners first
+func GetMembers(db *sql.DB) ([]Member, error) {
+	result := make([]Member, 0)
+	sql := `SELECT users.name, members.role, members.joined_at FROM members JOIN users ON users.id = members.user_id
+		ORDER BY CASE members.role WHEN 'owner' THEN 0 WHEN 'editor' THEN 1 ELSE 2 END, users.name`
+	rows, err := db.Query(sql)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		member := Member{}
+		if err = rows.Scan(&member.User, &member.Role, &member.JoinedAt); err != nil {
+			return result, err
+		}
+		result = append(result, member)
+	}
+	return result, rows.Err()
+}
+
+// GetMember loads the membership of a user, returns sql.ErrNoRows if it is no member
+func GetMember(db *sql.DB, name string) (Member, error) {
+	member := Member{}
+	sql := "SELECT users.name, members.role, members.joined_at FROM members JOIN users ON users.id = members.user_id WHERE users.name = ?"
+	err := db.QueryRow(sql, name).Scan(&member.User, &member.Role, &member.JoinedAt)
+	return member, err
+}
+
+// SetMember adds a user to the household or changes its role, unless that leaves no owner.
+// Returns sql.ErrNoRows if there is no such user.
+func SetMember(db *sql.DB, name, role string) (Member, error) {
+	member := Member{User: name, Role: role}
+	tx, err := db.Begin()
+	if err != nil {
+		return member, err
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	if err = tx.QueryRow("SELECT id FROM users WHERE name = ?", name).Scan(&userID); err != nil {
+		return member, err
+	}
+	_, err = tx.Exec(`INSERT INTO members(user_id, role, joined_at) VALUES(?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET role = excluded.role`, userID, role, time.Now().Unix())
+	if err != nil {
+		return member, err
+	}
+	if err = checkOwnerLeft(tx); err != nil {
+		return member, err
+	}
+	if err = tx.QueryRow("SELECT joined_at FROM members WHERE user_id = ?", userID).Scan(&member.JoinedAt); err != nil {
+		return member, err
+	}
+	return member, tx.Commit()
+}
+
+// DeleteMember removes a user from the household, unless it is the last owner
+func DeleteMember(db *sql.DB, name string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM members WHERE user_id = (SELECT id FROM users WHERE name = ?)", name)
+	if err != nil {
+		return 0, err
+	}
+	if err = checkOwnerLeft(tx); err != nil {
+		return 0, err
+	}
+	num, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(num), tx.Commit()
+}
+
+// checkOwnerLeft returns ErrLastOwner if the household has members, but no owner
+func checkOwnerLeft(tx *sql.Tx) error {
+	var members, owners int
+	err := tx.QueryRow("SELECT COUNT(*), COUNT(CASE role WHEN 'owner' THEN 1 END) FROM members").Scan(&members, &owners)
+	if err != nil {
+		return err
+	}
+	if members > 0 && owners == 0 {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+// ********************************** //
+//             handlers:              //
+// ********************************** //
+
+// GET /household lists the members of the household
+func showHousehold(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		members, err := GetMembers(db)
+		if err != nil {
+			ctx.Logger().Infof("showHousehold: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read members")
+		}
+		return ctx.JSON(http.StatusOK, members)
+	}
+}
+
+// PUT /household/members/:name invites a user into the household or changes its role, only owners can do that
+func setMember(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		input := &MemberInput{}
+		if err := ctx.Bind(input); err != nil {
+			ctx.Logger().Infof("setMember: Bind Error with request %v: %v", ctx.Request().Body, err)
+			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+		}
+		if !isAllowedRole(input.Role) {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Role is of wrong format (%s), only following are allowed: %s", input.Role, strings.Join(AllowedRoles, ", ")))
+		}
+
+		member, err := SetMember(db, ctx.Param("name"), input.Role)
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusNotFound, "No such user")
+		}
+		if errors.Is(err, ErrLastOwner) {
+			return echo.NewHTTPError(http.StatusConflict, "The household needs an owner")
+		}
+		if err != nil {
+			ctx.Logger().Infof("setMember: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not change member")
+		}
+		return ctx.JSON(http.StatusOK, member)
+	}
+}
+
+// DELETE /household/members/:name removes a user from the household.
+// Owners can remove anybody, the others only themselves.
+func deleteMember(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		name := ctx.Param("name")
+		role, _ := ctx.Get(contextRole).(string)
+		if user, _ := currentUser(ctx); role != RoleOwner && user.Name != name {
+			return echo.NewHTTPError(http.StatusForbidden, "Only owners can remove other members")
+		}
+
+		num, err := DeleteMember(db, name)
+		if errors.Is(err, ErrLastOwner) {
+			return echo.NewHTTPError(http.StatusConflict, "The household needs an owner")
+		}
+		if err != nil {
+			ctx.Logger().Infof("deleteMember: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not remove member")
+		}
+		if num == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "No such member")
+		}
+		return ctx.NoContent(http.StatusNoContent)
+	}
+}
+
+// requireOwner only lets owners of the household through, listAccess has to run before
+func requireOwner() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if role, _ := ctx.Get(contextRole).(string); role != RoleOwner {
+				return echo.NewHTTPError(http.StatusForbidden, "Only owners can do this")
+			}
+			return next(ctx)
+		}
+	}
+}
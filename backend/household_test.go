@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// TestListAccessMeals makes sure the meal plan is not mistaken for /api/me, which has its own checks
+func TestListAccessMeals(t *testing.T) {
+	db := newTestDB(t)
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := CreateUser(db, name, "secret123", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := SetMember(db, "bob", RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	apis := e.Group("/api", userAuth(db, SessionConfig{Lifetime: time.Hour}, false), listAccess(db, apiOwnAccess...))
+	apis.GET("/me", func(ctx echo.Context) error { return ctx.NoContent(http.StatusOK) })
+	apis.DELETE("/meals/:id", deleteMeal(db))
+	apis.POST("/meals/shopping", shopMeals(db, nil))
+
+	tests := []struct {
+		user, method, path string
+		status             int
+	}{
+		{"bob", http.MethodGet, "/api/me", http.StatusOK},
+		{"bob", http.MethodPost, "/api/meals/shopping", http.StatusForbidden},
+		{"bob", http.MethodDelete, "/api/meals/1", http.StatusForbidden},
+		{"alice", http.MethodDelete, "/api/meals/1", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, test.path, strings.NewReader("{}"))
+		request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		request.SetBasicAuth(test.user, "secret123")
+		answer := httptest.NewRecorder()
+		e.ServeHTTP(answer, request)
+		if answer.Code != test.status {
+			t.Errorf("%s %s %s answered %d instead of %d: %s", test.user, test.method, test.path, answer.Code, test.status, answer.Body)
+		}
+	}
+}
+
+// TestListAccess makes sure viewers only read the list and users outside the household can not use it
+func TestListAccess(t *testing.T) {
+	db := newTestDB(t)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if _, err := CreateUser(db, name, "secret123", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := SetMember(db, "bob", RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+
+	config := SessionConfig{Lifetime: time.Hour}
+	e := echo.New()
+	apis := e.Group("/api", userAuth(db, config, false), listAccess(db, apiOwnAccess...))
+	apis.GET("/items", showAllItems(db))
+	apis.POST("/items/sync", syncItems(db, nil))
+	events := e.Group("/events", userAuth(db, config, false), listAccess(db))
+	events.GET("", func(ctx echo.Context) error { return ctx.NoContent(http.StatusOK) })
+
+	tests := []struct {
+		user, method, path string
+		status             int
+	}{
+		{"alice", http.MethodGet, "/api/items", http.StatusOK},
+		{"alice", http.MethodPost, "/api/items/sync", http.StatusOK},
+		{"bob", http.MethodGet, "/api/items", http.StatusOK},
+		{"bob", http.MethodGet, "/events", http.StatusOK},
+		{"bob", http.MethodPost, "/api/items/sync", http.StatusForbidden},
+		{"carol", http.MethodGet, "/api/items", http.StatusForbidden},
+		{"carol", http.MethodGet, "/events", http.StatusForbidden},
+		{"carol", http.MethodPost, "/api/items/sync", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, test.path, strings.NewReader(`{"version": 1, "items": []}`))
+		request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		request.SetBasicAuth(test.user, "secret123")
+		answer := httptest.NewRecorder()
+		e.ServeHTTP(answer, request)
+		if answer.Code != test.status {
+			t.Errorf("%s %s %s answered %d instead of %d: %s", test.user, test.method, test.path, answer.Code, test.status, answer.Body)
+		}
+	}
+}
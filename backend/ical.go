@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// minimal iCalendar (RFC 5545) support for VTODO components
+
+// icalEscape escapes a TEXT value
+func icalEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(value)
+}
+
+// icalUnescape reverses icalEscape
+func icalUnescape(value string) string {
+	return strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n").Replace(value)
+}
+
+// icalFold splits content lines longer than 75 octets, without breaking utf-8 sequences
+func icalFold(line string) string {
+	var b strings.Builder
+	length := 0
+	for _, r := range line {
+		size := len(string(r))
+		if length+size > 75 {
+			b.WriteString("\r\n ")
+			length = 1
+		}
+		b.WriteRune(r)
+		length += size
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// RenderVTodo renders an item as calendar object with one VTODO
+func RenderVTodo(item *Item) string {
+	var b strings.Builder
+	b.WriteString(icalFold("BEGIN:VCALENDAR"))
+	b.WriteString(icalFold("VERSION:2.0"))
+	b.WriteString(icalFold("PRODID:-//akoeb//shoppinglist//EN"))
+	writeVTodo(&b, item)
+	b.WriteString(icalFold("END:VCALENDAR"))
+	return b.String()
+}
+
+// RenderCalendar renders all items as one calendar with many VTODOs
+func RenderCalendar(name string, items []Item) string {
+	var b strings.Builder
+	b.WriteString(icalFold("BEGIN:VCALENDAR"))
+	b.WriteString(icalFold("VERSION:2.0"))
+	b.WriteString(icalFold("PRODID:-//akoeb//shoppinglist//EN"))
+	b.WriteString(icalFold("X-WR-CALNAME:" + icalEscape(name)))
+	for i := range items {
+		writeVTodo(&b, &items[i])
+	}
+	b.WriteString(icalFold("END:VCALENDAR"))
+	return b.String()
+}
+
+func writeVTodo(b *strings.Builder, item *Item) {
+	b.WriteString(icalFold("BEGIN:VTODO"))
+	b.WriteString(icalFold("UID:" + icalEscape(item.UId)))
+	b.WriteString(icalFold("DTSTAMP:" + time.Now().UTC().Format("20060102T150405Z")))
+	b.WriteString(icalFold("SUMMARY:" + icalEscape(item.Label())))
+	if item.Status == StatusChecked {
+		b.WriteString(icalFold("STATUS:COMPLETED"))
+		b.WriteString(icalFold("PERCENT-COMPLETE:100"))
+	} else {
+		b.WriteString(icalFold("STATUS:NEEDS-ACTION"))
+	}
+	if item.Shop != nil && item.Shop.Name != "" {
+		b.WriteString(icalFold("LOCATION:" + icalEscape(item.Shop.Name)))
+	}
+	if item.Category != "" {
+		b.WriteString(icalFold("CATEGORIES:" + icalEscape(item.Category)))
+	}
+	b.WriteString(icalFold(fmt.Sprintf("X-APPLE-SORT-ORDER:%d", item.Orderno)))
+	b.WriteString(icalFold("END:VTODO"))
+}
+
+// VTodo holds the properties of a VTODO we care about
+type VTodo struct {
+	UID        string
+	Summary    string
+	Status     string
+	Completed  bool
+	Location   string
+	Categories []string
+}
+
+// ParseVTodo reads the first VTODO from a calendar object
+func ParseVTodo(data string) (VTodo, error) {
+	todo := VTodo{}
+
+	// unfold continuation lines
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\n ", "")
+	data = strings.ReplaceAll(data, "\n\t", "")
+
+	inTodo, found := false, false
+	for _, line := range strings.Split(data, "\n") {
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		name, value := strings.ToUpper(line[:colon]), line[colon+1:]
+		// drop parameters like LOCATION;LANGUAGE=de
+		if semicolon := strings.Index(name, ";"); semicolon >= 0 {
+			name = name[:semicolon]
+		}
+
+		switch {
+		case name == "BEGIN" && strings.ToUpper(value) == "VTODO":
+			inTodo, found = true, true
+		case name == "END" && strings.ToUpper(value) == "VTODO":
+			inTodo = false
+		case !inTodo:
+		case name == "UID":
+			todo.UID = icalUnescape(value)
+		case name == "SUMMARY":
+			todo.Summary = icalUnescape(value)
+		case name == "STATUS":
+			todo.Status = strings.ToUpper(value)
+			todo.Completed = todo.Completed || todo.Status == "COMPLETED"
+		case name == "COMPLETED":
+			todo.Completed = true
+		case name == "PERCENT-COMPLETE":
+			todo.Completed = todo.Completed || value == "100"
+		case name == "LOCATION":
+			todo.Location = icalUnescape(value)
+		case name == "CATEGORIES":
+			for _, category := range splitICalList(value) {
+				todo.Categories = append(todo.Categories, icalUnescape(category))
+			}
+		}
+		if !inTodo && found {
+			break
+		}
+	}
+	if !found {
+		return todo, fmt.Errorf("no VTODO found")
+	}
+	// a task that was reopened keeps its COMPLETED date in some clients
+	if todo.Status == "NEEDS-ACTION" || todo.Status == "IN-PROCESS" {
+		todo.Completed = false
+	}
+	return todo, nil
+}
+
+// splitICalList splits a list value at commas that are not escaped
+func splitICalList(value string) []string {
+	var result []string
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case ',':
+			result = append(result, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(result, value[start:])
+}
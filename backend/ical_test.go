@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVTodoRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		item Item
+		todo VTodo
+	}{
+		{"plain", Item{UId: "i1", Title: "Bread", Status: StatusOpen},
+			VTodo{UID: "i1", Summary: "Bread", Status: "NEEDS-ACTION"}},
+		{"quantity", Item{UId: "i2", Title: "Flour", Quantity: 2, Unit: "kg", Status: StatusChecked},
+			VTodo{UID: "i2", Summary: "2 kg Flour", Status: "COMPLETED", Completed: true}},
+		{"escaping", Item{UId: "i3", Title: `Salt; pepper, a\b` + "\nand more", Status: StatusOpen, Category: "Spices, dry"},
+			VTodo{UID: "i3", Summary: `Salt; pepper, a\b` + "\nand more", Status: "NEEDS-ACTION", Categories: []string{"Spices, dry"}}},
+		{"folding", Item{UId: "i4", Title: strings.Repeat("Grüne Äpfel aus dem Alten Land ", 5), Status: StatusOpen,
+			Shop: &Shop{UId: "s1", Name: "Wochenmarkt"}},
+			VTodo{UID: "i4", Summary: strings.Repeat("Grüne Äpfel aus dem Alten Land ", 5), Status: "NEEDS-ACTION", Location: "Wochenmarkt"}},
+	}
+	for _, test := range tests {
+		data := RenderVTodo(&test.item)
+		for _, line := range strings.Split(strings.TrimSuffix(data, "\r\n"), "\r\n") {
+			if len(line) > 75 {
+				t.Errorf("%q: line is longer than 75 octets: %s", test.name, line)
+			}
+		}
+		todo, err := ParseVTodo(data)
+		if err != nil {
+			t.Errorf("%q: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(todo, test.todo) {
+			t.Errorf("%q: parsed\n%+v instead of\n%+v", test.name, todo, test.todo)
+		}
+	}
+}
+
+func TestParseVTodo(t *testing.T) {
+	tests := []struct {
+		name, data string
+		todo       VTodo
+	}{
+		{"parameters and tab folding",
+			"BEGIN:VCALENDAR\nBEGIN:VTODO\nUID:a1\nSUMMARY;LANGUAGE=de:Brot und\n\t Butter\nLOCATION;ALTREP=\"x\":Bäcker\nEND:VTODO\nEND:VCALENDAR\n",
+			VTodo{UID: "a1", Summary: "Brot und Butter", Location: "Bäcker"}},
+		{"categories list",
+			"BEGIN:VTODO\r\nUID:a2\r\nSUMMARY:Milk\r\nCATEGORIES:Dairy,Cold\\, fresh,Breakfast\r\nCATEGORIES:Other\r\nEND:VTODO\r\n",
+			VTodo{UID: "a2", Summary: "Milk", Categories: []string{"Dairy", "Cold, fresh", "Breakfast", "Other"}}},
+		{"completed without status",
+			"BEGIN:VTODO\r\nUID:a3\r\nSUMMARY:Eggs\r\nCOMPLETED:20240101T100000Z\r\nEND:VTODO\r\n",
+			VTodo{UID: "a3", Summary: "Eggs", Completed: true}},
+		{"reopened keeps its completed date",
+			"BEGIN:VTODO\r\nUID:a4\r\nSUMMARY:Eggs\r\nCOMPLETED:20240101T100000Z\r\nPERCENT-COMPLETE:100\r\nSTATUS:NEEDS-ACTION\r\nEND:VTODO\r\n",
+			VTodo{UID: "a4", Summary: "Eggs", Status: "NEEDS-ACTION"}},
+		{"only the first todo",
+			"BEGIN:VTODO\r\nUID:a5\r\nSUMMARY:First\r\nEND:VTODO\r\nBEGIN:VTODO\r\nUID:a6\r\nSUMMARY:Second\r\nEND:VTODO\r\n",
+			VTodo{UID: "a5", Summary: "First"}},
+	}
+	for _, test := range tests {
+		todo, err := ParseVTodo(test.data)
+		if err != nil {
+			t.Errorf("%q: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(todo, test.todo) {
+			t.Errorf("%q: parsed\n%+v instead of\n%+v", test.name, todo, test.todo)
+		}
+	}
+
+	if _, err := ParseVTodo("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nSUMMARY:Party\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"); err == nil {
+		t.Error("calendar without VTODO was parsed")
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// NoShopName is the heading for items that are not assigned to any shop
+const NoShopName = "Other"
+
+// ShopGroup holds all items of one shop, Shop is nil for items without shop
+type ShopGroup struct {
+	Shop  *Shop
+	Items []Item
+}
+
+// Name of the group for headings
+func (g *ShopGroup) Name() string {
+	if g.Shop == nil {
+		return NoShopName
+	}
+	return g.Shop.Name
+}
+
+// GroupItemsByShop sorts items into groups per shop, in the order of the shops.
+// Items without a shop or with an unknown shop come last. Empty groups are left out.
+func GroupItemsByShop(items []Item, shops []Shop, openOnly bool) []ShopGroup {
+	groups := make([]ShopGroup, 0, len(shops)+1)
+	index := make(map[string]int)
+	for i := range shops {
+		index[shops[i].UId] = len(groups)
+		groups = append(groups, ShopGroup{Shop: &shops[i]})
+	}
+	noShop := ShopGroup{}
+
+	for _, item := range items {
+		if openOnly && item.Status != StatusOpen {
+			continue
+		}
+		if item.Shop != nil {
+			if i, ok := index[item.Shop.UId]; ok {
+				groups[i].Items = append(groups[i].Items, item)
+				continue
+			}
+		}
+		noShop.Items = append(noShop.Items, item)
+	}
+	groups = append(groups, noShop)
+
+	// remove empty groups
+	result := groups[:0]
+	for _, group := range groups {
+		if len(group.Items) > 0 {
+			result = append(result, group)
+		}
+	}
+	return result
+}
+
+// list export formats with their content types
+var listFormats = map[string]string{
+	"csv":      "text/csv; charset=UTF-8",
+	"markdown": "text/markdown; charset=UTF-8",
+	"text":     echo.MIMETextPlainCharsetUTF8,
+	"todotxt":  echo.MIMETextPlainCharsetUTF8,
+}
+
+// RenderList writes the grouped items in the given format
+func RenderList(w io.Writer, format string, groups []ShopGroup) error {
+	switch format {
+	case "csv":
+		return renderCSV(w, groups)
+	case "markdown":
+		return renderMarkdown(w, groups)
+	case "text":
+		return renderText(w, groups)
+	case "todotxt":
+		return RenderTodoTxt(w, groups)
+	}
+	return fmt.Errorf("unknown format %s", format)
+}
+
+// renderCSV writes one line per item with a header line
+func renderCSV(w io.Writer, groups []ShopGroup) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"shop", "title", "quantity", "unit", "status"}); err != nil {
+		return err
+	}
+	for _, group := range groups {
+		shop := ""
+		if group.Shop != nil {
+			shop = group.Shop.Name
+		}
+		for _, item := range group.Items {
+			quantity := ""
+			if item.Quantity != 0 {
+				quantity = strconv.FormatFloat(item.Quantity, 'f', -1, 64)
+			}
+			if err := writer.Write([]string{shop, item.Title, quantity, item.Unit, item.Status}); err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// renderMarkdown writes a checklist with one heading per shop
+func renderMarkdown(w io.Writer, groups []ShopGroup) error {
+	for i, group := range groups {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "## %s\n\n", group.Name()); err != nil {
+			return err
+		}
+		for _, item := range group.Items {
+			check := " "
+			if item.Status == StatusChecked {
+				check = "x"
+			}
+			if _, err := fmt.Fprintf(w, "- [%s] %s\n", check, item.Label()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// renderText writes a plain list that can be pasted into chats
+func renderText(w io.Writer, groups []ShopGroup) error {
+	for i, group := range groups {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s:\n", group.Name()); err != nil {
+			return err
+		}
+		for _, item := range group.Items {
+			line := "- " + item.Label()
+			if item.Status == StatusChecked {
+				line += " (done)"
+			}
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ********************************** //
+//             handlers:              //
+// ********************************** //
+
+// GET /items/export/:format renders the list as csv, markdown, text or todotxt.
+// With ?open=true only OPEN items are exported.
+func exportItems(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		format := strings.ToLower(ctx.Param("format"))
+		contentType, ok := listFormats[format]
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Unknown format, use csv, markdown, text or todotxt")
+		}
+		openOnly := false
+		if param := ctx.QueryParam("open"); param != "" {
+			var err error
+			openOnly, err = strconv.ParseBool(param)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "open must be true or false")
+			}
+		}
+
+		items, err := GetAllItems(db)
+		if err != nil {
+			ctx.Logger().Infof("exportItems: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read items")
+		}
+		shops, err := GetAllShops(db)
+		if err != nil {
+			ctx.Logger().Infof("exportItems: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read shops")
+		}
+
+		var buf bytes.Buffer
+		groups := GroupItemsByShop(shareItems(ctx, items.Items), shareShops(ctx, shops.Shops), openOnly)
+		if err = RenderList(&buf, format, groups); err != nil {
+			ctx.Logger().Infof("exportItems: Render Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not render items")
+		}
+		return ctx.Blob(http.StatusOK, contentType, buf.Bytes())
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestGroupItemsByShop(t *testing.T) {
+	shops := []Shop{{UId: "s1", Name: "Bakery"}, {UId: "s2", Name: "Market"}, {UId: "s3", Name: "Butcher"}}
+	items := []Item{
+		{UId: "i1", Title: "Apples", Status: StatusOpen, Shop: &shops[1]},
+		{UId: "i2", Title: "Soap", Status: StatusOpen},
+		{UId: "i3", Title: "Bread", Status: StatusChecked, Shop: &shops[0]},
+		{UId: "i4", Title: "Rolls", Status: StatusOpen, Shop: &shops[0]},
+		{UId: "i5", Title: "Cheese", Status: StatusOpen, Shop: &Shop{UId: "gone", Name: "Closed"}},
+	}
+	tests := []struct {
+		openOnly bool
+		groups   []string
+		items    [][]string
+	}{
+		{openOnly: false, groups: []string{"Bakery", "Market", NoShopName},
+			items: [][]string{{"i3", "i4"}, {"i1"}, {"i2", "i5"}}},
+		{openOnly: true, groups: []string{"Bakery", "Market", NoShopName},
+			items: [][]string{{"i4"}, {"i1"}, {"i2", "i5"}}},
+	}
+	for _, test := range tests {
+		groups := GroupItemsByShop(items, shops, test.openOnly)
+		if len(groups) != len(test.groups) {
+			t.Errorf("open only %v: %+v", test.openOnly, groups)
+			continue
+		}
+		for i, group := range groups {
+			if group.Name() != test.groups[i] || len(group.Items) != len(test.items[i]) {
+				t.Errorf("open only %v: group %d is %s with %+v", test.openOnly, i, group.Name(), group.Items)
+				continue
+			}
+			for j, item := range group.Items {
+				if item.UId != test.items[i][j] {
+					t.Errorf("open only %v: group %s has %s instead of %s", test.openOnly, group.Name(), item.UId, test.items[i][j])
+				}
+			}
+		}
+	}
+}
+
+func TestRenderList(t *testing.T) {
+	shop := &Shop{UId: "s1", Name: "Corner, Bakery"}
+	groups := []ShopGroup{
+		{Shop: shop, Items: []Item{{UId: "i1", Title: "Bread", Status: StatusChecked, Shop: shop}}},
+		{Items: []Item{{UId: "i2", Title: "Milk", Status: StatusOpen, Quantity: 1.5, Unit: "l"}}},
+	}
+	tests := []struct {
+		format string
+		output string
+	}{
+		{"csv", "shop,title,quantity,unit,status\n\"Corner, Bakery\",Bread,,,CHECKED\n,Milk,1.5,l,OPEN\n"},
+		{"markdown", "## Corner, Bakery\n\n- [x] Bread\n\n## Other\n\n- [ ] 1.5 l Milk\n"},
+		{"text", "Corner, Bakery:\n- Bread (done)\n\nOther:\n- 1.5 l Milk\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := RenderList(&buf, test.format, groups); err != nil {
+			t.Errorf("%s: %v", test.format, err)
+			continue
+		}
+		if buf.String() != test.output {
+			t.Errorf("%s: rendered\n%s\ninstead of\n%s", test.format, buf.String(), test.output)
+		}
+		if err := RenderList(failingWriter{}, test.format, groups); !errors.Is(err, errWriteFailed) {
+			t.Errorf("%s: writing to a failing writer returned %v", test.format, err)
+		}
+	}
+}
+
+var errWriteFailed = errors.New("write failed")
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errWriteFailed
+}
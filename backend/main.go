@@ -4,6 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -19,6 +22,28 @@ type Options struct {
 	Domain               *string
 	Port                 *int
 	BindIP               *string
+	SnapshotInterval     *time.Duration
+	SnapshotKeep         *int
+	TrashDays            *int
+	EventBacklog         *int
+	EventQueue           *int
+	MaxSubscribers       *int
+	SlowConsumers        *string
+	Heartbeat            *time.Duration
+	EventRetry           *time.Duration
+	EventWriteTimeout    *time.Duration
+	Broker               *string
+	BrokerPoll           *time.Duration
+	SessionLifetime      *time.Duration
+	OIDCIssuer           *string
+	OIDCClientID         *string
+	OIDCClientSecret     *string
+	OIDCRedirectURL      *string
+	OIDCAllowedEmails    *string
+	OIDCAllowedGroups    *string
+	OIDCGroupsClaim      *string
+	OIDCScopes           *string
+	OIDCRole             *string
 	LogLevel             log.Lvl
 }
 
@@ -30,12 +55,39 @@ func parseFlags() *Options {
 	options.Port = flag.Int("port", 8080, "The Port that the application uses for listening")
 	options.Domain = flag.String("domain", "localhost", "The Domain for CORS and TLS")
 	options.DatabaseFile = flag.String("db", "storage.db", "The file to store the sqlite3 database")
-	options.HTTPBaseAuthUser = flag.String("user", "", "The user name for HTTP Base authentication")
-	options.HTTPBaseAuthPassword = flag.String("password", "", "The password for HTTP Base authentication")
+	options.HTTPBaseAuthUser = flag.String("user", "", "An admin user to create or update on start, use the users subcommand for more")
+	options.HTTPBaseAuthPassword = flag.String("password", "", "The password of the admin user given with -user")
 	options.BindIP = flag.String("bind", "", "The IP address to bind to, defaults to all local")
+	options.SnapshotInterval = flag.Duration("snapshot-interval", 6*time.Hour, "How often to take automatic snapshots of the lists, 0 disables them")
+	options.SnapshotKeep = flag.Int("snapshot-keep", 28, "How many automatic snapshots to keep")
+	options.TrashDays = flag.Int("trash-days", 30, "After how many days deleted items and shops are purged from the trash, 0 keeps them forever")
+	options.EventBacklog = flag.Int("event-backlog", 1000, "How many events to keep for clients that reconnect after missing some")
+	options.EventQueue = flag.Int("event-queue", 64, "How many events may wait for a client before it counts as slow")
+	options.MaxSubscribers = flag.Int("max-subscribers", 100, "How many clients may listen to events at the same time, 0 for no limit")
+	options.SlowConsumers = flag.String("slow-consumers", SlowResync, fmt.Sprintf("What to do with clients that do not keep up with the events: %s drops their events and makes them reload, %s drops them", SlowResync, SlowDisconnect))
+	options.Heartbeat = flag.Duration("heartbeat", 30*time.Second, "How often to send a heartbeat on idle event streams, 0 disables it")
+	options.EventRetry = flag.Duration("event-retry", 5*time.Second, "How long clients should wait before reconnecting a lost event stream, 0 leaves it to them")
+	options.EventWriteTimeout = flag.Duration("event-write-timeout", 15*time.Second, "How long sending an event may take before the client is dropped, 0 waits forever")
+	options.Broker = flag.String("broker", BrokerMemory, fmt.Sprintf("How events get to the clients: %s within this process, %s through the database, for several instances sharing it", BrokerMemory, BrokerSQLite))
+	options.BrokerPoll = flag.Duration("broker-poll", 500*time.Millisecond, "How often the sqlite broker looks for events of other instances")
+	options.SessionLifetime = flag.Duration("session-lifetime", 30*24*time.Hour, "How long a login lasts without being used")
+	options.OIDCIssuer = flag.String("oidc-issuer", "", "The issuer URL of an OpenID Connect provider to log in with, empty disables it")
+	options.OIDCClientID = flag.String("oidc-client-id", "", "The client id registered at the OpenID Connect provider")
+	options.OIDCClientSecret = flag.String("oidc-client-secret", "", "The client secret registered at the OpenID Connect provider, if any")
+	options.OIDCRedirectURL = flag.String("oidc-redirect-url", "", "Where the OpenID Connect provider sends users back to, defaults to /oidc/callback on the requested host")
+	options.OIDCAllowedEmails = flag.String("oidc-allowed-emails", "", "Comma separated email addresses, or domains like @example.com, that may log in with OpenID Connect")
+	options.OIDCAllowedGroups = flag.String("oidc-allowed-groups", "", "Comma separated groups whose members may log in with OpenID Connect")
+	options.OIDCGroupsClaim = flag.String("oidc-groups-claim", "groups", "The claim of the ID token that holds the groups")
+	options.OIDCScopes = flag.String("oidc-scopes", "", "Comma separated scopes to request from the OpenID Connect provider, defaults to openid, email, profile and groups if -oidc-allowed-groups is set")
+	options.OIDCRole = flag.String("oidc-role", RoleEditor, "The household role of users created on their first OpenID Connect login, empty lets owners invite them")
 	debugFlag := flag.Bool("debug", false, "Activate debug logging")
 
 	// parse command line into options
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		commandUsage()
+	}
 	flag.Parse()
 
 	// some options need special treatment
@@ -52,12 +104,61 @@ func parseFlags() *Options {
 	if *options.HTTPBaseAuthPassword != "" && *options.HTTPBaseAuthUser == "" {
 		log.Fatal("Can not use HTTP Base Authentication with only password, needs also user")
 	}
-	log.Infof("options: %v/%v", *options.HTTPBaseAuthUser, *options.HTTPBaseAuthPassword)
+	if *options.TrashDays < 0 {
+		log.Fatal("Can not keep items in the trash for a negative number of days")
+	}
+	if *options.SnapshotKeep < 1 {
+		log.Fatal("Need to keep at least one snapshot")
+	}
+	if *options.Heartbeat < 0 || *options.EventRetry < 0 || *options.EventWriteTimeout < 0 {
+		log.Fatal("Can not use negative durations for event streams")
+	}
+	if *options.EventBacklog < 0 {
+		log.Fatal("Can not keep a negative number of events")
+	}
+	if *options.MaxSubscribers < 0 {
+		log.Fatal("Can not allow a negative number of subscribers, use 0 for no limit")
+	}
+	if *options.EventQueue < 1 {
+		log.Fatal("Need to queue at least one event per client")
+	}
+	if *options.SlowConsumers != SlowResync && *options.SlowConsumers != SlowDisconnect {
+		log.Fatalf("slow-consumers must be one of %s", strings.Join(AllowedSlowPolicies, ", "))
+	}
+	if *options.Broker != BrokerMemory && *options.Broker != BrokerSQLite {
+		log.Fatalf("broker must be one of %s", strings.Join(AllowedBrokers, ", "))
+	}
+	if *options.SessionLifetime < time.Minute {
+		log.Fatal("Sessions need to last at least a minute")
+	}
+	if *options.BrokerPoll <= 0 {
+		log.Fatal("Need a positive interval for polling the broker")
+	}
+	if *options.OIDCIssuer != "" {
+		if *options.OIDCClientID == "" {
+			log.Fatal("Can not log in with OpenID Connect without client id")
+		}
+		if *options.OIDCAllowedEmails == "" && *options.OIDCAllowedGroups == "" {
+			log.Fatal("Can not log in with OpenID Connect without allowed emails or groups")
+		}
+		if *options.OIDCRole != "" && !isAllowedRole(*options.OIDCRole) {
+			log.Fatalf("oidc-role must be empty or one of %s", strings.Join(AllowedRoles, ", "))
+		}
+	}
+	log.Infof("options: user %v", *options.HTTPBaseAuthUser)
 	return options
 }
 
 func main() {
 
+	// subcommands run instead of the server
+	if ok, err := runCommand(os.Args[1:]); ok {
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	options := parseFlags()
 
 	// Echo instance
@@ -68,8 +169,37 @@ func main() {
 	db := initDB(*options.DatabaseFile)
 	migrate(db)
 
+	// periodic snapshots
+	if *options.SnapshotInterval > 0 {
+		go scheduleSnapshots(db, *options.SnapshotInterval, *options.SnapshotKeep)
+	}
+
+	// purge old entries from the trash
+	if *options.TrashDays > 0 {
+		go schedulePurge(db, *options.TrashDays)
+	}
+
+	// passes the update notifications between instances
+	var broker Broker = NewMemoryBroker()
+	if *options.Broker == BrokerSQLite {
+		sqliteBroker, err := NewSQLiteBroker(db, *options.BrokerPoll)
+		if err != nil {
+			log.Fatalf("Could not start the sqlite broker: %v", err)
+		}
+		broker = sqliteBroker
+	}
+
 	// channel to send back and forth update notifications
-	notifier := NewNotifier()
+	notifier := NewNotifier(NotifierConfig{
+		Backlog:      *options.EventBacklog,
+		QueueSize:    *options.EventQueue,
+		SlowPolicy:   *options.SlowConsumers,
+		MaxReceivers: *options.MaxSubscribers,
+		Broker:       broker,
+	})
+
+	// tell the other instances which clients are still here
+	go schedulePresence(notifier, presenceInterval, presenceTTL)
 
 	// Middleware
 	e.AutoTLSManager.Cache = autocert.DirCache(".cache")
@@ -88,23 +218,49 @@ func main() {
 				fmt.Sprintf("http://127.0.0.1:3000")},
 
 			AllowMethods: []string{echo.GET, echo.PUT, echo.POST, echo.DELETE, echo.OPTIONS},
+			// the frontend sends its session cookie
+			AllowCredentials: true,
 		}
 	} else {
 		corsConfig = middleware.CORSConfig{
 			AllowOrigins: []string{fmt.Sprintf("https://%s:%d", *options.Domain, *options.Port)},
 			AllowMethods: []string{echo.GET, echo.PUT, echo.POST, echo.DELETE, echo.OPTIONS},
+			// the frontend sends its session cookie
+			AllowCredentials: true,
 		}
 	}
+	// CalDAV clients are no browsers and need to see OPTIONS requests themselves
+	corsConfig.Skipper = func(ctx echo.Context) bool {
+		return strings.HasPrefix(ctx.Request().URL.Path, davPrefix+"/") || ctx.Request().URL.Path == davPrefix
+	}
 	e.Use(middleware.CORSWithConfig(corsConfig))
 
-	// basic auth
+	// the user from the command line is kept for existing setups
 	if *options.HTTPBaseAuthUser != "" {
-		e.Use(middleware.BasicAuth(func(username, password string, c echo.Context) (bool, error) {
-			if username == *options.HTTPBaseAuthUser && password == *options.HTTPBaseAuthPassword {
-				return true, nil
-			}
-			return false, nil
-		}))
+		if err := EnsureUser(db, *options.HTTPBaseAuthUser, *options.HTTPBaseAuthPassword); err != nil {
+			log.Fatalf("Could not create user %s: %v", *options.HTTPBaseAuthUser, err)
+		}
+	}
+	// logins, cookies are only sent over HTTPS outside of development
+	sessionConfig := SessionConfig{
+		Lifetime: *options.SessionLifetime,
+		Secure:   *options.Domain != "localhost",
+	}
+
+	// logins with an OpenID Connect provider, if there is one
+	var oidcProvider *OIDCProvider
+	if *options.OIDCIssuer != "" {
+		oidcProvider = NewOIDCProvider(OIDCConfig{
+			Issuer:        *options.OIDCIssuer,
+			ClientID:      *options.OIDCClientID,
+			ClientSecret:  *options.OIDCClientSecret,
+			RedirectURL:   *options.OIDCRedirectURL,
+			AllowedEmails: splitParam(*options.OIDCAllowedEmails),
+			AllowedGroups: splitParam(*options.OIDCAllowedGroups),
+			GroupsClaim:   *options.OIDCGroupsClaim,
+			Scopes:        splitParam(*options.OIDCScopes),
+			Role:          *options.OIDCRole,
+		})
 	}
 
 	// routes for static files
@@ -113,10 +269,17 @@ func main() {
 	// apis have their own middlewares: group them
 	apis := e.Group("/api")
 
-	// only allow application/json content type:
+	// requests log in with a token, a session, a share link or HTTP Base Authentication. Only members
+	// of the household and share links may use the list, the household and users have their own checks
+	apis.Use(userAuth(db, sessionConfig, false, "/api/login"))
+	apis.Use(listAccess(db, apiOwnAccess...))
+
+	// only allow application/json content type on requests that can have a body, so that the list exports
+	// can be downloaded without it. Empty POSTs are checked too, forms of other sites could send them:
 	apis.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(ctx echo.Context) error {
-			if ctx.Request().Header.Get(echo.HeaderContentType) != echo.MIMEApplicationJSON {
+			method := ctx.Request().Method
+			if method != http.MethodGet && method != http.MethodHead && ctx.Request().Header.Get(echo.HeaderContentType) != echo.MIMEApplicationJSON {
 				return echo.NewHTTPError(http.StatusUnsupportedMediaType, "we only accept JSON data, sorry.")
 			}
 			// For valid credentials call next
@@ -127,14 +290,108 @@ func main() {
 	// Routes for items
 	apis.GET("/items", showAllItems(db))
 	apis.POST("/items/sync", syncItems(db, notifier))
+	apis.GET("/items/export/:format", exportItems(db))
+	apis.POST("/items/import", importText(db, notifier))
+	apis.POST("/items/recipe", importRecipe(db, notifier))
 
 	// Routes for shops
 	apis.GET("/shops", showAllShops(db))
 	apis.POST("/shops/sync", syncShops(db, notifier))
 
+	// Routes for recipes and the meal plan
+	apis.GET("/recipes", showRecipes(db))
+	apis.POST("/recipes", saveRecipe(db))
+	apis.GET("/recipes/:uid", showRecipe(db))
+	apis.PUT("/recipes/:uid", saveRecipe(db))
+	apis.DELETE("/recipes/:uid", deleteRecipe(db))
+	apis.GET("/meals", showMeals(db))
+	apis.POST("/meals", addMeal(db))
+	apis.DELETE("/meals/:id", deleteMeal(db))
+	apis.POST("/meals/shopping", shopMeals(db, notifier))
+
+	// Routes for the event streams
+	apis.GET("/events/stats", showEventStats(notifier))
+	apis.GET("/presence", showPresence(notifier))
+	apis.PUT("/presence", setPresence(db, notifier))
+
+	// Routes for logins
+	apis.GET("/login", showLoginOptions(oidcProvider))
+	apis.POST("/login", login(db, sessionConfig))
+	apis.POST("/logout", logout(db, sessionConfig))
+	apis.GET("/sessions", showSessions(db))
+	apis.DELETE("/sessions/:id", deleteSession(db))
+
+	// Routes for API tokens, only people can manage them
+	tokens := apis.Group("/tokens", peopleOnly())
+	tokens.GET("", showTokens(db))
+	tokens.POST("", createToken(db))
+	tokens.DELETE("/:id", deleteToken(db))
+
+	// Routes for share links, editors create and revoke them
+	shares := apis.Group("/shares", peopleOnly())
+	shares.GET("", showShares(db))
+	shares.POST("", createShare(db))
+	shares.DELETE("/:id", deleteShare(db))
+
+	// Routes for users, only admins can manage them
+	apis.GET("/me", showMe())
+	users := apis.Group("/users", requireAdmin(db))
+	users.GET("", showUsers(db))
+	users.POST("", createUser(db))
+	users.PUT("/:name", updateUser(db))
+	users.DELETE("/:name", deleteUser(db))
+	users.DELETE("/:name/sessions", deleteUserSessions(db))
+
+	// Routes for the household sharing the list
+	household := apis.Group("/household", memberAccess(db))
+	household.GET("", showHousehold(db))
+	household.PUT("/members/:name", setMember(db), requireOwner())
+	household.DELETE("/members/:name", deleteMember(db))
+
+	// Routes for the audit log, the history is only for members of the household
+	changesets := apis.Group("/changesets", fullAccess())
+	changesets.GET("", showChangesets(db))
+	changesets.POST("/:id/revert", revertChangeset(db, notifier))
+
+	// Routes for snapshots
+	snapshots := apis.Group("/snapshots", fullAccess())
+	snapshots.GET("", showSnapshots(db))
+	snapshots.POST("", createSnapshot(db))
+	snapshots.GET("/:id", showSnapshot(db))
+	snapshots.DELETE("/:id", deleteSnapshot(db))
+	snapshots.POST("/:id/restore", restoreSnapshot(db, notifier))
+
+	// Routes for the trash
+	trash := apis.Group("/trash", fullAccess())
+	trash.GET("", showTrash(db))
+	trash.POST("/items/:uid/restore", restoreItem(db, notifier))
+	trash.POST("/shops/:uid/restore", restoreShop(db, notifier))
+
+	// Routes for export and import
+	apis.GET("/export", exportAll(db), fullAccess())
+	apis.POST("/import", importAll(db, notifier), fullAccess())
+
+	// CalDAV access to the items, outside of /api because it speaks XML
+	e.Any("/.well-known/caldav", davWellKnown())
+	dav := e.Group(davPrefix, userAuth(db, sessionConfig, true), listAccess(db))
+	dav.Any("", davHandler(db, notifier))
+	dav.Any("/*", davHandler(db, notifier))
+
+	// logins with the OpenID Connect provider, outside of /api because browsers navigate there
+	if oidcProvider != nil {
+		e.GET("/oidc/login", oidcLogin(oidcProvider, sessionConfig))
+		e.GET("/oidc/callback", oidcCallback(db, oidcProvider, sessionConfig))
+	}
+
 	// events
-	events := e.Group("/events")
-	events.GET("", eventsStream(notifier))
+	events := e.Group("/events", userAuth(db, sessionConfig, false), listAccess(db))
+	streamConfig := StreamConfig{
+		Heartbeat:    *options.Heartbeat,
+		Retry:        *options.EventRetry,
+		WriteTimeout: *options.EventWriteTimeout,
+	}
+	events.GET("", eventsStream(notifier, streamConfig))
+	events.GET("/ws", eventsSocket(db, notifier, streamConfig, corsConfig.AllowOrigins))
 
 	// Start server
 	e.Logger.Fatal(e.Start(fmt.Sprintf("%s:%d", *options.BindIP, *options.Port)))
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// DayFormat is the format of the days in the meal plan
+const DayFormat = "2006-01-02"
+
+// Meal is a recipe planned for one day
+type Meal struct {
+	ID        int64   `json:"id"`
+	Day       string  `json:"day"`
+	RecipeUId string  `json:"recipe_uid"`
+	Recipe    string  `json:"recipe,omitempty"`
+	Servings  float64 `json:"servings,omitempty"`
+}
+
+// Valid tells you whether a meal is valid
+func (m *Meal) Valid() (bool, []string) {
+	var errors []string
+	if _, err := time.Parse(DayFormat, m.Day); err != nil {
+		errors = append(errors, fmt.Sprintf("Day is of wrong format (%s), YYYY-MM-DD expected", m.Day))
+	}
+	if m.RecipeUId == "" {
+		errors = append(errors, "Recipe is missing")
+	}
+	if m.Servings < 0 {
+		errors = append(errors, "Servings must not be negative")
+	}
+	return len(errors) == 0, errors
+}
+
+// RecipeInput is a recipe to store, either given as is or found in a html page or JSON-LD
+type RecipeInput struct {
+	Recipe
+	HTML   string          `json:"html,omitempty"`
+	JSONLD json.RawMessage `json:"jsonld,omitempty"`
+}
+
+// MealPlanShopping is the input and result of adding the ingredients of planned meals to the list
+type MealPlanShopping struct {
+	From     string          `json:"from"`
+	To       string          `json:"to"`
+	Dedupe   bool            `json:"dedupe"`
+	Preview  bool            `json:"preview,omitempty"`
+	Meals    []Meal          `json:"meals,omitempty"`
+	Items    []Item          `json:"items,omitempty"`
+	Warnings []string        `json:"warnings,omitempty"`
+	List     *ItemCollection `json:"list,omitempty"`
+}
+
+// week returns the monday of the week of the given time and the sunday after it
+func week(t time.Time) (string, string) {
+	offset := (int(t.Weekday()) + 6) % 7
+	monday := t.AddDate(0, 0, -offset)
+	return monday.Format(DayFormat), monday.AddDate(0, 0, 6).Format(DayFormat)
+}
+
+// ********************************** //
+//     database access functions:     //
+// ********************************** //
+
+// GetAllRecipes loads all recipes with their ingredients, ordered by name
+func GetAllRecipes(db queryer) ([]Recipe, error) {
+	result := make([]Recipe, 0)
+
+	sql := "SELECT uid, name, servings, source FROM recipes ORDER BY name, uid"
+	rows, err := db.Query(sql)
+	// Exit if the SQL doesn't work for some reason
+	if err != nil {
+		return result, err
+	}
+	// make sure to cleanup when the program exits
+	defer rows.Close()
+
+	for rows.Next() {
+		recipe := Recipe{}
+		err = rows.Scan(&recipe.UId, &recipe.Name, &recipe.Servings, &recipe.Source)
+		// Exit if we get an error
+		if err != nil {
+			return result, err
+		}
+		result = append(result, recipe)
+	}
+	if err = rows.Err(); err != nil {
+		return result, err
+	}
+	rows.Close()
+
+	// load ingredients after the rows are closed
+	for i := range result {
+		result[i].Ingredients, err = getIngredients(db, result[i].UId)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// GetRecipeByID loads one recipe with its ingredients, identified by its id
+func GetRecipeByID(db *sql.DB, uid string) (Recipe, error) {
+	recipe := Recipe{}
+	query := "SELECT uid, name, servings, source FROM recipes WHERE uid = ?"
+	err := db.QueryRow(query, uid).Scan(&recipe.UId, &recipe.Name, &recipe.Servings, &recipe.Source)
+	if err != nil {
+		return recipe, err
+	}
+	recipe.Ingredients, err = getIngredients(db, uid)
+	return recipe, err
+}
+
+func getIngredients(db queryer, recipeID string) ([]Ingredient, error) {
+	result := make([]Ingredient, 0)
+	query := "SELECT title, quantity, unit, text FROM recipe_ingredients WHERE recipe_id = ? ORDER BY position"
+	rows, err := db.Query(query, recipeID)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		ingredient := Ingredient{}
+		if err = rows.Scan(&ingredient.Title, &ingredient.Quantity, &ingredient.Unit, &ingredient.Text); err != nil {
+			return result, err
+		}
+		result = append(result, ingredient)
+	}
+	return result, rows.Err()
+}
+
+// UpsertRecipe writes a recipe with its ingredients to database, the ingredients are replaced
+func UpsertRecipe(db *sql.DB, recipe *Recipe) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// make sure nothing stays half written
+	defer tx.Rollback()
+
+	if err = upsertRecipe(tx, recipe); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// upsertRecipe writes a recipe within a transaction, see UpsertRecipe
+func upsertRecipe(tx *sql.Tx, recipe *Recipe) error {
+	query := `INSERT INTO recipes(uid, name, servings, source) VALUES(?, ?, ?, ?)
+		ON CONFLICT(uid) DO UPDATE SET name = excluded.name, servings = excluded.servings, source = excluded.source`
+	if _, err := tx.Exec(query, recipe.UId, recipe.Name, recipe.Servings, recipe.Source); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recipe_ingredients WHERE recipe_id = ?", recipe.UId); err != nil {
+		return err
+	}
+	query = "INSERT INTO recipe_ingredients(recipe_id, position, title, quantity, unit, text) VALUES(?, ?, ?, ?, ?, ?)"
+	for i, ingredient := range recipe.Ingredients {
+		_, err := tx.Exec(query, recipe.UId, i, ingredient.Title, ingredient.Quantity, ingredient.Unit, ingredient.Text)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteRecipeByID deletes one recipe with its ingredients and the meals planned with it
+func DeleteRecipeByID(db *sql.DB, uid string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	// make sure nothing stays half deleted
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("DELETE FROM meals WHERE recipe_id = ?", uid); err != nil {
+		return 0, err
+	}
+	if _, err = tx.Exec("DELETE FROM recipe_ingredients WHERE recipe_id = ?", uid); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec("DELETE FROM recipes WHERE uid = ?", uid)
+	if err != nil {
+		return 0, err
+	}
+	numDeleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(numDeleted), tx.Commit()
+}
+
+// GetMeals loads the meals planned from one day to another, both included
+func GetMeals(db queryer, from, to string) ([]Meal, error) {
+	return queryMeals(db, "WHERE meals.day >= ? AND meals.day <= ?", from, to)
+}
+
+// GetAllMeals loads all planned meals
+func GetAllMeals(db queryer) ([]Meal, error) {
+	return queryMeals(db, "")
+}
+
+// queryMeals loads the meals matching the where clause, ordered by day
+func queryMeals(db queryer, where string, args ...interface{}) ([]Meal, error) {
+	result := make([]Meal, 0)
+
+	sql := `SELECT meals.id, meals.day, meals.recipe_id, recipes.name, meals.servings
+		FROM meals JOIN recipes ON recipes.uid = meals.recipe_id ` + where + " ORDER BY meals.day, meals.id"
+	rows, err := db.Query(sql, args...)
+	// Exit if the SQL doesn't work for some reason
+	if err != nil {
+		return result, err
+	}
+	// make sure to cleanup when the program exits
+	defer rows.Close()
+
+	for rows.Next() {
+		meal := Meal{}
+		err = rows.Scan(&meal.ID, &meal.Day, &meal.RecipeUId, &meal.Recipe, &meal.Servings)
+		// Exit if we get an error
+		if err != nil {
+			return result, err
+		}
+		result = append(result, meal)
+	}
+	return result, rows.Err()
+}
+
+// AddMeal plans a meal, the id is set on the given meal
+func AddMeal(db queryer, meal *Meal) error {
+	result, err := db.Exec("INSERT INTO meals(day, recipe_id, servings) VALUES(?, ?, ?)", meal.Day, meal.RecipeUId, meal.Servings)
+	if err != nil {
+		return err
+	}
+	meal.ID, err = result.LastInsertId()
+	return err
+}
+
+// DeleteMealByID removes a meal from the plan
+func DeleteMealByID(db *sql.DB, id int64) (int, error) {
+	result, err := db.Exec("DELETE FROM meals WHERE id = ?", id)
+	if err != nil {
+		return 0, err
+	}
+	numDeleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(numDeleted), nil
+}
+
+// MealItems collects the ingredients of all meals, scaled to the planned servings
+// and added up across the meals
+func MealItems(db *sql.DB, meals []Meal) ([]Item, error) {
+	var items []Item
+	recipes := make(map[string]Recipe)
+	for _, meal := range meals {
+		recipe, ok := recipes[meal.RecipeUId]
+		if !ok {
+			var err error
+			recipe, err = GetRecipeByID(db, meal.RecipeUId)
+			if err != nil {
+				return nil, err
+			}
+			recipes[meal.RecipeUId] = recipe
+		}
+		items = append(items, recipe.Items(meal.Servings)...)
+	}
+	return AggregateItems(items), nil
+}
+
+// ********************************** //
+//             handlers:              //
+// ********************************** //
+
+// GET /recipes lists all recipes
+func showRecipes(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		recipes, err := GetAllRecipes(db)
+		if err != nil {
+			ctx.Logger().Infof("showRecipes: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read recipes")
+		}
+		return ctx.JSON(http.StatusOK, recipes)
+	}
+}
+
+// GET /recipes/:uid shows one recipe
+func showRecipe(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		recipe, err := GetRecipeByID(db, ctx.Param("uid"))
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusNotFound, "No such recipe")
+		}
+		if err != nil {
+			ctx.Logger().Infof("showRecipe: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read recipe")
+		}
+		return ctx.JSON(http.StatusOK, recipe)
+	}
+}
+
+// POST /recipes stores a new recipe and PUT /recipes/:uid replaces one.
+// The recipe can be given as is, or as html page or JSON-LD to read it from.
+// Ingredients with a text but without title are parsed from the text.
+func saveRecipe(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+
+		// bind body into struct
+		input := &RecipeInput{}
+		err := ctx.Bind(input)
+		if err != nil {
+			ctx.Logger().Infof("saveRecipe: Bind Error with request %v: %v", ctx.Request().Body, err)
+			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+		}
+
+		recipe := input.Recipe
+		if len(input.JSONLD) > 0 || input.HTML != "" {
+			recipe, err = extractRecipeInput(input.HTML, input.JSONLD)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+			}
+			// given values take precedence over the ones found
+			if input.Name != "" {
+				recipe.Name = input.Name
+			}
+			if input.Servings != 0 {
+				recipe.Servings = input.Servings
+			}
+			recipe.Source = input.Source
+		}
+		for i, ingredient := range recipe.Ingredients {
+			if ingredient.Title == "" && ingredient.Text != "" {
+				recipe.Ingredients[i] = ParseIngredient(ingredient.Text)
+			}
+		}
+
+		status := http.StatusCreated
+		recipe.UId = NewUID()
+		if uid := ctx.Param("uid"); uid != "" {
+			_, err = GetRecipeByID(db, uid)
+			if err == sql.ErrNoRows {
+				return echo.NewHTTPError(http.StatusNotFound, "No such recipe")
+			}
+			if err != nil {
+				ctx.Logger().Infof("saveRecipe: Database Error on get %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Could not read recipe")
+			}
+			status = http.StatusOK
+			recipe.UId = uid
+		}
+
+		if ok, errors := recipe.Valid(); !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, strings.Join(errors, "; "))
+		}
+
+		// do database operation
+		if err = UpsertRecipe(db, &recipe); err != nil {
+			ctx.Logger().Infof("saveRecipe: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not save recipe")
+		}
+		return ctx.JSON(status, recipe)
+	}
+}
+
+// DELETE /recipes/:uid removes a recipe and the meals planned with it
+func deleteRecipe(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		num, err := DeleteRecipeByID(db, ctx.Param("uid"))
+		if err != nil {
+			ctx.Logger().Infof("deleteRecipe: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not delete recipe")
+		}
+		if num == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "No such recipe")
+		}
+		return ctx.NoContent(http.StatusNoContent)
+	}
+}
+
+// mealRange reads the days from the from and to query parameters,
+// by default the current week from monday to sunday
+func mealRange(ctx echo.Context) (string, string, error) {
+	return dayRange(ctx.QueryParam("from"), ctx.QueryParam("to"))
+}
+
+// dayRange returns the days from and to, or the week from the first one or of today if they are empty
+func dayRange(fromDay, toDay string) (string, string, error) {
+	from, to := week(time.Now())
+	if fromDay != "" {
+		day, err := time.Parse(DayFormat, fromDay)
+		if err != nil {
+			return from, to, err
+		}
+		from, to = fromDay, day.AddDate(0, 0, 6).Format(DayFormat)
+	}
+	if toDay != "" {
+		if _, err := time.Parse(DayFormat, toDay); err != nil {
+			return from, to, err
+		}
+		to = toDay
+	}
+	return from, to, nil
+}
+
+// GET /meals lists the planned meals, of the current week or from and to the given days
+func showMeals(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		from, to, err := mealRange(ctx)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "from and to must be days like 2024-01-31")
+		}
+		meals, err := GetMeals(db, from, to)
+		if err != nil {
+			ctx.Logger().Infof("showMeals: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read meals")
+		}
+		return ctx.JSON(http.StatusOK, meals)
+	}
+}
+
+// POST /meals plans a recipe for a day
+func addMeal(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+
+		// bind body into struct
+		meal := &Meal{}
+		err := ctx.Bind(meal)
+		if err != nil {
+			ctx.Logger().Infof("addMeal: Bind Error with request %v: %v", ctx.Request().Body, err)
+			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+		}
+		if ok, errors := meal.Valid(); !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, strings.Join(errors, "; "))
+		}
+		recipe, err := GetRecipeByID(db, meal.RecipeUId)
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest, "No such recipe")
+		}
+		if err != nil {
+			ctx.Logger().Infof("addMeal: Database Error on get %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read recipe")
+		}
+
+		// do database operation
+		meal.ID = 0
+		meal.Recipe = recipe.Name
+		if err = AddMeal(db, meal); err != nil {
+			ctx.Logger().Infof("addMeal: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not plan meal")
+		}
+		return ctx.JSON(http.StatusCreated, meal)
+	}
+}
+
+// DELETE /meals/:id removes a meal from the plan
+func deleteMeal(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+		}
+		num, err := DeleteMealByID(db, id)
+		if err != nil {
+			ctx.Logger().Infof("deleteMeal: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not delete meal")
+		}
+		if num == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "No such meal")
+		}
+		return ctx.NoContent(http.StatusNoContent)
+	}
+}
+
+// POST /meals/shopping adds the ingredients of the meals planned in the current week,
+// or from and to the given days, to the list. Quantities are added up across the meals and
+// with open items of the same name and unit, unless dedupe is false, and every item is tagged
+// with the recipes that need it.
+// With preview set, the result is returned without changing anything.
+func shopMeals(db *sql.DB, notifier *Notifier) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+
+		// bind body into struct, the ingredients of the week are merged unless asked not to
+		input := &MealPlanShopping{Dedupe: true}
+		err := ctx.Bind(input)
+		if err != nil {
+			ctx.Logger().Infof("shopMeals: Bind Error with request %v: %v", ctx.Request().Body, err)
+			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+		}
+		// the days can be given in the body or as query parameters
+		if input.From == "" && input.To == "" {
+			input.From, input.To = ctx.QueryParam("from"), ctx.QueryParam("to")
+		}
+		from, to, err := dayRange(input.From, input.To)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "from and to must be days like 2024-01-31")
+		}
+
+		result := MealPlanShopping{From: from, To: to, Dedupe: input.Dedupe, Preview: input.Preview}
+		result.Meals, err = GetMeals(db, from, to)
+		if err != nil {
+			ctx.Logger().Infof("shopMeals: Database Error on get %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read meals")
+		}
+		ingredients, err := MealItems(db, result.Meals)
+		if err != nil {
+			ctx.Logger().Infof("shopMeals: Database Error on get %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read recipes")
+		}
+
+		if input.Preview || len(ingredients) == 0 {
+			orig, err := GetAllItems(db)
+			if err != nil {
+				ctx.Logger().Infof("shopMeals: Database Error on get %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Could not read items")
+			}
+			_, result.Items, result.Warnings = AddIngredients(orig.Items, ingredients, input.Dedupe)
+			return ctx.JSON(http.StatusOK, result)
+		}
+
+		// do database operation
+		items, _, err := UpdateItems(db, notifier, "meals/shopping", author(ctx), func(orig []Item) ([]Item, error) {
+			var merged []Item
+			merged, result.Items, result.Warnings = AddIngredients(orig, ingredients, input.Dedupe)
+			return merged, nil
+		})
+		if err != nil {
+			ctx.Logger().Infof("shopMeals: Database Error on update %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not add ingredients")
+		}
+		result.List = &items
+		return ctx.JSON(http.StatusOK, result)
+	}
+}
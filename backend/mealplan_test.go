@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// TestShopMealsMerges makes sure an ingredient shared by two meals of the week and already on the list
+// ends up as one item, unless the request asks not to merge
+func TestShopMealsMerges(t *testing.T) {
+	db := newTestDB(t)
+	if err := UpsertItem(db, &Item{UId: "i1", Title: "Milk", Status: StatusOpen, Quantity: 1, Unit: "l"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, recipe := range []Recipe{
+		{UId: "r1", Name: "Pancakes", Servings: 2, Ingredients: []Ingredient{{Title: "Milk", Quantity: 0.5, Unit: "l"}}},
+		{UId: "r2", Name: "Porridge", Servings: 2, Ingredients: []Ingredient{{Title: "Milk", Quantity: 0.25, Unit: "l"}}},
+	} {
+		recipe := recipe
+		if err := UpsertRecipe(db, &recipe); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, meal := range []Meal{{Day: "2024-01-29", RecipeUId: "r1"}, {Day: "2024-01-30", RecipeUId: "r2"}} {
+		meal := meal
+		if err := AddMeal(db, &meal); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e := echo.New()
+	e.POST("/meals/shopping", shopMeals(db, nil))
+	shop := func(body string) []Item {
+		t.Helper()
+		request := httptest.NewRequest(http.MethodPost, "/meals/shopping?from=2024-01-29", strings.NewReader(body))
+		request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		answer := httptest.NewRecorder()
+		e.ServeHTTP(answer, request)
+		if answer.Code != http.StatusOK {
+			t.Fatalf("answered %d: %s", answer.Code, answer.Body)
+		}
+		items, err := GetAllItems(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return items.Items
+	}
+
+	if items := shop("{}"); len(items) != 1 || items[0].Quantity != 1.75 || len(items[0].Recipes) != 2 {
+		t.Errorf("items are %+v", items)
+	}
+	if items := shop(`{"dedupe": false}`); len(items) != 2 || items[1].Quantity != 0.75 {
+		t.Errorf("items without merging are %+v", items)
+	}
+}
@@ -1,13 +1,22 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// item status codes
+const (
+	StatusOpen    = "OPEN"
+	StatusChecked = "CHECKED"
+)
+
 // AllowedStatusCodes for checking that statuses are always correct
-var AllowedStatusCodes = []string{"OPEN", "CHECKED"}
+var AllowedStatusCodes = []string{StatusOpen, StatusChecked}
 
 func isAllowedStatusCode(code string) bool {
 	for _, item := range AllowedStatusCodes {
@@ -20,11 +29,18 @@ func isAllowedStatusCode(code string) bool {
 
 // Item is our shopping list item
 type Item struct {
-	UId     string `json:"uid"`
-	Title   string `json:"title"`
-	Status  string `json:"status"`
-	Orderno int    `json:"orderno"`
-	Shop    *Shop  `json:"shop,omitempty"`
+	UId      string  `json:"uid"`
+	Title    string  `json:"title"`
+	Status   string  `json:"status"`
+	Orderno  int     `json:"orderno"`
+	Quantity float64 `json:"quantity,omitempty"`
+	Unit     string  `json:"unit,omitempty"`
+	Category string  `json:"category,omitempty"`
+	Shop     *Shop   `json:"shop,omitempty"`
+	// Recipes are the names of the recipes the item is needed for
+	Recipes []string `json:"recipes,omitempty"`
+	// Revision is increased by the database on every change of the item
+	Revision int64 `json:"-"`
 }
 
 // Valid tells you whether an item is valid
@@ -43,6 +59,14 @@ func (i *Item) Valid() (bool, []string) {
 	return true, errors
 }
 
+// Label is the title of an item prefixed with its quantity, as people write it on a list
+func (i *Item) Label() string {
+	if quantity := FormatQuantity(i.Quantity, i.Unit); quantity != "" {
+		return quantity + " " + i.Title
+	}
+	return i.Title
+}
+
 // ItemCollection is a collection of shopping list items
 type ItemCollection struct {
 	Version int64  `json:"version"`
@@ -67,6 +91,21 @@ type Shop struct {
 	Orderno int    `json:"orderno"`
 }
 
+// Valid tells you whether a shop is valid
+func (s *Shop) Valid() (bool, []string) {
+	var errors []string
+	if s.UId == "" {
+		errors = append(errors, "UId is missing")
+	}
+	if s.Name == "" {
+		errors = append(errors, "Name is missing")
+	}
+	if len(errors) > 0 {
+		return false, errors
+	}
+	return true, errors
+}
+
 // ShopCollection is a list of Shops
 type ShopCollection struct {
 	Version int64  `json:"version"`
@@ -78,7 +117,22 @@ func (s *ShopCollection) Valid() bool {
 	return s.Version <= time.Now().Unix()
 }
 
+// Versions holds the current versions of the item and shop lists
 type Versions struct {
 	ItemVersion int64
 	ShopVersion int64
 }
+
+// NewVersion returns a version number for changes made by the server itself.
+// Clients use the current time in milliseconds, so we do the same.
+func NewVersion() int64 {
+	return time.Now().UnixMilli()
+}
+
+// NewUID creates an id for items and shops created by the server,
+// in the same shape as the ids the clients create.
+func NewUID() string {
+	random := make([]byte, 6)
+	rand.Read(random)
+	return strconv.FormatInt(time.Now().UnixMilli(), 36) + hex.EncodeToString(random)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+)
+
+// listsMutex serializes all modifications of items and shops within this process,
+// so that two of them do not overwrite each other. Other processes sharing the
+// database are kept apart by the transactions.
+var listsMutex sync.Mutex
+
+// changeLists runs a modification of the lists in one transaction while holding listsMutex.
+// The changes are found by comparing the lists before and after, and recorded in the audit log
+// within the same transaction, under the given source and as a revert of revertOf if that is set.
+// After the commit they are sent to all listening clients as coming from the given author,
+// if a notifier is given. Returns the id of the changeset, 0 if nothing changed, and the changes.
+func changeLists(db *sql.DB, notifier *Notifier, source string, by Author, revertOf int64, modify func(tx *sql.Tx) error) (int64, []Change, error) {
+	listsMutex.Lock()
+	defer listsMutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	origShops, err := GetAllShops(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+	origItems, err := GetAllItems(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err = modify(tx); err != nil {
+		return 0, nil, err
+	}
+	shops, err := GetAllShops(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+	items, err := GetAllItems(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	changes, err := DiffShops(origShops.Shops, shops.Shops)
+	if err != nil {
+		return 0, nil, err
+	}
+	itemChanges, err := DiffItems(origItems.Items, items.Items)
+	if err != nil {
+		return 0, nil, err
+	}
+	changes = append(changes, itemChanges...)
+	id, err := RecordChangeset(tx, source, by.User, revertOf, changes)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+
+	PublishChanges(db, notifier, by, changes)
+	return id, changes, nil
+}
+
+// UpdateItems applies a modification to the complete item list with one version bump, see changeLists.
+// Returns the list after the modification and the changes that were applied.
+func UpdateItems(db *sql.DB, notifier *Notifier, source string, by Author, modify func([]Item) ([]Item, error)) (ItemCollection, []Change, error) {
+	var items ItemCollection
+	_, changes, err := changeLists(db, notifier, source, by, 0, func(tx *sql.Tx) error {
+		orig, err := GetAllItems(tx)
+		if err != nil {
+			return err
+		}
+		modified, err := modify(orig.Items)
+		if err != nil {
+			return err
+		}
+		if err = ReplaceItemList(tx, &ItemCollection{Version: NewVersion(), Items: modified}); err != nil {
+			return err
+		}
+		items, err = GetAllItems(tx)
+		return err
+	})
+	return items, changes, err
+}
+
+// UpdateShops applies a modification to the complete shop list with one version bump,
+// like UpdateItems does for items.
+// Returns the list after the modification and the changes that were applied.
+func UpdateShops(db *sql.DB, notifier *Notifier, source string, by Author, modify func([]Shop) ([]Shop, error)) (ShopCollection, []Change, error) {
+	var shops ShopCollection
+	_, changes, err := changeLists(db, notifier, source, by, 0, func(tx *sql.Tx) error {
+		orig, err := GetAllShops(tx)
+		if err != nil {
+			return err
+		}
+		modified, err := modify(orig.Shops)
+		if err != nil {
+			return err
+		}
+		if err = ReplaceShopList(tx, &ShopCollection{Version: NewVersion(), Shops: modified}); err != nil {
+			return err
+		}
+		shops, err = GetAllShops(tx)
+		return err
+	})
+	return shops, changes, err
+}
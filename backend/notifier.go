@@ -1,98 +1,350 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // AllowedCommands is an array with all possible commands
-var AllowedCommands = [1]string{"UPDATE"}
+var AllowedCommands = [2]string{"UPDATE", "PRESENCE"}
 
-// Notifier is used to send messages between the streaming handler and the regular handlers
+// what to do with receivers that do not keep up with the messages
+const (
+	// SlowResync drops the queued messages of a slow receiver and tells it to resync instead
+	SlowResync = "resync"
+	// SlowDisconnect drops a slow receiver, it reconnects and gets the missed messages replayed
+	SlowDisconnect = "disconnect"
+)
+
+// AllowedSlowPolicies for checking the slow consumer policy
+var AllowedSlowPolicies = []string{SlowResync, SlowDisconnect}
+
+// ErrTooManyReceivers is returned when the notifier has no room for another receiver
+var ErrTooManyReceivers = errors.New("too many receivers")
+
+// event topics receivers can subscribe to
+const (
+	TopicItems    = "items"
+	TopicShops    = "shops"
+	TopicPresence = "presence"
+)
+
+// AllowedTopics for checking subscriptions
+var AllowedTopics = []string{TopicItems, TopicShops, TopicPresence}
+
+// ListNone is the list of the items without a shop
+const ListNone = "none"
+
+// itemList returns the list an item is on
+func itemList(item *Item) string {
+	if item.Shop != nil && item.Shop.UId != "" {
+		return item.Shop.UId
+	}
+	return ListNone
+}
+
+// Message is an event as sent to the receivers, numbered in the order it was sent.
+// Topic and Lists tell which receivers want it, messages without topic go to everybody.
+type Message struct {
+	ID    uint64
+	Data  string
+	Topic string
+	Lists []string
+}
+
+// Subscription tells which messages a receiver wants, an empty one gets all of them
+type Subscription struct {
+	// Topics are the topics to get messages about, all if empty
+	Topics []string
+	// Lists are the uids of the shops whose lists to get messages about, all if empty.
+	// A list holds the items of one shop, ListNone the items without a shop.
+	Lists []string
+}
+
+// Wants tells whether a message is for the subscriber
+func (s Subscription) Wants(msg Message) bool {
+	if msg.Topic == "" {
+		return true
+	}
+	if len(s.Topics) > 0 && !contains(s.Topics, msg.Topic) {
+		return false
+	}
+	// messages about no list in particular go to every list
+	if len(s.Lists) == 0 || len(msg.Lists) == 0 {
+		return true
+	}
+	for _, list := range msg.Lists {
+		if contains(s.Lists, list) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, value string) bool {
+	for _, entry := range list {
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Receiver gets the messages of a notifier through its own queue
+type Receiver struct {
+	ID           int
+	Subscription Subscription
+	messages     chan Message
+	done         chan struct{}
+}
+
+// Messages returns the queue of the receiver
+func (r *Receiver) Messages() <-chan Message {
+	return r.messages
+}
+
+// Done is closed when the notifier dropped the receiver, because it was too slow
+func (r *Receiver) Done() <-chan struct{} {
+	return r.done
+}
+
+// NotifierConfig holds the settings of a notifier
+type NotifierConfig struct {
+	// Backlog is how many messages are kept for receivers that reconnect
+	Backlog int
+	// QueueSize is how many messages may wait for a receiver before it counts as slow
+	QueueSize int
+	// SlowPolicy is what to do with slow receivers, SlowResync or SlowDisconnect
+	SlowPolicy string
+	// MaxReceivers is how many receivers may listen at the same time, 0 for no limit
+	MaxReceivers int
+	// Broker passes the messages between the instances of the server, a MemoryBroker if nil
+	Broker Broker
+}
+
+// NotifierStats tells how busy a notifier is
+type NotifierStats struct {
+	Receivers    int `json:"receivers"`
+	MaxReceivers int `json:"max_receivers"`
+	// LastEventID is the id of the last message sent, empty if there was none yet
+	LastEventID string `json:"last_event_id,omitempty"`
+}
+
+// Notifier is used to send messages between the streaming handler and the regular handlers.
+// All its state is guarded by one mutex, messages are put into the queues of the receivers
+// without ever blocking the sender.
 type Notifier struct {
-	incoming  chan string
-	listeners map[int]chan string
+	mutex     sync.Mutex
+	config    NotifierConfig
+	receivers map[int]*Receiver
 	Commands  map[string]bool
-	maxSlots  int
-	pool      []int
+	nextID    int
+
+	// the clients listening on all instances, the instances they are connected to with
+	// when that was last heard of, and the connections of those on this one
+	presence    map[string]Presence
+	holders     map[string]map[string]time.Time
+	connections map[string]int
+
+	// the last messages, so that receivers that reconnect can get what they missed.
+	// Message ids start over with every start of the server and are counted by each instance
+	// on its own, boot tells the runs and instances apart.
+	boot    string
+	lastID  uint64
+	history []Message
 }
 
 // NewNotifier creates and returns a notifier
-func NewNotifier() *Notifier {
+func NewNotifier(config NotifierConfig) *Notifier {
+	if config.QueueSize < 1 {
+		config.QueueSize = 1
+	}
+	if config.Broker == nil {
+		config.Broker = NewMemoryBroker()
+	}
 	notifier := &Notifier{
-		incoming:  make(chan string),
-		Commands:  make(map[string]bool),
-		listeners: make(map[int]chan string),
-		maxSlots:  100,
+		config:      config,
+		Commands:    make(map[string]bool),
+		receivers:   make(map[int]*Receiver),
+		presence:    make(map[string]Presence),
+		holders:     make(map[string]map[string]time.Time),
+		connections: make(map[string]int),
+		boot:        NewUID(),
 	}
 	// create map with allowed commands
 	for _, item := range AllowedCommands {
 		notifier.Commands[item] = true
 	}
-	// initialize pool of available subscriber slots:
-	for i := 0; i < notifier.maxSlots; i++ {
-		notifier.pool = append(notifier.pool, i+1)
-	}
-	go notifier.Dispatcher()
+	config.Broker.Subscribe(notifier.dispatch)
 	return notifier
 }
 
-// Dispatcher waits on new messages on inocmimg channel and dispatches them to all listening clients
-func (n *Notifier) Dispatcher() {
-	for {
-		msg := <-n.incoming
-		for chanID := range n.listeners {
-			go n.sendToChannel(chanID, msg)
-		}
+// Send a command without details to all listening receivers
+func (n *Notifier) Send(msg string) error {
+	upper := strings.ToUpper(msg)
+	if _, ok := n.Commands[upper]; !ok {
+		return fmt.Errorf("Not a Valid Command: %s", msg)
 	}
+	return n.SendEvent(Event{Cmd: upper})
 }
 
-// go func to send notification to a given receiver
-// this will silently fail if the channel is closed
-func (n *Notifier) sendToChannel(chanID int, msg string) {
-	if channel, ok := n.listeners[chanID]; ok {
-		channel <- msg
+// SendEvent sends an event to all receivers subscribed to it, on all instances
+// of the server sharing the broker. They get it as JSON.
+func (n *Notifier) SendEvent(event Event) error {
+	if _, ok := n.Commands[event.Cmd]; !ok {
+		return fmt.Errorf("Not a Valid Command: %s", event.Cmd)
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
 	}
+	return n.config.Broker.Publish(Publication{Topic: event.Topic(), Lists: event.Lists(), Data: string(data)})
 }
 
-// Send a message to all listening receivers
-func (n *Notifier) Send(msg string) error {
-	upper := strings.ToUpper(msg)
-	if _, ok := n.Commands[upper]; !ok {
-		return fmt.Errorf("Not a Valid Command: %s", msg)
+// dispatch numbers a publication coming from the broker and queues it for the receivers
+func (n *Notifier) dispatch(publication Publication) {
+	// number and queue under the lock, so that messages arrive in the order of their ids
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if publication.Topic == TopicPresence && !n.updatePresence(publication.Data) {
+		return
+	}
+	n.lastID++
+	msg := Message{ID: n.lastID, Data: publication.Data, Topic: publication.Topic, Lists: publication.Lists}
+	n.history = append(n.history, msg)
+	if len(n.history) > n.config.Backlog {
+		n.history = n.history[len(n.history)-n.config.Backlog:]
+	}
+	for _, receiver := range n.receivers {
+		if receiver.Subscription.Wants(msg) {
+			n.deliver(receiver, msg)
+		}
+	}
+}
+
+// deliver puts a message into the queue of a receiver, without waiting.
+// If the queue is full, the slow consumer policy applies. Needs the lock.
+func (n *Notifier) deliver(receiver *Receiver, msg Message) {
+	select {
+	case receiver.messages <- msg:
+		return
+	default:
+	}
+
+	if n.config.SlowPolicy == SlowDisconnect {
+		n.removeReceiver(receiver)
+		return
+	}
+	// nothing in the queue matters anymore, the receiver reloads everything.
+	// The receiver may take messages meanwhile, so do not wait for them.
+	for drained := false; !drained; {
+		select {
+		case <-receiver.messages:
+		default:
+			drained = true
+		}
 	}
-	n.incoming <- upper
+	receiver.messages <- n.resyncMessage()
+}
 
-	return nil
+// EventID is the id of a message as sent to the clients. It is only known to the instance
+// that sent it: clients reconnecting to another instance behind the same broker resync, see Replay.
+func (n *Notifier) EventID(msg Message) string {
+	return fmt.Sprintf("%s-%d", n.boot, msg.ID)
 }
 
-// Listen for the next message from the notifier to a given receiver
-func (n *Notifier) Listen(chanID int) string {
-	cmd := ""
-	if channel, ok := n.listeners[chanID]; ok {
-		cmd = <-channel
+// Replay returns the messages sent after the message with the given event id.
+// If not all of them are known anymore, because the server was restarted in between,
+// the id is from another instance or the message log rolled over, ok is false: the receiver has to resync.
+func (n *Notifier) Replay(eventID string) ([]Message, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	dash := strings.LastIndex(eventID, "-")
+	if dash < 0 || eventID[:dash] != n.boot {
+		return nil, false
 	}
-	return cmd
+	id, err := strconv.ParseUint(eventID[dash+1:], 10, 64)
+	if err != nil || id > n.lastID {
+		return nil, false
+	}
+	// the message with the given id does not need to be in the log anymore, but all after it
+	first := n.lastID - uint64(len(n.history)) + 1
+	if id+1 < first {
+		return nil, false
+	}
+	missed := make([]Message, 0, n.lastID-id)
+	for _, msg := range n.history {
+		if msg.ID > id {
+			missed = append(missed, msg)
+		}
+	}
+	return missed, true
 }
 
-// NewReceiver creates a new Listening client and returns its id
-func (n *Notifier) NewReceiver() (int, error) {
-	if len(n.pool) == 0 {
-		return 0, fmt.Errorf("Can not accept more than %d connections at the same time", n.maxSlots)
+// Resync returns the message telling a receiver to reload everything,
+// it has the id of the last message sent, so that the receiver continues after it
+func (n *Notifier) Resync() Message {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.resyncMessage()
+}
+
+func (n *Notifier) resyncMessage() Message {
+	// UPDATE makes clients that do not know about resync reload as well
+	data, _ := json.Marshal(Event{Cmd: "UPDATE", Type: EventResync})
+	return Message{ID: n.lastID, Data: string(data)}
+}
+
+// NewReceiver creates a new Listening client, that gets the messages it subscribed to.
+// Returns ErrTooManyReceivers if the maximum number of receivers is reached.
+func (n *Notifier) NewReceiver(subscription Subscription) (*Receiver, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.config.MaxReceivers > 0 && len(n.receivers) >= n.config.MaxReceivers {
+		return nil, fmt.Errorf("%w: can not accept more than %d at the same time", ErrTooManyReceivers, n.config.MaxReceivers)
 	}
 
-	channel := make(chan string)
+	n.nextID++
+	receiver := &Receiver{
+		ID:           n.nextID,
+		Subscription: subscription,
+		messages:     make(chan Message, n.config.QueueSize),
+		done:         make(chan struct{}),
+	}
+	n.receivers[receiver.ID] = receiver
+	return receiver, nil
+}
 
-	// get id from pool:
-	var chanID int
-	chanID, n.pool = n.pool[0], n.pool[1:]
+// Stats returns the current number of receivers and the limit
+func (n *Notifier) Stats() NotifierStats {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	stats := NotifierStats{Receivers: len(n.receivers), MaxReceivers: n.config.MaxReceivers}
+	if n.lastID > 0 {
+		stats.LastEventID = n.EventID(Message{ID: n.lastID})
+	}
+	return stats
+}
 
-	n.listeners[chanID] = channel
-	return chanID, nil
+// RemoveReceiver deletes a given client, so that it makes room for another one.
+// Removing a receiver that is already gone does nothing.
+func (n *Notifier) RemoveReceiver(receiver *Receiver) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.removeReceiver(receiver)
 }
 
-// RemoveReceiver deletes a given client and returns the id back to the pool of open slots
-func (n *Notifier) RemoveReceiver(chanID int) {
-	delete(n.listeners, chanID)
-	n.pool = append(n.pool, chanID)
+func (n *Notifier) removeReceiver(receiver *Receiver) {
+	if n.receivers[receiver.ID] != receiver {
+		return
+	}
+	delete(n.receivers, receiver.ID)
+	close(receiver.done)
 }
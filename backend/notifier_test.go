@@ -0,0 +1,170 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForGoroutines fails the test if the number of goroutines does not go back to what it was before
+func waitForGoroutines(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestNotifierConcurrent adds and removes receivers while messages are sent, run it with -race.
+// Some receivers read their messages, others never do and have to be dropped as slow.
+func TestNotifierConcurrent(t *testing.T) {
+	for _, policy := range AllowedSlowPolicies {
+		t.Run(policy, func(t *testing.T) {
+			before := runtime.NumGoroutine()
+			notifier := NewNotifier(NotifierConfig{Backlog: 16, QueueSize: 4, SlowPolicy: policy})
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				reading := i%2 == 0
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						receiver, err := notifier.NewReceiver(Subscription{})
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						timeout := time.After(5 * time.Millisecond)
+					receive:
+						for {
+							select {
+							case <-receiver.Messages():
+								if !reading {
+									time.Sleep(time.Millisecond)
+								}
+							case <-receiver.Done():
+								break receive
+							case <-timeout:
+								break receive
+							case <-stop:
+								break receive
+							}
+						}
+						notifier.RemoveReceiver(receiver)
+					}
+				}()
+			}
+			var senders sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				senders.Add(1)
+				go func() {
+					defer senders.Done()
+					for j := 0; j < 200; j++ {
+						if err := notifier.Send("UPDATE"); err != nil {
+							t.Error(err)
+						}
+						notifier.Stats()
+					}
+				}()
+			}
+			senders.Wait()
+			close(stop)
+			wg.Wait()
+
+			if stats := notifier.Stats(); stats.Receivers != 0 || stats.LastEventID != notifier.EventID(Message{ID: 800}) {
+				t.Errorf("after all receivers left: %+v", stats)
+			}
+			waitForGoroutines(t, before)
+		})
+	}
+}
+
+func TestNotifierSlowResync(t *testing.T) {
+	notifier := NewNotifier(NotifierConfig{Backlog: 16, QueueSize: 2, SlowPolicy: SlowResync})
+	slow, _ := notifier.NewReceiver(Subscription{})
+	fast, _ := notifier.NewReceiver(Subscription{})
+
+	for i := 1; i <= 5; i++ {
+		notifier.Send("UPDATE")
+		if msg := <-fast.Messages(); msg.ID != uint64(i) {
+			t.Errorf("fast receiver got message %d instead of %d", msg.ID, i)
+		}
+	}
+
+	// the queue ran over twice, only the last resync is left
+	if len(slow.Messages()) != 1 {
+		t.Fatalf("slow receiver has %d messages queued instead of the resync", len(slow.Messages()))
+	}
+	msg := <-slow.Messages()
+	if msg.ID != 5 || !strings.Contains(msg.Data, `"type":"`+EventResync+`"`) {
+		t.Errorf("slow receiver got %+v instead of a resync", msg)
+	}
+	select {
+	case <-slow.Done():
+		t.Error("slow receiver was dropped")
+	default:
+	}
+	if stats := notifier.Stats(); stats.Receivers != 2 {
+		t.Errorf("%d receivers instead of 2", stats.Receivers)
+	}
+}
+
+func TestNotifierSlowDisconnect(t *testing.T) {
+	notifier := NewNotifier(NotifierConfig{Backlog: 16, QueueSize: 2, SlowPolicy: SlowDisconnect})
+	slow, _ := notifier.NewReceiver(Subscription{})
+	fast, _ := notifier.NewReceiver(Subscription{})
+
+	for i := 1; i <= 3; i++ {
+		notifier.Send("UPDATE")
+		<-fast.Messages()
+	}
+
+	select {
+	case <-slow.Done():
+	default:
+		t.Fatal("slow receiver was not dropped")
+	}
+	if stats := notifier.Stats(); stats.Receivers != 1 {
+		t.Errorf("%d receivers instead of 1", stats.Receivers)
+	}
+	// removing it again, as the handler does when it sees Done, does nothing
+	notifier.RemoveReceiver(slow)
+
+	// it reconnects with the id of the last message it got and gets the rest
+	var last Message
+	for len(slow.Messages()) > 0 {
+		last = <-slow.Messages()
+	}
+	missed, ok := notifier.Replay(notifier.EventID(last))
+	if !ok || len(missed) != 1 || missed[0].ID != 3 {
+		t.Errorf("replay after %d: %v %+v", last.ID, ok, missed)
+	}
+}
+
+func TestNotifierMaxReceivers(t *testing.T) {
+	notifier := NewNotifier(NotifierConfig{QueueSize: 1, MaxReceivers: 1})
+	first, err := notifier.NewReceiver(Subscription{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = notifier.NewReceiver(Subscription{}); err == nil {
+		t.Error("second receiver was accepted")
+	}
+	notifier.RemoveReceiver(first)
+	if _, err = notifier.NewReceiver(Subscription{}); err != nil {
+		t.Errorf("no room after removing a receiver: %v", err)
+	}
+}
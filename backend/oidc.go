@@ -0,0 +1,458 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Users can log in with an OpenID Connect provider, using the authorization code flow with PKCE.
+// Identities of the provider are mapped to local users by their verified email address.
+
+// CookieOIDC keeps state, nonce and code verifier of a login while the browser is at the provider
+const CookieOIDC = "oidc_login"
+
+// ErrNotAllowed is returned when an identity does not match the rules for logging in
+var ErrNotAllowed = errors.New("not allowed to log in")
+
+// OIDCConfig holds the settings of the login with an OpenID Connect provider
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends the browser back to, empty derives it from the request
+	RedirectURL string
+	// AllowedEmails are addresses, or domains starting with @
+	AllowedEmails []string
+	AllowedGroups []string
+	// GroupsClaim is the claim of the ID token that holds the groups
+	GroupsClaim string
+	// Scopes are requested from the provider, empty requests openid, email, profile
+	// and groups if there are AllowedGroups
+	Scopes []string
+	// Role is what users created on their first login become in the household,
+	// empty leaves inviting them to the owners
+	Role string
+}
+
+// Identity is who the provider says logged in
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Groups        []string
+}
+
+// Allows tells whether an identity matches one of the rules for logging in
+func (c *OIDCConfig) Allows(identity Identity) bool {
+	if identity.EmailVerified {
+		email := strings.ToLower(identity.Email)
+		for _, allowed := range c.AllowedEmails {
+			allowed = strings.ToLower(allowed)
+			if email == allowed || (strings.HasPrefix(allowed, "@") && strings.HasSuffix(email, allowed)) {
+				return true
+			}
+		}
+	}
+	for _, group := range identity.Groups {
+		if contains(c.AllowedGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// scope returns the scopes to request from the provider, openid is always among them
+func (c *OIDCConfig) scope() string {
+	scopes := c.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+		if len(c.AllowedGroups) > 0 {
+			scopes = append(scopes, "groups")
+		}
+	}
+	if !contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	return strings.Join(scopes, " ")
+}
+
+// oidcDiscovery is the part of the provider configuration we need
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCProvider talks to the identity provider. Its configuration and keys are loaded when first needed,
+// so that the server starts even if the provider is down.
+type OIDCProvider struct {
+	Config     OIDCConfig
+	client     *http.Client
+	mutex      sync.Mutex
+	discovery  *oidcDiscovery
+	keys       map[string]*rsa.PublicKey
+	keysLoaded time.Time
+}
+
+// NewOIDCProvider creates a provider for the given settings
+func NewOIDCProvider(config OIDCConfig) *OIDCProvider {
+	return &OIDCProvider{
+		Config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// getJSON loads a JSON document from the provider
+func (p *OIDCProvider) getJSON(url string, target interface{}) error {
+	response, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", url, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(target)
+}
+
+// endpoints returns the configuration of the provider, loading it on first use
+func (p *OIDCProvider) endpoints() (oidcDiscovery, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.discovery != nil {
+		return *p.discovery, nil
+	}
+	discovery := oidcDiscovery{}
+	err := p.getJSON(strings.TrimSuffix(p.Config.Issuer, "/")+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return discovery, err
+	}
+	if discovery.Issuer != p.Config.Issuer {
+		return discovery, fmt.Errorf("provider calls itself %s instead of %s", discovery.Issuer, p.Config.Issuer)
+	}
+	p.discovery = &discovery
+	return discovery, nil
+}
+
+// key returns the public key the provider signs with. Unknown keys reload the keys,
+// providers rotate them, but not more than once a minute.
+func (p *OIDCProvider) key(id string) (*rsa.PublicKey, error) {
+	discovery, err := p.endpoints()
+	if err != nil {
+		return nil, err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if key, ok := p.keys[id]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysLoaded) < time.Minute {
+		return nil, fmt.Errorf("unknown key %s", id)
+	}
+
+	var set struct {
+		Keys []struct {
+			ID  string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err = p.getJSON(discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]*rsa.PublicKey)
+	p.keysLoaded = time.Now()
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			continue
+		}
+		p.keys[jwk.ID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if key, ok := p.keys[id]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %s", id)
+}
+
+// AuthURL is where the browser logs in at the provider
+func (p *OIDCProvider) AuthURL(redirect, state, nonce, verifier string) (string, error) {
+	discovery, err := p.endpoints()
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.Config.ClientID},
+		"redirect_uri":          {redirect},
+		"scope":                 {p.Config.scope()},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange trades the code the browser brought back for the ID token
+func (p *OIDCProvider) Exchange(redirect, code, verifier string) (string, error) {
+	discovery, err := p.endpoints()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirect},
+		"client_id":     {p.Config.ClientID},
+		"code_verifier": {verifier},
+	}
+	if p.Config.ClientSecret != "" {
+		form.Set("client_secret", p.Config.ClientSecret)
+	}
+	response, err := p.client.PostForm(discovery.TokenEndpoint, form)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint answered %s", response.Status)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("token endpoint sent no ID token")
+	}
+	return tokens.IDToken, nil
+}
+
+// Verify checks signature, issuer, audience, expiry and nonce of an ID token and returns who logged in
+func (p *OIDCProvider) Verify(idToken, nonce string) (Identity, error) {
+	identity := Identity{}
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		id, _ := token.Header["kid"].(string)
+		return p.key(id)
+	}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithIssuer(p.Config.Issuer), jwt.WithAudience(p.Config.ClientID),
+		jwt.WithExpirationRequired())
+	if err != nil {
+		return identity, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return identity, errors.New("ID token has no claims")
+	}
+	if claimed, _ := claims["nonce"].(string); claimed != nonce {
+		return identity, errors.New("ID token has the wrong nonce")
+	}
+
+	identity.Subject, _ = claims["sub"].(string)
+	if identity.Subject == "" {
+		return identity, errors.New("ID token has no subject")
+	}
+	identity.Email, _ = claims["email"].(string)
+	// some providers send it as string
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	}
+	switch groups := claims[p.Config.GroupsClaim].(type) {
+	case string:
+		identity.Groups = []string{groups}
+	case []interface{}:
+		for _, group := range groups {
+			if name, ok := group.(string); ok {
+				identity.Groups = append(identity.Groups, name)
+			}
+		}
+	}
+	return identity, nil
+}
+
+// redirectURL returns where the provider sends the browser back to
+func (p *OIDCProvider) redirectURL(ctx echo.Context) string {
+	if p.Config.RedirectURL != "" {
+		return p.Config.RedirectURL
+	}
+	return fmt.Sprintf("%s://%s/oidc/callback", ctx.Scheme(), ctx.Request().Host)
+}
+
+// ********************************** //
+//     database access functions:     //
+// ********************************** //
+
+// GetUserByIdentity loads the user an identity is linked to, returns sql.ErrNoRows if there is none
+func GetUserByIdentity(db *sql.DB, issuer, subject string) (User, error) {
+	user := User{}
+	sql := `SELECT users.id, users.name, users.admin, users.created_at, users.password_hash
+		FROM identities JOIN users ON users.id = identities.user_id WHERE identities.issuer = ? AND identities.subject = ?`
+	err := db.QueryRow(sql, issuer, subject).Scan(&user.ID, &user.Name, &user.Admin, &user.CreatedAt, &user.hash)
+	return user, err
+}
+
+// LinkIdentity remembers which user an identity belongs to
+func LinkIdentity(db *sql.DB, issuer string, identity Identity, userID int64) error {
+	_, err := db.Exec("INSERT INTO identities(issuer, subject, user_id, email, created_at) VALUES(?, ?, ?, ?, ?)",
+		issuer, identity.Subject, userID, identity.Email, time.Now().Unix())
+	return err
+}
+
+// IdentityUser returns the user of an identity that is allowed to log in. Identities seen for the first time
+// are linked to the user named like their verified email address, which is created if there is none.
+// Only users created by a login with the provider are linked, users with a password are not.
+func IdentityUser(db *sql.DB, config OIDCConfig, identity Identity) (User, error) {
+	if !config.Allows(identity) {
+		return User{}, ErrNotAllowed
+	}
+	user, err := GetUserByIdentity(db, config.Issuer, identity.Subject)
+	if err != sql.ErrNoRows {
+		return user, err
+	}
+
+	name := strings.ToLower(identity.Email)
+	if !identity.EmailVerified || !userName.MatchString(name) {
+		return user, fmt.Errorf("%w: needs a verified email address that can be a user name", ErrNotAllowed)
+	}
+	user, err = GetUserByName(db, name)
+	if err == sql.ErrNoRows {
+		// nobody knows the password, these users log in with the provider only
+		user, err = CreateUser(db, name, newToken(), false)
+		if err != nil {
+			return user, err
+		}
+		if _, err = db.Exec("UPDATE users SET oidc = 1 WHERE id = ?", user.ID); err != nil {
+			return user, err
+		}
+		if _, err = GetMember(db, name); err == sql.ErrNoRows && config.Role != "" {
+			_, err = SetMember(db, name, config.Role)
+		}
+	} else if err == nil {
+		// whoever has the address at the provider must not take over a user that logs in with a password
+		var oidc bool
+		if err = db.QueryRow("SELECT oidc FROM users WHERE id = ?", user.ID).Scan(&oidc); err == nil && !oidc {
+			return User{}, fmt.Errorf("%w: %s is a user with a password", ErrNotAllowed, name)
+		}
+	}
+	if err != nil {
+		return user, err
+	}
+	return user, LinkIdentity(db, config.Issuer, identity, user.ID)
+}
+
+// ********************************** //
+//             handlers:              //
+// ********************************** //
+
+// LoginOptions tells the frontend how users can log in
+type LoginOptions struct {
+	OIDC bool `json:"oidc"`
+}
+
+// GET /login shows how users can log in
+func showLoginOptions(provider *OIDCProvider) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		return ctx.JSON(http.StatusOK, LoginOptions{OIDC: provider != nil})
+	}
+}
+
+// GET /oidc/login sends the browser to the provider
+func oidcLogin(provider *OIDCProvider, config SessionConfig) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		state, nonce, verifier := newToken(), newToken(), newToken()
+		target, err := provider.AuthURL(provider.redirectURL(ctx), state, nonce, verifier)
+		if err != nil {
+			ctx.Logger().Errorf("oidcLogin: Provider Error %v", err)
+			return echo.NewHTTPError(http.StatusBadGateway, "Could not reach the identity provider")
+		}
+		// the provider sends the browser back from another site, strict cookies would not come along
+		ctx.SetCookie(&http.Cookie{
+			Name: CookieOIDC, Value: strings.Join([]string{state, nonce, verifier}, "."), Path: "/oidc", MaxAge: 600,
+			HttpOnly: true, Secure: config.Secure, SameSite: http.SameSiteLaxMode,
+		})
+		return ctx.Redirect(http.StatusFound, target)
+	}
+}
+
+// GET /oidc/callback is where the provider sends the browser back to, it starts a session
+func oidcCallback(db *sql.DB, provider *OIDCProvider, config SessionConfig) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		cookie, err := ctx.Cookie(CookieOIDC)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Login took too long or was not started here")
+		}
+		ctx.SetCookie(&http.Cookie{Name: CookieOIDC, Path: "/oidc", MaxAge: -1, HttpOnly: true, Secure: config.Secure})
+		login := strings.Split(cookie.Value, ".")
+		if len(login) != 3 || ctx.QueryParam("state") != login[0] {
+			return echo.NewHTTPError(http.StatusBadRequest, "Login does not match")
+		}
+		if message := ctx.QueryParam("error"); message != "" {
+			ctx.Logger().Warnf("oidcCallback: Provider refused login: %s %s", message, ctx.QueryParam("error_description"))
+			return echo.NewHTTPError(http.StatusUnauthorized, "The identity provider refused the login")
+		}
+
+		idToken, err := provider.Exchange(provider.redirectURL(ctx), ctx.QueryParam("code"), login[2])
+		if err != nil {
+			ctx.Logger().Errorf("oidcCallback: Provider Error %v", err)
+			return echo.NewHTTPError(http.StatusBadGateway, "Could not get the login from the identity provider")
+		}
+		identity, err := provider.Verify(idToken, login[1])
+		if err != nil {
+			ctx.Logger().Warnf("oidcCallback: Invalid ID token %v", err)
+			return echo.NewHTTPError(http.StatusUnauthorized, "The login of the identity provider is invalid")
+		}
+		user, err := IdentityUser(db, provider.Config, identity)
+		if errors.Is(err, ErrNotAllowed) {
+			ctx.Logger().Warnf("oidcCallback: %s (%s) %v", identity.Subject, identity.Email, err)
+			return echo.NewHTTPError(http.StatusForbidden, "You are not allowed to log in here")
+		}
+		if err != nil {
+			ctx.Logger().Infof("oidcCallback: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not log in")
+		}
+
+		if err = PurgeSessions(db); err != nil {
+			ctx.Logger().Errorf("oidcCallback: Could not purge sessions %v", err)
+		}
+		session, token, err := CreateSession(db, user, ctx.Request().UserAgent(), config.Lifetime)
+		if err != nil {
+			ctx.Logger().Infof("oidcCallback: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not log in")
+		}
+		setSessionCookies(ctx, config, token, session.csrf)
+		return ctx.Redirect(http.StatusFound, "/")
+	}
+}
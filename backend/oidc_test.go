@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// mockIssuer is an OpenID Connect provider with discovery, keys and token endpoint.
+// The token endpoint signs whatever claims the test sets, it fills in the nonce of the last login.
+type mockIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	mutex  sync.Mutex
+	// claims of the next ID token and the key id it is signed with
+	claims jwt.MapClaims
+	kid    string
+	// what the last login at the authorization endpoint asked for
+	nonce     string
+	challenge string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &mockIssuer{key: key, kid: "k1"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                issuer.server.URL,
+			AuthorizationEndpoint: issuer.server.URL + "/authorize",
+			TokenEndpoint:         issuer.server.URL + "/token",
+			JWKSURI:               issuer.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "k1", "kty": "RSA", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mutex.Lock()
+		defer issuer.mutex.Unlock()
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("code") != "code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != issuer.challenge {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		claims := jwt.MapClaims{"nonce": issuer.nonce}
+		for name, value := range issuer.claims {
+			claims[name] = value
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = issuer.kid
+		signed, err := token.SignedString(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signed})
+	})
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+// validClaims are those of an ID token the provider accepts, for the given email address
+func (m *mockIssuer) validClaims(email string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            m.server.URL,
+		"aud":            "shop",
+		"sub":            "sub-" + email,
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"email":          email,
+		"email_verified": true,
+	}
+}
+
+// oidcLoginFlow runs a login with the given claims and returns the answer of the callback.
+// change can modify the callback request before it is sent.
+func oidcLoginFlow(t *testing.T, e *echo.Echo, issuer *mockIssuer, claims jwt.MapClaims, change func(*http.Request)) *httptest.ResponseRecorder {
+	login := httptest.NewRecorder()
+	e.ServeHTTP(login, httptest.NewRequest(http.MethodGet, "/oidc/login", nil))
+	if login.Code != http.StatusFound {
+		t.Fatalf("login answered %d: %s", login.Code, login.Body)
+	}
+	target, err := url.Parse(login.Header().Get(echo.HeaderLocation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := target.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != "shop" {
+		t.Fatalf("login sent the browser to %s", target)
+	}
+
+	issuer.mutex.Lock()
+	issuer.claims, issuer.nonce, issuer.challenge = claims, query.Get("nonce"), query.Get("code_challenge")
+	issuer.mutex.Unlock()
+
+	request := httptest.NewRequest(http.MethodGet, "/oidc/callback?code=code&state="+url.QueryEscape(query.Get("state")), nil)
+	for _, cookie := range login.Result().Cookies() {
+		request.AddCookie(cookie)
+	}
+	if change != nil {
+		change(request)
+	}
+	callback := httptest.NewRecorder()
+	e.ServeHTTP(callback, request)
+	return callback
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+	db := newTestDB(t)
+	provider := NewOIDCProvider(OIDCConfig{
+		Issuer:        issuer.server.URL,
+		ClientID:      "shop",
+		AllowedEmails: []string{"@example.com"},
+		AllowedGroups: []string{"shoppers"},
+		GroupsClaim:   "groups",
+		Role:          RoleEditor,
+	})
+	// a user with a password is not linked to whoever has its address at the provider
+	if _, err := CreateUser(db, "admin@example.com", "secret123", true); err != nil {
+		t.Fatal(err)
+	}
+	config := SessionConfig{Lifetime: time.Hour}
+	e := echo.New()
+	e.GET("/oidc/login", oidcLogin(provider, config))
+	e.GET("/oidc/callback", oidcCallback(db, provider, config))
+
+	with := func(claims jwt.MapClaims, name string, value interface{}) jwt.MapClaims {
+		claims[name] = value
+		return claims
+	}
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		change func(*http.Request)
+		kid    string
+		status int
+	}{
+		{name: "allowed email", claims: issuer.validClaims("alice@example.com"), status: http.StatusFound},
+		{name: "allowed group", claims: with(issuer.validClaims("bob@other.org"), "groups", []string{"shoppers"}), status: http.StatusFound},
+		{name: "bad state", claims: issuer.validClaims("alice@example.com"), status: http.StatusBadRequest,
+			change: func(r *http.Request) { r.URL.RawQuery = "code=code&state=forged" }},
+		{name: "no login cookie", claims: issuer.validClaims("alice@example.com"), status: http.StatusBadRequest,
+			change: func(r *http.Request) { r.Header.Del("Cookie") }},
+		{name: "wrong nonce", claims: with(issuer.validClaims("alice@example.com"), "nonce", "other"), status: http.StatusUnauthorized},
+		{name: "wrong audience", claims: with(issuer.validClaims("alice@example.com"), "aud", "other"), status: http.StatusUnauthorized},
+		{name: "wrong issuer", claims: with(issuer.validClaims("alice@example.com"), "iss", "https://evil.example.com"), status: http.StatusUnauthorized},
+		{name: "expired", claims: with(issuer.validClaims("alice@example.com"), "exp", time.Now().Add(-time.Minute).Unix()), status: http.StatusUnauthorized},
+		{name: "unknown key", claims: issuer.validClaims("alice@example.com"), kid: "k2", status: http.StatusUnauthorized},
+		{name: "email not allowed", claims: issuer.validClaims("mallory@other.org"), status: http.StatusForbidden},
+		{name: "email not verified", claims: with(issuer.validClaims("carol@example.com"), "email_verified", false), status: http.StatusForbidden},
+		{name: "user with password", claims: issuer.validClaims("admin@example.com"), status: http.StatusForbidden},
+		{name: "other group", claims: with(issuer.validClaims("dave@other.org"), "groups", []string{"guests"}), status: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			issuer.mutex.Lock()
+			issuer.kid = test.kid
+			if issuer.kid == "" {
+				issuer.kid = "k1"
+			}
+			issuer.mutex.Unlock()
+			answer := oidcLoginFlow(t, e, issuer, test.claims, test.change)
+			if answer.Code != test.status {
+				t.Fatalf("callback answered %d instead of %d: %s", answer.Code, test.status, answer.Body)
+			}
+			session := false
+			for _, cookie := range answer.Result().Cookies() {
+				session = session || (cookie.Name == CookieSession && cookie.Value != "")
+			}
+			if session != (test.status == http.StatusFound) {
+				t.Errorf("session cookie set: %v", session)
+			}
+		})
+	}
+
+	user, err := GetUserByIdentity(db, issuer.server.URL, "sub-alice@example.com")
+	if err != nil || user.Name != "alice@example.com" {
+		t.Errorf("identity is linked to %q: %v", user.Name, err)
+	}
+	// the first member of the household is always its owner
+	if member, err := GetMember(db, "bob@other.org"); err != nil || member.Role != RoleEditor {
+		t.Errorf("new user joined as %q: %v", member.Role, err)
+	}
+	if _, err := GetUserByIdentity(db, issuer.server.URL, "sub-admin@example.com"); err != sql.ErrNoRows {
+		t.Errorf("identity is linked to the user with a password: %v", err)
+	}
+	if _, err := GetUserByName(db, "mallory@other.org"); err != sql.ErrNoRows {
+		t.Errorf("user that is not allowed was created: %v", err)
+	}
+}
+
+func TestOIDCScope(t *testing.T) {
+	tests := []struct {
+		config OIDCConfig
+		scope  string
+	}{
+		{OIDCConfig{}, "openid email profile"},
+		{OIDCConfig{AllowedGroups: []string{"shoppers"}}, "openid email profile groups"},
+		{OIDCConfig{AllowedGroups: []string{"shoppers"}, Scopes: []string{"email", "roles"}}, "openid email roles"},
+		{OIDCConfig{Scopes: []string{"email", "openid"}}, "email openid"},
+	}
+	for _, test := range tests {
+		if scope := test.config.scope(); scope != test.scope {
+			t.Errorf("%+v requests %q instead of %q", test.config, scope, test.scope)
+		}
+	}
+
+	issuer := newMockIssuer(t)
+	provider := NewOIDCProvider(OIDCConfig{Issuer: issuer.server.URL, ClientID: "shop", AllowedGroups: []string{"shoppers"}})
+	target, err := provider.AuthURL("http://localhost/oidc/callback", "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(target, "scope=openid+email+profile+groups") {
+		t.Errorf("login asks for %s", target)
+	}
+}
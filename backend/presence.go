@@ -0,0 +1,313 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+// presence event types
+const (
+	EventPresenceJoined  = "presence.joined"
+	EventPresenceUpdated = "presence.updated"
+	EventPresenceLeft    = "presence.left"
+	// EventPresenceAlive tells the other instances which clients are still connected,
+	// it is not sent to the receivers
+	EventPresenceAlive = "presence.alive"
+)
+
+// how often instances tell each other about their clients, and after how many missed
+// heartbeats the clients of an instance count as gone, e.g. because it died
+const (
+	presenceInterval = 30 * time.Second
+	presenceTTL      = 3 * presenceInterval
+)
+
+// ErrNotPresent is returned for clients that do not listen to events
+var ErrNotPresent = errors.New("client is not connected")
+
+// ErrClientTaken is returned when a client id is used by another user than the one it joined as
+var ErrClientTaken = errors.New("client belongs to another user")
+
+// Presence is a client listening to events, and where it is shopping if it said so
+type Presence struct {
+	Client string `json:"client"`
+	// Name is what the client calls itself, e.g. the device
+	Name string `json:"name,omitempty"`
+	// User is who logged in with the client, share:NAME for share links
+	User string `json:"user,omitempty"`
+	// Since is when the client connected, in milliseconds
+	Since int64 `json:"since"`
+	// Shop is where the client is shopping right now, nil when not shopping
+	Shop          *Shop `json:"shop,omitempty"`
+	ShoppingSince int64 `json:"shopping_since,omitempty"`
+}
+
+// PresenceRequest is what a client sends to tell where it is shopping,
+// the uid of the shop or nothing when it left the store
+type PresenceRequest struct {
+	Shop string `json:"shop"`
+}
+
+// Join announces a client of a user that started listening to events.
+// A client can listen more than once, the others only learn about the first time.
+// Returns ErrClientTaken if the client is present as another user.
+func (n *Notifier) Join(client, name, user string) error {
+	n.mutex.Lock()
+	if presence, ok := n.presence[client]; ok && presence.User != user {
+		n.mutex.Unlock()
+		return fmt.Errorf("%w: %s", ErrClientTaken, client)
+	}
+	n.connections[client]++
+	first := n.connections[client] == 1
+	n.mutex.Unlock()
+	if !first {
+		return nil
+	}
+	presence := Presence{Client: client, Name: name, User: user, Since: time.Now().UnixMilli()}
+	return n.SendEvent(Event{Cmd: "PRESENCE", Type: EventPresenceJoined, Client: client, Presence: &presence, Instance: n.boot})
+}
+
+// Leave announces a client that stopped listening, once it has no connection left on this instance.
+// The receivers only learn about it when no other instance holds a connection of the client.
+func (n *Notifier) Leave(client string) error {
+	n.mutex.Lock()
+	n.connections[client]--
+	if n.connections[client] > 0 {
+		n.mutex.Unlock()
+		return nil
+	}
+	delete(n.connections, client)
+	presence, ok := n.presence[client]
+	n.mutex.Unlock()
+	if !ok {
+		presence = Presence{Client: client}
+	}
+	return n.SendEvent(Event{Cmd: "PRESENCE", Type: EventPresenceLeft, Client: client, Presence: &presence, Instance: n.boot})
+}
+
+// SetShopping tells the others where a client of a user is shopping, nil when it left the store.
+// Returns ErrClientTaken if the client is present as another user.
+func (n *Notifier) SetShopping(client, user string, shop *Shop) (Presence, error) {
+	n.mutex.Lock()
+	presence, ok := n.presence[client]
+	n.mutex.Unlock()
+	if !ok {
+		return presence, fmt.Errorf("%w: %s", ErrNotPresent, client)
+	}
+	if presence.User != user {
+		return Presence{}, fmt.Errorf("%w: %s", ErrClientTaken, client)
+	}
+	presence.Shop = shop
+	presence.ShoppingSince = 0
+	if shop != nil {
+		presence.ShoppingSince = time.Now().UnixMilli()
+	}
+	err := n.SendEvent(Event{Cmd: "PRESENCE", Type: EventPresenceUpdated, Client: client, Presence: &presence, Instance: n.boot})
+	return presence, err
+}
+
+// Presence returns the clients listening to events on all instances, in the order they connected
+func (n *Notifier) Presence() []Presence {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	result := make([]Presence, 0, len(n.presence))
+	for _, presence := range n.presence {
+		result = append(result, presence)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Since != result[j].Since {
+			return result[i].Since < result[j].Since
+		}
+		return result[i].Client < result[j].Client
+	})
+	return result
+}
+
+// PresenceHeartbeat tells the other instances which clients are still connected to this one.
+// Other instances that were not heard of for ttl no longer hold their clients, and the receivers
+// of this instance learn that the clients left that are not connected anywhere else.
+func (n *Notifier) PresenceHeartbeat(ttl time.Duration) error {
+	n.mutex.Lock()
+	clients := make([]string, 0, len(n.connections))
+	for client := range n.connections {
+		clients = append(clients, client)
+	}
+	var gone []Presence
+	for client, instances := range n.holders {
+		for instance, seen := range instances {
+			if instance != n.boot && time.Since(seen) >= ttl {
+				delete(instances, instance)
+			}
+		}
+		if len(instances) == 0 {
+			gone = append(gone, n.presence[client])
+			delete(n.presence, client)
+			delete(n.holders, client)
+		}
+	}
+	n.mutex.Unlock()
+
+	// every instance notices this by itself, so it does not go through the broker
+	for i := range gone {
+		data, err := json.Marshal(Event{Cmd: "PRESENCE", Type: EventPresenceLeft, Client: gone[i].Client, Presence: &gone[i]})
+		if err != nil {
+			return err
+		}
+		n.dispatch(Publication{Topic: TopicPresence, Data: string(data)})
+	}
+	if len(clients) == 0 {
+		return nil
+	}
+	sort.Strings(clients)
+	data, err := json.Marshal(Event{Cmd: "PRESENCE", Type: EventPresenceAlive, Clients: clients, Instance: n.boot})
+	if err != nil {
+		return err
+	}
+	return n.config.Broker.Publish(Publication{Topic: TopicPresence, Data: string(data)})
+}
+
+// updatePresence keeps track of the presence events of all instances.
+// Returns whether the event is for the receivers: heartbeats are not, and neither is a client
+// leaving one instance while it is still connected to another. Needs the lock.
+func (n *Notifier) updatePresence(data string) bool {
+	var event Event
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		return true
+	}
+	if event.Type == EventPresenceAlive {
+		for _, client := range event.Clients {
+			if _, ok := n.presence[client]; ok {
+				n.hold(client, event.Instance)
+			}
+		}
+		return false
+	}
+	if event.Presence == nil {
+		return true
+	}
+	client := event.Presence.Client
+	switch event.Type {
+	case EventPresenceLeft:
+		delete(n.holders[client], event.Instance)
+		if len(n.holders[client]) > 0 {
+			return false
+		}
+		delete(n.presence, client)
+		delete(n.holders, client)
+	case EventPresenceJoined:
+		n.presence[client] = *event.Presence
+		n.hold(client, event.Instance)
+	case EventPresenceUpdated:
+		// any instance can change the presence, only the ones with a connection hold the client
+		if _, ok := n.presence[client]; !ok {
+			return false
+		}
+		n.presence[client] = *event.Presence
+	}
+	return true
+}
+
+// hold notes that an instance has a connection of a client. Needs the lock.
+func (n *Notifier) hold(client, instance string) {
+	if n.holders[client] == nil {
+		n.holders[client] = make(map[string]time.Time)
+	}
+	n.holders[client][instance] = time.Now()
+}
+
+// schedulePresence sends a presence heartbeat every interval, see PresenceHeartbeat
+func schedulePresence(notifier *Notifier, interval, ttl time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := notifier.PresenceHeartbeat(ttl); err != nil {
+			log.Errorf("schedulePresence: Could not send heartbeat %v", err)
+		}
+	}
+}
+
+// joinPresence announces the client of an event stream or socket as the user of the request,
+// if it sent its id. The returned function announces that it left.
+// A client id that is present as another user is not announced again.
+func joinPresence(ctx echo.Context, notifier *Notifier) func() {
+	client := ctx.QueryParam("client")
+	if client == "" {
+		client = clientID(ctx)
+	}
+	if client == "" {
+		return func() {}
+	}
+	err := notifier.Join(client, ctx.QueryParam("name"), author(ctx).User)
+	if errors.Is(err, ErrClientTaken) {
+		ctx.Logger().Warnf("joinPresence: %v", err)
+		return func() {}
+	}
+	if err != nil {
+		ctx.Logger().Errorf("joinPresence: Could not send event %v", err)
+	}
+	return func() {
+		if err := notifier.Leave(client); err != nil {
+			ctx.Logger().Errorf("joinPresence: Could not send event %v", err)
+		}
+	}
+}
+
+// ********************************** //
+//             handlers:              //
+// ********************************** //
+
+// GET /presence lists the clients listening to events and where they are shopping
+func showPresence(notifier *Notifier) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		return ctx.JSON(http.StatusOK, notifier.Presence())
+	}
+}
+
+// PUT /presence tells the others where the client sending the request is shopping
+func setPresence(db *sql.DB, notifier *Notifier) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		request := &PresenceRequest{}
+		if err := ctx.Bind(request); err != nil {
+			ctx.Logger().Infof("setPresence: Bind Error with request %v: %v", ctx.Request().Body, err)
+			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+		}
+		client := clientID(ctx)
+		if client == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s header is missing", HeaderClientID))
+		}
+
+		var shop *Shop
+		if request.Shop != "" {
+			found, err := GetShopByID(db, request.Shop)
+			if err != nil {
+				ctx.Logger().Infof("setPresence: Database Error %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Could not read shop")
+			}
+			if found.UId == "" {
+				return echo.NewHTTPError(http.StatusNotFound, "Shop not found")
+			}
+			shop = &found
+		}
+
+		presence, err := notifier.SetShopping(client, author(ctx).User, shop)
+		if errors.Is(err, ErrNotPresent) {
+			return echo.NewHTTPError(http.StatusNotFound, "Client is not listening to events")
+		}
+		if errors.Is(err, ErrClientTaken) {
+			return echo.NewHTTPError(http.StatusForbidden, "Client belongs to another user")
+		}
+		if err != nil {
+			ctx.Logger().Errorf("setPresence: Could not send event %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not set presence")
+		}
+		return ctx.JSON(http.StatusOK, presence)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPresenceUser(t *testing.T) {
+	notifier := NewNotifier(NotifierConfig{Backlog: 16, QueueSize: 8})
+	if err := notifier.Join("phone", "Phone", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if presence := notifier.Presence(); len(presence) != 1 || presence[0].User != "alice" {
+		t.Errorf("presence does not know the user: %+v", presence)
+	}
+
+	if err := notifier.Join("phone", "Phone", "bob"); !errors.Is(err, ErrClientTaken) {
+		t.Errorf("another user could join with the client: %v", err)
+	}
+	if _, err := notifier.SetShopping("phone", "bob", &Shop{UId: "s1"}); !errors.Is(err, ErrClientTaken) {
+		t.Errorf("another user could set the presence of the client: %v", err)
+	}
+	presence, err := notifier.SetShopping("phone", "alice", &Shop{UId: "s1"})
+	if err != nil || presence.Shop == nil || presence.User != "alice" {
+		t.Errorf("user could not set the presence of its client: %+v %v", presence, err)
+	}
+}
+
+func TestPresenceHeartbeat(t *testing.T) {
+	broker := &fanoutBroker{}
+	first := NewNotifier(NotifierConfig{Backlog: 16, QueueSize: 8, Broker: broker})
+	second := NewNotifier(NotifierConfig{Backlog: 16, QueueSize: 8, Broker: broker})
+	if err := first.Join("phone", "Phone", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Join("laptop", "Laptop", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	onSecond, _ := second.NewReceiver(Subscription{})
+
+	// heartbeats keep the clients of the other instance, and the receivers do not see them
+	if err := first.PresenceHeartbeat(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.PresenceHeartbeat(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if len(second.Presence()) != 2 || len(onSecond.Messages()) != 0 {
+		t.Fatalf("after heartbeats: %+v, %d messages", second.Presence(), len(onSecond.Messages()))
+	}
+
+	// the first instance died without telling anybody, its client is forgotten
+	time.Sleep(10 * time.Millisecond)
+	if err := second.PresenceHeartbeat(5 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if presence := second.Presence(); len(presence) != 1 || presence[0].Client != "laptop" {
+		t.Errorf("after the first instance died: %+v", presence)
+	}
+	if msg := receive(t, onSecond); !strings.Contains(msg.Data, EventPresenceLeft) || !strings.Contains(msg.Data, `"phone"`) {
+		t.Errorf("receiver got %s instead of the client leaving", msg.Data)
+	}
+	// the client of the own instance stays, it is still connected
+	if presence := first.Presence(); len(presence) != 2 {
+		t.Errorf("the other instance was told: %+v", presence)
+	}
+}
+
+func TestPresenceReconnect(t *testing.T) {
+	broker := &fanoutBroker{}
+	first := NewNotifier(NotifierConfig{Backlog: 16, QueueSize: 8, Broker: broker})
+	second := NewNotifier(NotifierConfig{Backlog: 16, QueueSize: 8, Broker: broker})
+	onSecond, _ := second.NewReceiver(Subscription{})
+
+	// the client reconnects through the load balancer and ends up on the other instance,
+	// before the first one noticed that the old connection is gone
+	if err := first.Join("phone", "Phone", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Join("phone", "Phone", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Leave("phone"); err != nil {
+		t.Fatal(err)
+	}
+	for _, notifier := range []*Notifier{first, second} {
+		if presence := notifier.Presence(); len(presence) != 1 {
+			t.Errorf("client is gone although still connected to the second instance: %+v", presence)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if msg := receive(t, onSecond); !strings.Contains(msg.Data, EventPresenceJoined) {
+			t.Errorf("receiver got %s instead of the joins", msg.Data)
+		}
+	}
+	if len(onSecond.Messages()) != 0 {
+		t.Errorf("receiver was told that the client left one instance")
+	}
+
+	// once it leaves the last one, everybody learns about it
+	if err := second.Leave("phone"); err != nil {
+		t.Fatal(err)
+	}
+	if presence := first.Presence(); len(presence) != 0 {
+		t.Errorf("client is still present: %+v", presence)
+	}
+	if msg := receive(t, onSecond); !strings.Contains(msg.Data, EventPresenceLeft) {
+		t.Errorf("receiver got %s instead of the client leaving", msg.Data)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// units maps all spellings we understand to the unit we store
+var units = map[string]string{
+	"mg": "mg", "g": "g", "gr": "g", "gram": "g", "grams": "g", "kg": "kg", "kilo": "kg", "kilos": "kg",
+	"ml": "ml", "cl": "cl", "dl": "dl", "l": "l", "liter": "l", "liters": "l", "litre": "l", "litres": "l",
+	"tsp": "tsp", "teaspoon": "tsp", "teaspoons": "tsp", "tbsp": "tbsp", "tablespoon": "tbsp", "tablespoons": "tbsp",
+	"cup": "cup", "cups": "cup", "oz": "oz", "ounce": "oz", "ounces": "oz", "lb": "lb", "lbs": "lb", "pound": "lb", "pounds": "lb",
+	"pc": "pc", "pcs": "pc", "piece": "pc", "pieces": "pc", "pack": "pack", "packs": "pack", "pkg": "pack",
+	"can": "can", "cans": "can", "bottle": "bottle", "bottles": "bottle", "bunch": "bunch", "bunches": "bunch",
+	"clove": "clove", "cloves": "clove", "pinch": "pinch", "slice": "slice", "slices": "slice",
+}
+
+// unicode vulgar fractions used in recipes
+var fractions = map[rune]float64{
+	'½': 0.5, '⅓': 1.0 / 3, '⅔': 2.0 / 3, '¼': 0.25, '¾': 0.75, '⅕': 0.2, '⅛': 0.125, '⅜': 0.375, '⅝': 0.625, '⅞': 0.875,
+}
+
+// lookupUnit returns the unit we store for a spelling, empty if it is none
+func lookupUnit(word string) string {
+	return units[strings.TrimSuffix(strings.ToLower(word), ".")]
+}
+
+// parseNumber reads a number at the start of a word, like 2, 1.5, 1,5, 1/2, ½ or 1½.
+// Whatever follows the number (e.g. the unit in 500g) is returned as rest.
+func parseNumber(word string) (value float64, rest string, ok bool) {
+	end := 0
+	for end < len(word) && (word[end] >= '0' && word[end] <= '9' || word[end] == '.' || word[end] == ',' || word[end] == '/') {
+		end++
+	}
+	number, rest := word[:end], word[end:]
+
+	if number != "" {
+		number = strings.Replace(number, ",", ".", 1)
+		if parts := strings.SplitN(number, "/", 2); len(parts) == 2 {
+			numerator, err1 := strconv.ParseFloat(parts[0], 64)
+			denominator, err2 := strconv.ParseFloat(parts[1], 64)
+			if err1 != nil || err2 != nil || denominator == 0 {
+				return 0, word, false
+			}
+			value = numerator / denominator
+		} else {
+			var err error
+			value, err = strconv.ParseFloat(number, 64)
+			if err != nil {
+				return 0, word, false
+			}
+		}
+		ok = true
+	}
+
+	// unicode fraction directly after the number or on its own
+	for fraction, fractionValue := range fractions {
+		if strings.HasPrefix(rest, string(fraction)) {
+			value += fractionValue
+			rest = rest[len(string(fraction)):]
+			ok = true
+			break
+		}
+	}
+	return value, rest, ok
+}
+
+// ParseQuantity splits the quantity and unit from the text of an item.
+// Understands leading quantities like "2 milk", "500g flour", "1 1/2 cups sugar", "2x bread"
+// and trailing ones like "bread x2". Returns a zero quantity if there is none.
+func ParseQuantity(text string) (quantity float64, unit string, rest string) {
+	words := strings.Fields(text)
+	if len(words) < 2 {
+		return 0, "", strings.TrimSpace(text)
+	}
+
+	value, suffix, ok := parseNumber(words[0])
+	if ok {
+		words = words[1:]
+		// mixed numbers like 1 1/2
+		if suffix == "" && len(words) > 1 {
+			if fraction, fractionSuffix, ok := parseNumber(words[0]); ok && fraction < 1 {
+				value += fraction
+				suffix = fractionSuffix
+				words = words[1:]
+			}
+		}
+		// ranges like 2-3, we take the upper bound to be on the safe side
+		if strings.HasPrefix(suffix, "-") {
+			if upper, upperSuffix, ok := parseNumber(suffix[1:]); ok {
+				value, suffix = upper, upperSuffix
+			}
+		}
+		switch {
+		case suffix == "x" || suffix == "×":
+			// 2x bread
+		case suffix != "":
+			// 500g flour
+			unit = lookupUnit(suffix)
+			if unit == "" {
+				// not a quantity at all, e.g. 7up
+				return 0, "", strings.TrimSpace(text)
+			}
+		case len(words) > 1 && lookupUnit(words[0]) != "":
+			// 500 g flour
+			unit = lookupUnit(words[0])
+			words = words[1:]
+		case len(words) > 1 && (words[0] == "x" || words[0] == "×"):
+			// 2 x bread
+			words = words[1:]
+		}
+		// 2 cups of flour
+		if unit != "" && len(words) > 1 && strings.ToLower(words[0]) == "of" {
+			words = words[1:]
+		}
+		return value, unit, strings.Join(words, " ")
+	}
+
+	// bread x2
+	last := words[len(words)-1]
+	if strings.HasPrefix(last, "x") || strings.HasPrefix(last, "×") {
+		_, size := firstRune(last)
+		if value, suffix, ok := parseNumber(last[size:]); ok && suffix == "" {
+			return value, "", strings.Join(words[:len(words)-1], " ")
+		}
+	}
+	return 0, "", strings.TrimSpace(text)
+}
+
+func firstRune(s string) (rune, int) {
+	for _, r := range s {
+		return r, len(string(r))
+	}
+	return unicode.ReplacementChar, 0
+}
+
+// FormatQuantity renders a quantity with its unit, empty if there is no quantity
+func FormatQuantity(quantity float64, unit string) string {
+	if quantity == 0 {
+		return ""
+	}
+	number := strconv.FormatFloat(quantity, 'f', -1, 64)
+	// avoid things like 0.3333333333333333 from fractions
+	if len(number) > 5 {
+		number = strconv.FormatFloat(quantity, 'f', 2, 64)
+		number = strings.TrimRight(strings.TrimRight(number, "0"), ".")
+	}
+	if unit == "" {
+		return number
+	}
+	return number + " " + unit
+}
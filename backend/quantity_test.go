@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestParseQuantity(t *testing.T) {
+	tests := []struct {
+		text     string
+		quantity float64
+		unit     string
+		rest     string
+	}{
+		{"milk", 0, "", "milk"},
+		{"2 milk", 2, "", "milk"},
+		{"500g flour", 500, "g", "flour"},
+		{"500 g flour", 500, "g", "flour"},
+		{"1,5 l milk", 1.5, "l", "milk"},
+		{"1 1/2 cups of sugar", 1.5, "cup", "sugar"},
+		{"½ tsp salt", 0.5, "tsp", "salt"},
+		{"1½ kg potatoes", 1.5, "kg", "potatoes"},
+		{"2-3 onions", 3, "", "onions"},
+		{"2x bread", 2, "", "bread"},
+		{"2 x bread", 2, "", "bread"},
+		{"bread x2", 2, "", "bread"},
+		{"7up", 0, "", "7up"},
+		{"7up bottles", 0, "", "7up bottles"},
+		{"  eggs  ", 0, "", "eggs"},
+	}
+	for _, test := range tests {
+		quantity, unit, rest := ParseQuantity(test.text)
+		if quantity != test.quantity || unit != test.unit || rest != test.rest {
+			t.Errorf("%q: %v %q %q instead of %v %q %q", test.text, quantity, unit, rest, test.quantity, test.unit, test.rest)
+		}
+	}
+}
+
+func TestFormatQuantity(t *testing.T) {
+	tests := []struct {
+		quantity float64
+		unit     string
+		text     string
+	}{
+		{0, "g", ""},
+		{2, "", "2"},
+		{1.5, "l", "1.5 l"},
+		{1.0 / 3, "cup", "0.33 cup"},
+	}
+	for _, test := range tests {
+		if text := FormatQuantity(test.quantity, test.unit); text != test.text {
+			t.Errorf("%v %q: %q instead of %q", test.quantity, test.unit, text, test.text)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// RecipeImport is the input and result of importing the ingredients of a schema.org Recipe.
+// Either HTML with embedded JSON-LD or the JSON-LD itself has to be given.
+type RecipeImport struct {
+	HTML     string          `json:"html,omitempty"`
+	JSONLD   json.RawMessage `json:"jsonld,omitempty"`
+	Servings float64         `json:"servings,omitempty"`
+	Dedupe   bool            `json:"dedupe,omitempty"`
+	Preview  bool            `json:"preview,omitempty"`
+
+	Name     string          `json:"name,omitempty"`
+	Yield    float64         `json:"yield,omitempty"`
+	Items    []Item          `json:"items,omitempty"`
+	Warnings []string        `json:"warnings,omitempty"`
+	List     *ItemCollection `json:"list,omitempty"`
+}
+
+// Ingredient is one line of the ingredient list of a recipe
+type Ingredient struct {
+	Title    string  `json:"title"`
+	Quantity float64 `json:"quantity,omitempty"`
+	Unit     string  `json:"unit,omitempty"`
+	// Text is the line as written in the recipe
+	Text string `json:"text,omitempty"`
+}
+
+// Recipe is a dish with its ingredients for the given number of servings
+type Recipe struct {
+	UId         string       `json:"uid"`
+	Name        string       `json:"name"`
+	Servings    float64      `json:"servings,omitempty"`
+	Source      string       `json:"source,omitempty"`
+	Ingredients []Ingredient `json:"ingredients"`
+}
+
+// Valid tells you whether a recipe is valid
+func (r *Recipe) Valid() (bool, []string) {
+	var errors []string
+	if r.Name == "" {
+		errors = append(errors, "Name is missing")
+	}
+	if r.Servings < 0 {
+		errors = append(errors, "Servings must not be negative")
+	}
+	for i, ingredient := range r.Ingredients {
+		if ingredient.Title == "" {
+			errors = append(errors, fmt.Sprintf("Title of ingredient %d is missing", i+1))
+		}
+	}
+	return len(errors) == 0, errors
+}
+
+// Items turns the ingredients into OPEN items for the given number of servings,
+// tagged with the name of the recipe. If either the recipe or the request does not
+// say how many servings, the quantities are not scaled.
+func (r *Recipe) Items(servings float64) []Item {
+	factor := 1.0
+	if servings > 0 && r.Servings > 0 {
+		factor = servings / r.Servings
+	}
+	items := make([]Item, 0, len(r.Ingredients))
+	for _, ingredient := range r.Ingredients {
+		items = append(items, Item{
+			UId:      NewUID(),
+			Title:    ingredient.Title,
+			Status:   StatusOpen,
+			Quantity: ingredient.Quantity * factor,
+			Unit:     ingredient.Unit,
+			Recipes:  []string{r.Name},
+		})
+	}
+	return AggregateItems(items)
+}
+
+var (
+	// <script type="application/ld+json"> blocks in html pages
+	jsonLDScript = regexp.MustCompile(`(?is)<script[^>]*type\s*=\s*["']?application/ld\+json["']?[^>]*>(.*?)</script>`)
+	// the first number in a recipeYield like "4 servings"
+	yieldNumber = regexp.MustCompile(`\d+(?:[.,]\d+)?`)
+	// notes in ingredients like "(about 2 cups)"
+	ingredientNote = regexp.MustCompile(`\s*\([^)]*\)`)
+)
+
+// ExtractRecipeFromHTML finds the first schema.org Recipe in the JSON-LD blocks of a html page
+func ExtractRecipeFromHTML(page string) (Recipe, error) {
+	for _, match := range jsonLDScript.FindAllStringSubmatch(page, -1) {
+		recipe, err := ExtractRecipe([]byte(strings.TrimSpace(match[1])))
+		if err == nil {
+			return recipe, nil
+		}
+	}
+	return Recipe{}, fmt.Errorf("no schema.org Recipe found in page")
+}
+
+// ExtractRecipe finds the first schema.org Recipe in a JSON-LD document,
+// which can be a single object, an array or an object with a @graph
+func ExtractRecipe(data []byte) (Recipe, error) {
+	var document interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return Recipe{}, err
+	}
+	node := findRecipeNode(document)
+	if node == nil {
+		return Recipe{}, fmt.Errorf("no schema.org Recipe found")
+	}
+
+	recipe := Recipe{}
+	recipe.Name, _ = node["name"].(string)
+	recipe.Name = html.UnescapeString(recipe.Name)
+	recipe.Servings = parseYield(node["recipeYield"])
+	ingredients, ok := node["recipeIngredient"]
+	if !ok {
+		// the old name of the property
+		ingredients = node["ingredients"]
+	}
+	var lines []string
+	for _, ingredient := range toList(ingredients) {
+		if text, ok := ingredient.(string); ok && strings.TrimSpace(text) != "" {
+			lines = append(lines, html.UnescapeString(strings.TrimSpace(text)))
+		}
+	}
+	recipe.Ingredients = ParseIngredients(lines)
+	if len(recipe.Ingredients) == 0 {
+		return recipe, fmt.Errorf("recipe has no ingredients")
+	}
+	return recipe, nil
+}
+
+// findRecipeNode walks the JSON-LD tree to the first node of @type Recipe
+func findRecipeNode(node interface{}) map[string]interface{} {
+	switch value := node.(type) {
+	case []interface{}:
+		for _, child := range value {
+			if found := findRecipeNode(child); found != nil {
+				return found
+			}
+		}
+	case map[string]interface{}:
+		for _, nodeType := range toList(value["@type"]) {
+			if name, ok := nodeType.(string); ok && (name == "Recipe" || strings.HasSuffix(name, "/Recipe")) {
+				return value
+			}
+		}
+		if graph, ok := value["@graph"]; ok {
+			return findRecipeNode(graph)
+		}
+	}
+	return nil
+}
+
+// toList returns a JSON value as list, single values become a list with one element
+func toList(value interface{}) []interface{} {
+	switch list := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return list
+	default:
+		return []interface{}{list}
+	}
+}
+
+// parseYield reads the number of servings from a recipeYield, 0 if there is none
+func parseYield(value interface{}) float64 {
+	for _, yield := range toList(value) {
+		switch v := yield.(type) {
+		case float64:
+			return v
+		case string:
+			if number := yieldNumber.FindString(v); number != "" {
+				result, err := strconv.ParseFloat(strings.Replace(number, ",", ".", 1), 64)
+				if err == nil {
+					return result
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// extractRecipeInput finds the recipe in JSON-LD, given as object or as string containing it,
+// or else in a html page
+func extractRecipeInput(page string, jsonld json.RawMessage) (Recipe, error) {
+	if len(jsonld) == 0 {
+		return ExtractRecipeFromHTML(page)
+	}
+	data := []byte(jsonld)
+	var text string
+	if json.Unmarshal(jsonld, &text) == nil {
+		data = []byte(text)
+	}
+	return ExtractRecipe(data)
+}
+
+// ParseIngredients reads quantity, unit and title of ingredient lines.
+// Notes in parentheses and preparation hints after a comma are dropped,
+// lines without anything left are skipped.
+func ParseIngredients(lines []string) []Ingredient {
+	var ingredients []Ingredient
+	for _, line := range lines {
+		ingredient := ParseIngredient(line)
+		if ingredient.Title != "" {
+			ingredients = append(ingredients, ingredient)
+		}
+	}
+	return ingredients
+}
+
+// ParseIngredient reads quantity, unit and title of one ingredient line
+func ParseIngredient(line string) Ingredient {
+	ingredient := Ingredient{Text: line}
+	text := ingredientNote.ReplaceAllString(line, "")
+	ingredient.Quantity, ingredient.Unit, ingredient.Title = ParseQuantity(text)
+	// the preparation hint follows the title, a comma in the quantity is a decimal comma
+	if comma := strings.Index(ingredient.Title, ","); comma >= 0 {
+		ingredient.Title = strings.TrimSpace(ingredient.Title[:comma])
+	}
+	return ingredient
+}
+
+// AggregateItems adds up items with the same title and unit, the first one of them is kept
+func AggregateItems(items []Item) []Item {
+	result := make([]Item, 0, len(items))
+	index := make(map[string]int)
+	for _, item := range items {
+		key := strings.ToLower(item.Title) + "\x00" + item.Unit
+		if i, ok := index[key]; ok {
+			result[i].Quantity += item.Quantity
+			result[i].Recipes = mergeRecipeNames(result[i].Recipes, item.Recipes)
+			continue
+		}
+		index[key] = len(result)
+		result = append(result, item)
+	}
+	return result
+}
+
+// mergeRecipeNames adds the names that are not in the list yet
+func mergeRecipeNames(names []string, more []string) []string {
+	result := append([]string{}, names...)
+	for _, name := range more {
+		found := false
+		for _, existing := range result {
+			found = found || existing == name
+		}
+		if !found {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// AddIngredients adds ingredient items to the list.
+// With dedupe, an OPEN item with the same title takes up the ingredient instead: quantities are added up
+// if the units match and the recipes are added to its tags. An ingredient in another unit is added as an item
+// of its own, so that the list never claims to cover more than it does. Without dedupe, all ingredients are added as new items.
+// Returns the new list and the items that were added or changed.
+func AddIngredients(existing []Item, ingredients []Item, dedupe bool) ([]Item, []Item, []string) {
+	var warnings []string
+	result := make([]Item, 0, len(ingredients))
+	index := make(map[string][]int)
+	orderno := 0
+	for i, item := range existing {
+		if item.Status == StatusOpen {
+			title := strings.ToLower(item.Title)
+			index[title] = append(index[title], i)
+		}
+		if item.Orderno >= orderno {
+			orderno = item.Orderno + 1
+		}
+	}
+
+	for _, ingredient := range ingredients {
+		title := strings.ToLower(ingredient.Title)
+		if i, ok := sameIngredient(existing, index[title], ingredient); ok && dedupe {
+			item := existing[i]
+			switch {
+			case item.Quantity == 0 && item.Unit == "":
+				item.Quantity, item.Unit = ingredient.Quantity, ingredient.Unit
+			case item.Unit == ingredient.Unit:
+				item.Quantity += ingredient.Quantity
+			}
+			item.Recipes = mergeRecipeNames(item.Recipes, ingredient.Recipes)
+			existing[i] = item
+			result = append(result, item)
+			continue
+		}
+		if len(index[title]) > 0 && dedupe {
+			item := existing[index[title][0]]
+			warnings = append(warnings, fmt.Sprintf("%s is already on the list as %s, added %s as another item",
+				item.Title, FormatQuantity(item.Quantity, item.Unit), FormatQuantity(ingredient.Quantity, ingredient.Unit)))
+		}
+		ingredient.Orderno = orderno
+		orderno++
+		index[title] = append(index[title], len(existing))
+		existing = append(existing, ingredient)
+		result = append(result, ingredient)
+	}
+	return existing, result, warnings
+}
+
+// sameIngredient finds the item among the candidates that can take up an ingredient: one in the same unit,
+// one without quantity, or any one if the ingredient has no quantity itself
+func sameIngredient(items []Item, candidates []int, ingredient Item) (int, bool) {
+	for _, i := range candidates {
+		if items[i].Unit == ingredient.Unit || (items[i].Quantity == 0 && items[i].Unit == "") {
+			return i, true
+		}
+	}
+	if ingredient.Quantity == 0 && ingredient.Unit == "" && len(candidates) > 0 {
+		return candidates[0], true
+	}
+	return 0, false
+}
+
+// ********************************** //
+//             handlers:              //
+// ********************************** //
+
+// POST /items/recipe adds the ingredients of a recipe to the list.
+// With preview set, the result is returned without changing anything.
+// Tokens and share links with the add scope can not dedupe, share links add to their list.
+func importRecipe(db *sql.DB, notifier *Notifier) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+
+		// bind body into struct
+		input := &RecipeImport{}
+		err := ctx.Bind(input)
+		if err != nil {
+			ctx.Logger().Infof("importRecipe: Bind Error with request %v: %v", ctx.Request().Body, err)
+			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+		}
+		if input.Servings < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "servings must not be negative")
+		}
+
+		if len(input.JSONLD) == 0 && input.HTML == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "Need either html or jsonld")
+		}
+		recipe, err := extractRecipeInput(input.HTML, input.JSONLD)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		// with the add scope, existing items must not change
+		if input.Dedupe && addOnly(ctx) {
+			input.Dedupe = false
+		}
+
+		result := RecipeImport{Name: recipe.Name, Yield: recipe.Servings, Servings: input.Servings, Dedupe: input.Dedupe, Preview: input.Preview}
+		if input.Servings > 0 && recipe.Servings == 0 {
+			result.Warnings = append(result.Warnings, "recipe does not say how many servings it makes, quantities are not scaled")
+		}
+		ingredients := recipe.Items(input.Servings)
+		onShareList(ctx, ingredients)
+		var warnings []string
+
+		if input.Preview {
+			orig, err := GetAllItems(db)
+			if err != nil {
+				ctx.Logger().Infof("importRecipe: Database Error on get %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Could not read items")
+			}
+			_, result.Items, warnings = AddIngredients(orig.Items, ingredients, input.Dedupe)
+			result.Warnings = append(result.Warnings, warnings...)
+			return ctx.JSON(http.StatusOK, result)
+		}
+
+		// do database operation
+		items, _, err := UpdateItems(db, notifier, "items/recipe", author(ctx), func(orig []Item) ([]Item, error) {
+			var merged []Item
+			merged, result.Items, warnings = AddIngredients(orig, ingredients, input.Dedupe)
+			return merged, nil
+		})
+		if err != nil {
+			ctx.Logger().Infof("importRecipe: Database Error on update %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not add ingredients")
+		}
+		result.Warnings = append(result.Warnings, warnings...)
+		items.Items = shareItems(ctx, items.Items)
+		result.List = &items
+		return ctx.JSON(http.StatusOK, result)
+	}
+}
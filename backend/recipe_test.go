@@ -0,0 +1,120 @@
+package main
+
+import "testing"
+
+func TestAddIngredientsUnits(t *testing.T) {
+	existing := []Item{{UId: "i1", Title: "Flour", Status: StatusOpen, Quantity: 1, Unit: "kg", Recipes: []string{"Bread"}}}
+	ingredients := []Item{
+		{UId: "n1", Title: "flour", Status: StatusOpen, Quantity: 200, Unit: "g", Recipes: []string{"Cake"}},
+		{UId: "n2", Title: "Flour", Status: StatusOpen, Quantity: 100, Unit: "g", Recipes: []string{"Pie"}},
+		{UId: "n3", Title: "Flour", Status: StatusOpen, Quantity: 1, Unit: "kg", Recipes: []string{"Pizza"}},
+	}
+	list, changed, warnings := AddIngredients(existing, ingredients, true)
+
+	// the grams can not be added to the kilogram, they become an item of their own
+	if len(list) != 2 || len(changed) != 3 || len(warnings) != 1 {
+		t.Fatalf("list %+v, changed %+v, warnings %v", list, changed, warnings)
+	}
+	if list[0].Quantity != 2 || list[0].Unit != "kg" || len(list[0].Recipes) != 2 {
+		t.Errorf("kilograms are %+v", list[0])
+	}
+	if list[1].UId != "n1" || list[1].Quantity != 300 || list[1].Unit != "g" || len(list[1].Recipes) != 2 {
+		t.Errorf("grams are %+v", list[1])
+	}
+}
+
+func TestParseIngredient(t *testing.T) {
+	tests := []struct {
+		line     string
+		title    string
+		quantity float64
+		unit     string
+	}{
+		{"1,5 kg Mehl", "Mehl", 1.5, "kg"},
+		{"2 onions, finely chopped", "onions", 2, ""},
+		{"200 g butter (softened)", "butter", 200, "g"},
+		{"Salt, to taste", "Salt", 0, ""},
+		{"0,5 l Milch, lauwarm", "Milch", 0.5, "l"},
+		{", garnish", "", 0, ""},
+	}
+	for _, test := range tests {
+		ingredient := ParseIngredient(test.line)
+		if ingredient.Title != test.title || ingredient.Quantity != test.quantity || ingredient.Unit != test.unit {
+			t.Errorf("%q: %+v", test.line, ingredient)
+		}
+	}
+}
+
+func TestExtractRecipe(t *testing.T) {
+	tests := []struct {
+		name     string
+		jsonld   string
+		recipe   string
+		servings float64
+		titles   []string
+	}{
+		{name: "object",
+			jsonld: `{"@type": "Recipe", "name": "Bread", "recipeYield": "4 servings", "recipeIngredient": ["1,5 kg Mehl", "1 tsp salt"]}`,
+			recipe: "Bread", servings: 4, titles: []string{"Mehl", "salt"}},
+		{name: "array",
+			jsonld: `[{"@type": "WebPage"}, {"@type": ["Recipe"], "name": "Soup", "recipeYield": ["2", "2 bowls"], "recipeIngredient": "2 carrots"}]`,
+			recipe: "Soup", servings: 2, titles: []string{"carrots"}},
+		{name: "graph",
+			jsonld: `{"@context": "https://schema.org", "@graph": [{"@type": "Organization"}, {"@type": "http://schema.org/Recipe", "name": "Tea &amp; Cake", "recipeYield": 6, "recipeIngredient": ["1 cake"]}]}`,
+			recipe: "Tea & Cake", servings: 6, titles: []string{"cake"}},
+		{name: "ingredients fallback",
+			jsonld: `{"@type": "Recipe", "name": "Salad", "ingredients": ["1 head lettuce", " "]}`,
+			recipe: "Salad", titles: []string{"head lettuce"}},
+	}
+	for _, test := range tests {
+		recipe, err := ExtractRecipe([]byte(test.jsonld))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if recipe.Name != test.recipe || recipe.Servings != test.servings || len(recipe.Ingredients) != len(test.titles) {
+			t.Errorf("%s: %+v", test.name, recipe)
+			continue
+		}
+		for i, ingredient := range recipe.Ingredients {
+			if ingredient.Title != test.titles[i] {
+				t.Errorf("%s: ingredient %d is %q instead of %q", test.name, i, ingredient.Title, test.titles[i])
+			}
+		}
+	}
+
+	for _, jsonld := range []string{`{"@type": "WebPage"}`, `{"@type": "Recipe", "name": "Nothing"}`, `not json`} {
+		if _, err := ExtractRecipe([]byte(jsonld)); err == nil {
+			t.Errorf("%s: no error", jsonld)
+		}
+	}
+}
+
+func TestExtractRecipeFromHTML(t *testing.T) {
+	page := `<html><head>
+<script type="application/ld+json">{"@type": "BreadcrumbList"}</script>
+<script type='application/ld+json'>
+{"@type": "Recipe", "name": "Pancakes", "recipeYield": "4 servings", "recipeIngredient": ["0,5 l milk", "2 eggs"]}
+</script></head></html>`
+	recipe, err := ExtractRecipeFromHTML(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recipe.Name != "Pancakes" || recipe.Servings != 4 || len(recipe.Ingredients) != 2 {
+		t.Fatalf("recipe is %+v", recipe)
+	}
+
+	// scaled from 4 to 6 servings
+	items := recipe.Items(6)
+	if len(items) != 2 || items[0].Title != "milk" || items[0].Quantity != 0.75 || items[0].Unit != "l" || items[1].Quantity != 3 {
+		t.Errorf("items for 6 servings are %+v", items)
+	}
+	// without servings the quantities stay
+	if items = recipe.Items(0); items[0].Quantity != 0.5 {
+		t.Errorf("items without servings are %+v", items)
+	}
+
+	if _, err = ExtractRecipeFromHTML("<html><body>no recipe</body></html>"); err == nil {
+		t.Error("page without recipe gave no error")
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// cookies of a session: the session token is hidden from scripts, the CSRF token
+// is read by the frontend and sent back as header with every change
+const (
+	CookieSession = "session"
+	CookieCSRF    = "csrf_token"
+	HeaderCSRF    = "X-CSRF-Token"
+)
+
+// the key under which the session of a request is stored in the echo context
+const contextSession = "session"
+
+// how often the session token is replaced, and how long the replaced one still works
+// for requests that were already on their way
+const (
+	sessionRotation = time.Hour
+	sessionGrace    = time.Minute
+)
+
+// SessionConfig holds the settings of the login sessions
+type SessionConfig struct {
+	// Lifetime is how long a session lasts without being used
+	Lifetime time.Duration
+	// Secure makes browsers send the cookies only over HTTPS
+	Secure bool
+}
+
+// Session is a login of a user in a browser, the token itself is only stored as hash
+type Session struct {
+	ID        string `json:"id"`
+	UserAgent string `json:"user_agent"`
+	CreatedAt int64  `json:"created_at"`
+	LastSeen  int64  `json:"last_seen"`
+	ExpiresAt int64  `json:"expires_at"`
+	// Current is the session of the request listing the sessions
+	Current   bool `json:"current,omitempty"`
+	userID    int64
+	csrf      string
+	rotatedAt int64
+}
+
+// LoginRequest is what the login form sends
+type LoginRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// LoginResponse tells the frontend who is logged in and the token to send with changes
+type LoginResponse struct {
+	User User   `json:"user"`
+	CSRF string `json:"csrf_token"`
+}
+
+// newToken returns a random token for cookies
+func newToken() string {
+	random := make([]byte, 32)
+	rand.Read(random)
+	return base64.RawURLEncoding.EncodeToString(random)
+}
+
+// hashToken is how tokens are stored, so that the database does not hold usable ones
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// currentSession returns the session of the request, ok is false if it did not use one
+func currentSession(ctx echo.Context) (Session, bool) {
+	session, ok := ctx.Get(contextSession).(Session)
+	return session, ok
+}
+
+// setSessionCookies hands the tokens of a session to the browser, an empty token removes them
+func setSessionCookies(ctx echo.Context, config SessionConfig, token, csrf string) {
+	maxAge := int(config.Lifetime.Seconds())
+	if token == "" {
+		maxAge = -1
+	}
+	ctx.SetCookie(&http.Cookie{
+		Name: CookieSession, Value: token, Path: "/", MaxAge: maxAge,
+		HttpOnly: true, Secure: config.Secure, SameSite: http.SameSiteStrictMode,
+	})
+	ctx.SetCookie(&http.Cookie{
+		Name: CookieCSRF, Value: csrf, Path: "/", MaxAge: maxAge,
+		Secure: config.Secure, SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// sessionAuth logs a request in with the session cookie, if it has a valid one.
+// Changes need the CSRF token as header. The session is kept alive and its token rotated.
+func sessionAuth(db *sql.DB, ctx echo.Context, config SessionConfig) (bool, error) {
+	cookie, err := ctx.Cookie(CookieSession)
+	if err != nil || cookie.Value == "" {
+		return false, nil
+	}
+	session, user, err := GetSessionByToken(db, cookie.Value)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !readOnlyMethods[ctx.Request().Method] {
+		header := ctx.Request().Header.Get(HeaderCSRF)
+		if subtle.ConstantTimeCompare([]byte(header), []byte(session.csrf)) != 1 {
+			return false, echo.NewHTTPError(http.StatusForbidden, "CSRF token is missing or wrong")
+		}
+	}
+
+	now := time.Now()
+	if now.Sub(time.Unix(session.LastSeen, 0)) > time.Minute {
+		if err = TouchSession(db, session.ID, config.Lifetime); err != nil {
+			return false, err
+		}
+	}
+	if now.Sub(time.Unix(session.rotatedAt, 0)) > sessionRotation {
+		token, rotated, err := RotateSession(db, session.ID, cookie.Value)
+		if err != nil {
+			return false, err
+		}
+		if rotated {
+			setSessionCookies(ctx, config, token, session.csrf)
+		}
+	}
+	ctx.Set(contextUser, user)
+	ctx.Set(contextSession, session)
+	return true, nil
+}
+
+// ********************************** //
+//     database access functions:     //
+// ********************************** //
+
+// CreateSession starts a session for a user and returns it with its token
+func CreateSession(db *sql.DB, user User, userAgent string, lifetime time.Duration) (Session, string, error) {
+	now := time.Now()
+	token := newToken()
+	session := Session{
+		ID:        NewUID(),
+		UserAgent: userAgent,
+		CreatedAt: now.Unix(),
+		LastSeen:  now.Unix(),
+		ExpiresAt: now.Add(lifetime).Unix(),
+		userID:    user.ID,
+		csrf:      newToken(),
+		rotatedAt: now.Unix(),
+	}
+	query := `INSERT INTO sessions(id, user_id, token_hash, csrf_token, user_agent, created_at, rotated_at, last_seen, expires_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(query, session.ID, session.userID, hashToken(token), session.csrf, session.UserAgent,
+		session.CreatedAt, session.rotatedAt, session.LastSeen, session.ExpiresAt)
+	return session, token, err
+}
+
+// GetSessionByToken loads an unexpired session and its user, returns sql.ErrNoRows if there is none.
+// The token replaced by the last rotation still works for a short while.
+func GetSessionByToken(db *sql.DB, token string) (Session, User, error) {
+	session := Session{}
+	user := User{}
+	now := time.Now()
+	query := `SELECT sessions.id, sessions.user_id, sessions.csrf_token, sessions.user_agent, sessions.created_at,
+			sessions.rotated_at, sessions.last_seen, sessions.expires_at,
+			users.id, users.name, users.admin, users.created_at, users.password_hash
+		FROM sessions JOIN users ON users.id = sessions.user_id
+		WHERE (sessions.token_hash = ? OR (sessions.previous_hash = ? AND sessions.rotated_at > ?)) AND sessions.expires_at > ?`
+	hash := hashToken(token)
+	err := db.QueryRow(query, hash, hash, now.Add(-sessionGrace).Unix(), now.Unix()).Scan(
+		&session.ID, &session.userID, &session.csrf, &session.UserAgent, &session.CreatedAt,
+		&session.rotatedAt, &session.LastSeen, &session.ExpiresAt,
+		&user.ID, &user.Name, &user.Admin, &user.CreatedAt, &user.hash)
+	return session, user, err
+}
+
+// TouchSession marks a session as used and extends it
+func TouchSession(db *sql.DB, id string, lifetime time.Duration) error {
+	now := time.Now()
+	_, err := db.Exec("UPDATE sessions SET last_seen = ?, expires_at = ? WHERE id = ?", now.Unix(), now.Add(lifetime).Unix(), id)
+	return err
+}
+
+// RotateSession gives a session a new token and returns it, if the given token is still its current one.
+// ok is false if a concurrent request rotated it first, that request hands out the new token.
+func RotateSession(db *sql.DB, id, current string) (string, bool, error) {
+	token := newToken()
+	result, err := db.Exec("UPDATE sessions SET previous_hash = token_hash, token_hash = ?, rotated_at = ? WHERE id = ? AND token_hash = ?",
+		hashToken(token), time.Now().Unix(), id, hashToken(current))
+	if err != nil {
+		return "", false, err
+	}
+	num, err := result.RowsAffected()
+	return token, num == 1, err
+}
+
+// GetSessions loads the unexpired sessions of a user, the most recently used first
+func GetSessions(db *sql.DB, userID int64) ([]Session, error) {
+	result := make([]Session, 0)
+	query := `SELECT id, user_agent, created_at, last_seen, expires_at FROM sessions
+		WHERE user_id = ? AND expires_at > ? ORDER BY last_seen DESC`
+	rows, err := db.Query(query, userID, time.Now().Unix())
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		session := Session{userID: userID}
+		if err = rows.Scan(&session.ID, &session.UserAgent, &session.CreatedAt, &session.LastSeen, &session.ExpiresAt); err != nil {
+			return result, err
+		}
+		result = append(result, session)
+	}
+	return result, rows.Err()
+}
+
+// DeleteSession ends a session of a user
+func DeleteSession(db *sql.DB, userID int64, id string) (int, error) {
+	result, err := db.Exec("DELETE FROM sessions WHERE user_id = ? AND id = ?", userID, id)
+	if err != nil {
+		return 0, err
+	}
+	num, err := result.RowsAffected()
+	return int(num), err
+}
+
+// DeleteUserSessions ends all sessions of a user
+func DeleteUserSessions(db *sql.DB, userID int64) (int, error) {
+	result, err := db.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	if err != nil {
+		return 0, err
+	}
+	num, err := result.RowsAffected()
+	return int(num), err
+}
+
+// PurgeSessions removes the expired sessions
+func PurgeSessions(db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE expires_at <= ?", time.Now().Unix())
+	return err
+}
+
+// ********************************** //
+//             handlers:              //
+// ********************************** //
+
+// POST /login starts a session with name and password
+func login(db *sql.DB, config SessionConfig) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		request := &LoginRequest{}
+		if err := ctx.Bind(request); err != nil {
+			ctx.Logger().Infof("login: Bind Error with request %v: %v", ctx.Request().Body, err)
+			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+		}
+		user, valid, err := CheckPassword(db, request.Name, request.Password)
+		if err != nil {
+			ctx.Logger().Infof("login: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not log in")
+		}
+		if !valid {
+			ctx.Logger().Warnf("login: wrong name or password for %s", request.Name)
+			return echo.NewHTTPError(http.StatusUnauthorized, "Wrong name or password")
+		}
+
+		if err = PurgeSessions(db); err != nil {
+			ctx.Logger().Errorf("login: Could not purge sessions %v", err)
+		}
+		session, token, err := CreateSession(db, user, ctx.Request().UserAgent(), config.Lifetime)
+		if err != nil {
+			ctx.Logger().Infof("login: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not log in")
+		}
+		setSessionCookies(ctx, config, token, session.csrf)
+		return ctx.JSON(http.StatusOK, LoginResponse{User: user, CSRF: session.csrf})
+	}
+}
+
+// POST /logout ends the session of the request
+func logout(db *sql.DB, config SessionConfig) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		if session, ok := currentSession(ctx); ok {
+			if _, err := DeleteSession(db, session.userID, session.ID); err != nil {
+				ctx.Logger().Infof("logout: Database Error %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Could not log out")
+			}
+		}
+		setSessionCookies(ctx, config, "", "")
+		return ctx.NoContent(http.StatusNoContent)
+	}
+}
+
+// GET /sessions lists the sessions of the logged in user
+func showSessions(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		user, ok := currentUser(ctx)
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Not logged in")
+		}
+		sessions, err := GetSessions(db, user.ID)
+		if err != nil {
+			ctx.Logger().Infof("showSessions: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read sessions")
+		}
+		if current, ok := currentSession(ctx); ok {
+			for i := range sessions {
+				sessions[i].Current = sessions[i].ID == current.ID
+			}
+		}
+		return ctx.JSON(http.StatusOK, sessions)
+	}
+}
+
+// DELETE /sessions/:id ends a session of the logged in user
+func deleteSession(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		user, ok := currentUser(ctx)
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Not logged in")
+		}
+		num, err := DeleteSession(db, user.ID, ctx.Param("id"))
+		if err != nil {
+			ctx.Logger().Infof("deleteSession: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not end session")
+		}
+		if num == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "No such session")
+		}
+		return ctx.NoContent(http.StatusNoContent)
+	}
+}
+
+// DELETE /users/:name/sessions ends all sessions of a user, for admins
+func deleteUserSessions(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		user, err := GetUserByName(db, ctx.Param("name"))
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusNotFound, "No such user")
+		}
+		if err != nil {
+			ctx.Logger().Infof("deleteUserSessions: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read user")
+		}
+		if _, err = DeleteUserSessions(db, user.ID); err != nil {
+			ctx.Logger().Infof("deleteUserSessions: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not end sessions")
+		}
+		return ctx.NoContent(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRotateSessionOnce makes sure that of two requests rotating a session at the same time only one
+// hands out a new token, so that the browser never holds a token that is neither current nor previous
+func TestRotateSessionOnce(t *testing.T) {
+	db := newTestDB(t)
+	user, err := CreateUser(db, "alice", "secret123", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, token, err := CreateSession(db, user, "test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, ok, err := RotateSession(db, session.ID, token)
+	if err != nil || !ok {
+		t.Fatalf("first rotation: %v %v", ok, err)
+	}
+	if _, ok, err = RotateSession(db, session.ID, token); err != nil || ok {
+		t.Fatalf("second rotation with the same token: %v %v", ok, err)
+	}
+	for _, valid := range []string{token, first} {
+		if _, _, err := GetSessionByToken(db, valid); err != nil {
+			t.Errorf("token no longer valid after the rotation: %v", err)
+		}
+	}
+}
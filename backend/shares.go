@@ -0,0 +1,332 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Share links let people without an account use one list, e.g. guests read the party list
+// or a house-sitter adds items. Their token is part of the link.
+
+// ShareTokenPrefix starts every share token
+const ShareTokenPrefix = "sls_"
+
+// SharePrefix marks changes made with a share link in the changesets and events
+const SharePrefix = "share:"
+
+// HeaderShare carries the token of a share link. Links carry it after the # of the URL,
+// which browsers do not send and so it does not end up in access logs.
+const HeaderShare = "X-Share-Token"
+
+// CookieShare keeps the token of a share link for requests that can not send headers, like EventSource.
+// It is set once the token was sent in the header and only works for reading.
+const CookieShare = "share"
+
+// the key under which the share link of a request is stored in the echo context
+const contextShare = "share"
+
+// AllowedShareScopes are the scopes of share links, they never get full access
+var AllowedShareScopes = []string{ScopeRead, ScopeAdd}
+
+// Share is a link to the list, the token itself is only shown when it is created
+type Share struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Scope     string `json:"scope"`
+	List      string `json:"list"`
+	CreatedBy string `json:"created_by"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Token     string `json:"token,omitempty"`
+	URL       string `json:"url,omitempty"`
+	// the shop of the list, nil for ListNone, loaded when the link is used
+	shop *Shop
+}
+
+// ShareInput is what editors send to create a share link
+type ShareInput struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+	// List is the uid of the shop whose list is shared, or ListNone for the items without a shop
+	List string `json:"list"`
+	// ExpiresIn is a duration like 72h, empty for links that do not expire
+	ExpiresIn string `json:"expires_in"`
+}
+
+// Valid tells you whether a share link can be created
+func (s *ShareInput) Valid() (bool, []string) {
+	var errors []string
+	if strings.TrimSpace(s.Name) == "" {
+		errors = append(errors, "Name is missing")
+	}
+	if s.Scope != ScopeRead && s.Scope != ScopeAdd {
+		errors = append(errors, fmt.Sprintf("Scope is of wrong format (%s), only following are allowed: %s", s.Scope, strings.Join(AllowedShareScopes, ", ")))
+	}
+	if strings.TrimSpace(s.List) == "" {
+		errors = append(errors, "List is missing")
+	}
+	if s.ExpiresIn != "" {
+		if expiresIn, err := time.ParseDuration(s.ExpiresIn); err != nil || expiresIn <= 0 {
+			errors = append(errors, fmt.Sprintf("Expires in is of wrong format (%s), use a duration like 72h", s.ExpiresIn))
+		}
+	}
+	if len(errors) > 0 {
+		return false, errors
+	}
+	return true, errors
+}
+
+// role is what a share link may do on the list, add links are limited further by their scope
+func (s *Share) role() string {
+	if s.Scope == ScopeAdd {
+		return RoleEditor
+	}
+	return RoleViewer
+}
+
+// currentShare returns the share link of the request, ok is false if it did not use one
+func currentShare(ctx echo.Context) (Share, bool) {
+	share, ok := ctx.Get(contextShare).(Share)
+	return share, ok
+}
+
+// shareList returns the list the share link of a request is limited to, ok is false if it is not.
+// Links from before share links had a list keep seeing all of them.
+func shareList(ctx echo.Context) (string, bool) {
+	share, ok := currentShare(ctx)
+	if !ok || share.List == "" {
+		return "", false
+	}
+	return share.List, true
+}
+
+// shareItems leaves out the items that are not on the list of the share link of a request
+func shareItems(ctx echo.Context, items []Item) []Item {
+	list, ok := shareList(ctx)
+	if !ok {
+		return items
+	}
+	result := make([]Item, 0, len(items))
+	for i := range items {
+		if itemList(&items[i]) == list {
+			result = append(result, items[i])
+		}
+	}
+	return result
+}
+
+// shareShops leaves out the shops that are not the list of the share link of a request
+func shareShops(ctx echo.Context, shops []Shop) []Shop {
+	list, ok := shareList(ctx)
+	if !ok {
+		return shops
+	}
+	result := make([]Shop, 0, 1)
+	for _, shop := range shops {
+		if shop.UId == list {
+			result = append(result, shop)
+		}
+	}
+	return result
+}
+
+// onShareList puts the items added with the share link of a request on its list
+func onShareList(ctx echo.Context, items []Item) {
+	share, ok := currentShare(ctx)
+	if !ok || share.List == "" {
+		return
+	}
+	for i := range items {
+		items[i].Shop = share.shop
+	}
+}
+
+// shareAuth lets a request in with the token of a share link, if it has a valid one.
+// The token comes from HeaderShare, or from CookieShare for reading requests.
+// Requests the scope of the link does not allow are rejected, as are links whose list is gone.
+func shareAuth(db *sql.DB, ctx echo.Context, config SessionConfig) (bool, error) {
+	secret := ctx.Request().Header.Get(HeaderShare)
+	fromHeader := secret != ""
+	cookie, err := ctx.Cookie(CookieShare)
+	if !fromHeader && err == nil && readOnlyMethods[ctx.Request().Method] {
+		secret = cookie.Value
+	}
+	if secret == "" {
+		return false, nil
+	}
+	share, err := GetShareByToken(db, secret)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !scopeAllows(share.Scope, ctx) {
+		return false, echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("The share link is only allowed to %s", share.Scope))
+	}
+	if share.List != "" && share.List != ListNone {
+		shop, err := GetShopByID(db, share.List)
+		if err != nil {
+			return false, err
+		}
+		if shop.UId == "" {
+			return false, echo.NewHTTPError(http.StatusForbidden, "The list of the share link does not exist anymore")
+		}
+		share.shop = &shop
+	}
+	if fromHeader && (cookie == nil || cookie.Value != secret) {
+		ctx.SetCookie(&http.Cookie{
+			Name: CookieShare, Value: secret, Path: "/",
+			HttpOnly: true, Secure: config.Secure, SameSite: http.SameSiteStrictMode,
+		})
+	}
+	ctx.Set(contextShare, share)
+	return true, nil
+}
+
+// ********************************** //
+//     database access functions:     //
+// ********************************** //
+
+// CreateShare stores a new share link and returns it with its token
+func CreateShare(db *sql.DB, input ShareInput, createdBy string) (Share, error) {
+	share := Share{
+		ID:        NewUID(),
+		Name:      strings.TrimSpace(input.Name),
+		Scope:     input.Scope,
+		List:      strings.TrimSpace(input.List),
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().Unix(),
+		Token:     ShareTokenPrefix + newToken(),
+	}
+	if input.ExpiresIn != "" {
+		expiresIn, err := time.ParseDuration(input.ExpiresIn)
+		if err != nil {
+			return share, err
+		}
+		share.ExpiresAt = time.Now().Add(expiresIn).Unix()
+	}
+	_, err := db.Exec("INSERT INTO shares(id, name, scope, list, token_hash, created_by, created_at, expires_at) VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
+		share.ID, share.Name, share.Scope, share.List, hashToken(share.Token), share.CreatedBy, share.CreatedAt, share.ExpiresAt)
+	return share, err
+}
+
+// GetShareByToken loads a share link that has not expired, returns sql.ErrNoRows if there is none
+func GetShareByToken(db *sql.DB, secret string) (Share, error) {
+	share := Share{}
+	sql := `SELECT id, name, scope, list, created_by, created_at, expires_at FROM shares
+		WHERE token_hash = ? AND (expires_at = 0 OR expires_at > ?)`
+	err := db.QueryRow(sql, hashToken(secret), time.Now().Unix()).Scan(
+		&share.ID, &share.Name, &share.Scope, &share.List, &share.CreatedBy, &share.CreatedAt, &share.ExpiresAt)
+	return share, err
+}
+
+// GetShares loads all share links that have not expired, newest first
+func GetShares(db *sql.DB) ([]Share, error) {
+	result := make([]Share, 0)
+	sql := `SELECT id, name, scope, list, created_by, created_at, expires_at FROM shares
+		WHERE expires_at = 0 OR expires_at > ? ORDER BY created_at DESC, id`
+	rows, err := db.Query(sql, time.Now().Unix())
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		share := Share{}
+		if err = rows.Scan(&share.ID, &share.Name, &share.Scope, &share.List, &share.CreatedBy, &share.CreatedAt, &share.ExpiresAt); err != nil {
+			return result, err
+		}
+		result = append(result, share)
+	}
+	return result, rows.Err()
+}
+
+// DeleteShare revokes a share link
+func DeleteShare(db *sql.DB, id string) (int, error) {
+	result, err := db.Exec("DELETE FROM shares WHERE id = ?", id)
+	if err != nil {
+		return 0, err
+	}
+	num, err := result.RowsAffected()
+	return int(num), err
+}
+
+// PurgeShares removes the expired share links
+func PurgeShares(db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM shares WHERE expires_at > 0 AND expires_at <= ?", time.Now().Unix())
+	return err
+}
+
+// ********************************** //
+//             handlers:              //
+// ********************************** //
+
+// GET /shares lists the share links of the list
+func showShares(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		shares, err := GetShares(db)
+		if err != nil {
+			ctx.Logger().Infof("showShares: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read share links")
+		}
+		return ctx.JSON(http.StatusOK, shares)
+	}
+}
+
+// POST /shares creates a share link to one list, the answer is the only time its token is shown
+func createShare(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		input := &ShareInput{}
+		if err := ctx.Bind(input); err != nil {
+			ctx.Logger().Infof("createShare: Bind Error with request %v: %v", ctx.Request().Body, err)
+			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+		}
+		if ok, errors := input.Valid(); !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, strings.Join(errors, "; "))
+		}
+
+		if input.List != ListNone {
+			shop, err := GetShopByID(db, input.List)
+			if err != nil {
+				ctx.Logger().Infof("createShare: Database Error %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Could not read shops")
+			}
+			if shop.UId == "" {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("No such list %s", input.List))
+			}
+		}
+
+		if err := PurgeShares(db); err != nil {
+			ctx.Logger().Errorf("createShare: Could not purge share links %v", err)
+		}
+		user, _ := currentUser(ctx)
+		share, err := CreateShare(db, *input, user.Name)
+		if err != nil {
+			ctx.Logger().Infof("createShare: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not create share link")
+		}
+		share.URL = fmt.Sprintf("%s://%s/#share=%s", ctx.Scheme(), ctx.Request().Host, share.Token)
+		return ctx.JSON(http.StatusCreated, share)
+	}
+}
+
+// DELETE /shares/:id revokes a share link
+func deleteShare(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		num, err := DeleteShare(db, ctx.Param("id"))
+		if err != nil {
+			ctx.Logger().Infof("deleteShare: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not revoke share link")
+		}
+		if num == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "No such share link")
+		}
+		return ctx.NoContent(http.StatusNoContent)
+	}
+}
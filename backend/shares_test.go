@@ -0,0 +1,222 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// newShareServer serves the routes the share link tests need, with two shops and an item on each list
+func newShareServer(t *testing.T) (*sql.DB, *echo.Echo) {
+	db := newTestDB(t)
+	if _, err := CreateUser(db, "alice", "secret123", false); err != nil {
+		t.Fatal(err)
+	}
+	for _, shop := range []Shop{{UId: "s1", Name: "Bakery"}, {UId: "s2", Name: "Market"}} {
+		if err := UpsertShop(db, &shop); err != nil {
+			t.Fatal(err)
+		}
+		if err := UpsertItem(db, &Item{UId: "i" + shop.UId, Title: "From " + shop.Name, Status: StatusOpen, Shop: &shop}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := UpsertItem(db, &Item{UId: "inone", Title: "Anywhere", Status: StatusOpen}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := SessionConfig{Lifetime: time.Hour}
+	e := echo.New()
+	apis := e.Group("/api", userAuth(db, config, false), listAccess(db, apiOwnAccess...))
+	apis.GET("/items", showAllItems(db))
+	apis.POST("/items/import", importText(db, nil))
+	apis.GET("/shops", showAllShops(db))
+	events := e.Group("/events", userAuth(db, config, false), listAccess(db))
+	events.GET("", func(ctx echo.Context) error {
+		subscription, err := parseSubscription(ctx)
+		if err != nil {
+			return err
+		}
+		return ctx.JSON(http.StatusOK, subscription.Lists)
+	})
+	return db, e
+}
+
+func shareRequest(e *echo.Echo, header string, cookie *http.Cookie, method, path, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if header != "" {
+		request.Header.Set(HeaderShare, header)
+	}
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
+	answer := httptest.NewRecorder()
+	e.ServeHTTP(answer, request)
+	return answer
+}
+
+// itemUIDs returns the uids of the items in an answer, in their order
+func itemUIDs(t *testing.T, data []byte) []string {
+	items := ItemCollection{}
+	if err := json.Unmarshal(data, &items); err != nil {
+		t.Fatal(err)
+	}
+	var uids []string
+	for _, item := range items.Items {
+		uids = append(uids, item.UId)
+	}
+	return uids
+}
+
+// TestShareAuth makes sure share links only see and add to their list, within their scope
+func TestShareAuth(t *testing.T) {
+	db, e := newShareServer(t)
+	read, err := CreateShare(db, ShareInput{Name: "guests", Scope: ScopeRead, List: "s1"}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	none, err := CreateShare(db, ShareInput{Name: "anyone", Scope: ScopeRead, List: ListNone}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	add, err := CreateShare(db, ShareInput{Name: "sitter", Scope: ScopeAdd, List: "s2"}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, token, method, path, body string
+		status                          int
+		answer                          string
+	}{
+		{"read items", read.Token, http.MethodGet, "/api/items", "", http.StatusOK, `"uid":"is1"`},
+		{"read shops", read.Token, http.MethodGet, "/api/shops", "", http.StatusOK, `"uid":"s1"`},
+		{"read events", read.Token, http.MethodGet, "/events?lists=s2", "", http.StatusOK, `["s1"]`},
+		{"read import", read.Token, http.MethodPost, "/api/items/import", `{"text": "Milk"}`, http.StatusForbidden, ""},
+		{"no shop items", none.Token, http.MethodGet, "/api/items", "", http.StatusOK, `"uid":"inone"`},
+		{"no shop shops", none.Token, http.MethodGet, "/api/shops", "", http.StatusOK, `"items":[]`},
+		{"add items", add.Token, http.MethodGet, "/api/items", "", http.StatusOK, `"uid":"is2"`},
+		{"unknown token", ShareTokenPrefix + "nope", http.MethodGet, "/api/items", "", http.StatusUnauthorized, ""},
+	}
+	for _, test := range tests {
+		answer := shareRequest(e, test.token, nil, test.method, test.path, test.body)
+		if answer.Code != test.status {
+			t.Errorf("%q: answered %d instead of %d: %s", test.name, answer.Code, test.status, answer.Body)
+			continue
+		}
+		if !strings.Contains(answer.Body.String(), test.answer) {
+			t.Errorf("%q: answer %s does not contain %s", test.name, answer.Body, test.answer)
+		}
+		if test.path == "/api/items" && test.status == http.StatusOK {
+			if uids := itemUIDs(t, answer.Body.Bytes()); len(uids) != 1 {
+				t.Errorf("%q: got items of other lists: %v", test.name, uids)
+			}
+		}
+	}
+
+	// items added with a link go to its list, the answer only shows that list
+	answer := shareRequest(e, add.Token, nil, http.MethodPost, "/api/items/import", `{"text": "Milk"}`)
+	if answer.Code != http.StatusOK {
+		t.Fatalf("add import answered %d: %s", answer.Code, answer.Body)
+	}
+	result := TextImport{}
+	if err = json.Unmarshal(answer.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Items) != 1 || itemList(&result.Items[0]) != "s2" {
+		t.Errorf("imported items are %+v", result.Items)
+	}
+	if len(result.List.Items) != 2 {
+		t.Errorf("answer shows the items of other lists: %+v", result.List.Items)
+	}
+	items, err := GetAllItems(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items.Items) != 4 {
+		t.Errorf("list after the import has %d items", len(items.Items))
+	}
+}
+
+// TestShareCookie makes sure the cookie set for a share link only works for reading
+func TestShareCookie(t *testing.T) {
+	db, e := newShareServer(t)
+	share, err := CreateShare(db, ShareInput{Name: "sitter", Scope: ScopeAdd, List: "s1"}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answer := shareRequest(e, share.Token, nil, http.MethodGet, "/api/items", "")
+	var cookie *http.Cookie
+	for _, c := range answer.Result().Cookies() {
+		if c.Name == CookieShare {
+			cookie = c
+		}
+	}
+	if cookie == nil || !cookie.HttpOnly || cookie.Value != share.Token {
+		t.Fatalf("share cookie is %+v", cookie)
+	}
+
+	if answer = shareRequest(e, "", cookie, http.MethodGet, "/events", ""); answer.Code != http.StatusOK || !strings.Contains(answer.Body.String(), `["s1"]`) {
+		t.Errorf("reading with the cookie answered %d: %s", answer.Code, answer.Body)
+	}
+	if answer = shareRequest(e, "", cookie, http.MethodPost, "/api/items/import", `{"text": "Milk"}`); answer.Code != http.StatusUnauthorized {
+		t.Errorf("adding with the cookie answered %d: %s", answer.Code, answer.Body)
+	}
+}
+
+// TestShareExpiryAndRevocation makes sure expired and revoked links and links to trashed lists do not work
+func TestShareExpiryAndRevocation(t *testing.T) {
+	db, e := newShareServer(t)
+	expired, err := CreateShare(db, ShareInput{Name: "expired", Scope: ScopeRead, List: "s1", ExpiresIn: "1ns"}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := CreateShare(db, ShareInput{Name: "revoked", Scope: ScopeRead, List: "s1", ExpiresIn: "72h"}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trashed, err := CreateShare(db, ShareInput{Name: "trashed", Scope: ScopeRead, List: "s2"}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if answer := shareRequest(e, revoked.Token, nil, http.MethodGet, "/api/items", ""); answer.Code != http.StatusOK {
+		t.Fatalf("link answered %d before it was revoked: %s", answer.Code, answer.Body)
+	}
+	if num, err := DeleteShare(db, revoked.ID); err != nil || num != 1 {
+		t.Fatalf("could not revoke link: %d %v", num, err)
+	}
+	if _, err = DeleteShopByID(db, "s2"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		share  Share
+		status int
+	}{
+		{"expired", expired, http.StatusUnauthorized},
+		{"revoked", revoked, http.StatusUnauthorized},
+		{"trashed", trashed, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if answer := shareRequest(e, test.share.Token, nil, http.MethodGet, "/api/items", ""); answer.Code != test.status {
+			t.Errorf("%q: answered %d instead of %d", test.name, answer.Code, test.status)
+		}
+	}
+
+	shares, err := GetShares(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 1 || shares[0].ID != trashed.ID {
+		t.Errorf("links left are %+v", shares)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+// Snapshot is the complete state of items and shops at one point in time
+type Snapshot struct {
+	ID        int64           `json:"id"`
+	CreatedAt int64           `json:"created_at"`
+	Label     string          `json:"label"`
+	Automatic bool            `json:"automatic"`
+	Items     *ItemCollection `json:"items,omitempty"`
+	Shops     *ShopCollection `json:"shops,omitempty"`
+}
+
+// SnapshotInfo describes a snapshot without its content, used for listings
+type SnapshotInfo struct {
+	ID          int64  `json:"id"`
+	CreatedAt   int64  `json:"created_at"`
+	Label       string `json:"label"`
+	Automatic   bool   `json:"automatic"`
+	ItemVersion int64  `json:"item_version"`
+	ShopVersion int64  `json:"shop_version"`
+}
+
+// ********************************** //
+//     database access functions:     //
+// ********************************** //
+
+// CreateSnapshot stores the current items and shops as a new snapshot.
+// Both are read in one transaction, so that the items never refer to shops the snapshot does not have.
+func CreateSnapshot(db *sql.DB, label string, automatic bool) (Snapshot, error) {
+	snapshot := Snapshot{
+		CreatedAt: time.Now().Unix(),
+		Label:     label,
+		Automatic: automatic,
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return snapshot, err
+	}
+	defer tx.Rollback()
+
+	items, err := GetAllItems(tx)
+	if err != nil {
+		return snapshot, err
+	}
+	shops, err := GetAllShops(tx)
+	if err != nil {
+		return snapshot, err
+	}
+	if err = tx.Commit(); err != nil {
+		return snapshot, err
+	}
+	snapshot.Items = &items
+	snapshot.Shops = &shops
+
+	itemsJSON, err := json.Marshal(items)
+	if err != nil {
+		return snapshot, err
+	}
+	shopsJSON, err := json.Marshal(shops)
+	if err != nil {
+		return snapshot, err
+	}
+
+	query := "INSERT INTO snapshots(created_at, label, automatic, item_version, shop_version, items, shops) VALUES(?, ?, ?, ?, ?, ?, ?)"
+	result, err := db.Exec(query, snapshot.CreatedAt, label, automatic, items.Version, shops.Version, string(itemsJSON), string(shopsJSON))
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.ID, err = result.LastInsertId()
+	return snapshot, err
+}
+
+// GetSnapshots lists all snapshots without their content, newest first
+func GetSnapshots(db *sql.DB) ([]SnapshotInfo, error) {
+	result := make([]SnapshotInfo, 0)
+
+	sql := "SELECT id, created_at, label, automatic, item_version, shop_version FROM snapshots ORDER BY id DESC"
+	rows, err := db.Query(sql)
+	// Exit if the SQL doesn't work for some reason
+	if err != nil {
+		return result, err
+	}
+	// make sure to cleanup when the program exits
+	defer rows.Close()
+
+	for rows.Next() {
+		info := SnapshotInfo{}
+		err = rows.Scan(&info.ID, &info.CreatedAt, &info.Label, &info.Automatic, &info.ItemVersion, &info.ShopVersion)
+		// Exit if we get an error
+		if err != nil {
+			return result, err
+		}
+		result = append(result, info)
+	}
+	return result, rows.Err()
+}
+
+// GetSnapshotByID loads one snapshot with its content, identified by its id
+func GetSnapshotByID(db queryer, id int64) (Snapshot, error) {
+	snapshot := Snapshot{}
+	var itemsJSON, shopsJSON string
+	query := "SELECT id, created_at, label, automatic, items, shops FROM snapshots WHERE id = ?"
+	err := db.QueryRow(query, id).Scan(&snapshot.ID, &snapshot.CreatedAt, &snapshot.Label, &snapshot.Automatic, &itemsJSON, &shopsJSON)
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.Items = &ItemCollection{}
+	if err = json.Unmarshal([]byte(itemsJSON), snapshot.Items); err != nil {
+		return snapshot, err
+	}
+	snapshot.Shops = &ShopCollection{}
+	err = json.Unmarshal([]byte(shopsJSON), snapshot.Shops)
+	return snapshot, err
+}
+
+// DeleteSnapshotByID deletes one snapshot from the database, identified by its id
+func DeleteSnapshotByID(db *sql.DB, id int64) (int, error) {
+	result, err := db.Exec("DELETE FROM snapshots WHERE id = ?", id)
+	if err != nil {
+		return 0, err
+	}
+	numDeleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(numDeleted), nil
+}
+
+// PruneSnapshots deletes the oldest automatic snapshots so that at most keep of them remain.
+// Snapshots created on demand are never pruned.
+func PruneSnapshots(db *sql.DB, keep int) error {
+	query := `DELETE FROM snapshots WHERE automatic = 1 AND id NOT IN (
+		SELECT id FROM snapshots WHERE automatic = 1 ORDER BY id DESC LIMIT ?)`
+	_, err := db.Exec(query, keep)
+	return err
+}
+
+// RestoreSnapshot replaces the current items and shops with the content of a snapshot,
+// in one transaction and recorded in the audit log, see changeLists.
+// The restored lists get a new version, so that clients holding the replaced state pick them up.
+// Returns the restored snapshot with the new versions and the changes that were applied.
+func RestoreSnapshot(db *sql.DB, notifier *Notifier, id int64, by Author) (Snapshot, []Change, error) {
+	var snapshot Snapshot
+	_, changes, err := changeLists(db, notifier, "snapshots/restore", by, 0, func(tx *sql.Tx) error {
+		var err error
+		snapshot, err = GetSnapshotByID(tx, id)
+		if err != nil {
+			return err
+		}
+
+		// shops first, so that restored items can reference restored shops
+		version := NewVersion()
+		snapshot.Shops.Version = version
+		if err = ReplaceShopList(tx, snapshot.Shops); err != nil {
+			return err
+		}
+		snapshot.Items.Version = version
+		return ReplaceItemList(tx, snapshot.Items)
+	})
+	return snapshot, changes, err
+}
+
+// scheduleSnapshots takes a snapshot every interval and keeps the latest keep automatic ones
+func scheduleSnapshots(db *sql.DB, interval time.Duration, keep int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := CreateSnapshot(db, "automatic", true); err != nil {
+			log.Errorf("scheduleSnapshots: Could not create snapshot %v", err)
+			continue
+		}
+		if err := PruneSnapshots(db, keep); err != nil {
+			log.Errorf("scheduleSnapshots: Could not prune snapshots %v", err)
+		}
+	}
+}
+
+// ********************************** //
+//             handlers:              //
+// ********************************** //
+
+// GET /snapshots lists all snapshots
+func showSnapshots(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		snapshots, err := GetSnapshots(db)
+		if err != nil {
+			ctx.Logger().Infof("showSnapshots: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read snapshots")
+		}
+		return ctx.JSON(http.StatusOK, snapshots)
+	}
+}
+
+// GET /snapshots/:id shows one snapshot with all its items and shops
+func showSnapshot(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+		}
+		snapshot, err := GetSnapshotByID(db, id)
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusNotFound, "No such snapshot")
+		}
+		if err != nil {
+			ctx.Logger().Infof("showSnapshot: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read snapshot")
+		}
+		return ctx.JSON(http.StatusOK, snapshot)
+	}
+}
+
+// POST /snapshots takes a snapshot on demand, the body may contain a label
+func createSnapshot(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		input := struct {
+			Label string `json:"label"`
+		}{}
+		if err := ctx.Bind(&input); err != nil {
+			ctx.Logger().Infof("createSnapshot: Bind Error with request %v: %v", ctx.Request().Body, err)
+			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+		}
+		snapshot, err := CreateSnapshot(db, input.Label, false)
+		if err != nil {
+			ctx.Logger().Infof("createSnapshot: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not create snapshot")
+		}
+		return ctx.JSON(http.StatusCreated, snapshot)
+	}
+}
+
+// DELETE /snapshots/:id removes a snapshot
+func deleteSnapshot(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+		}
+		num, err := DeleteSnapshotByID(db, id)
+		if err != nil {
+			ctx.Logger().Infof("deleteSnapshot: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not delete snapshot")
+		}
+		if num == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "No such snapshot")
+		}
+		return ctx.NoContent(http.StatusNoContent)
+	}
+}
+
+// POST /snapshots/:id/restore replaces items and shops with the content of a snapshot
+func restoreSnapshot(db *sql.DB, notifier *Notifier) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+		}
+
+		snapshot, _, err := RestoreSnapshot(db, notifier, id, author(ctx))
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusNotFound, "No such snapshot")
+		}
+		if err != nil {
+			ctx.Logger().Infof("restoreSnapshot: Database Error on restore %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not restore snapshot")
+		}
+		return ctx.JSON(http.StatusOK, snapshot)
+	}
+}
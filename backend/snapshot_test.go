@@ -0,0 +1,116 @@
+package main
+
+import "testing"
+
+func TestSnapshotRestore(t *testing.T) {
+	db := newTestDB(t)
+	shop := Shop{UId: "s1", Name: "Bakery", Color: "#aa0000"}
+	if err := UpsertShop(db, &shop); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpsertItem(db, &Item{UId: "i1", Title: "Bread", Status: StatusOpen, Quantity: 2, Shop: &shop}); err != nil {
+		t.Fatal(err)
+	}
+	for _, set := range []func(queryer, int64) error{SetItemVersion, SetShopVersion} {
+		if err := set(db, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	created, err := CreateSnapshot(db, "before the party", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := GetSnapshotByID(db, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Label != "before the party" || loaded.Automatic || len(loaded.Shops.Shops) != 1 || len(loaded.Items.Items) != 1 {
+		t.Fatalf("loaded snapshot is %+v", loaded)
+	}
+	if item := loaded.Items.Items[0]; item.Title != "Bread" || item.Quantity != 2 || item.Shop == nil || item.Shop.Name != "Bakery" {
+		t.Errorf("item of the snapshot is %+v", item)
+	}
+
+	// change everything, then go back
+	if _, err = DeleteItemByID(db, "i1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = UpsertItem(db, &Item{UId: "i2", Title: "Milk", Status: StatusOpen}); err != nil {
+		t.Fatal(err)
+	}
+	if err = UpsertShop(db, &Shop{UId: "s1", Name: "Market"}); err != nil {
+		t.Fatal(err)
+	}
+	_, changes, err := RestoreSnapshot(db, nil, created.ID, Author{User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 {
+		t.Errorf("restore changed %+v", changes)
+	}
+
+	items, err := GetAllItems(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items.Items) != 1 || items.Items[0].UId != "i1" || items.Items[0].Shop == nil || items.Items[0].Shop.Name != "Bakery" {
+		t.Errorf("items after the restore are %+v", items.Items)
+	}
+	versions, err := GetVersions(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versions.ItemVersion <= 1 || versions.ShopVersion <= 1 {
+		t.Errorf("versions after the restore are %+v", versions)
+	}
+	changesets, err := GetChangesets(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changesets) != 1 || changesets[0].Source != "snapshots/restore" || changesets[0].User != "alice" || len(changesets[0].Changes) != 3 {
+		t.Errorf("restore recorded %+v", changesets)
+	}
+
+	if _, _, err = RestoreSnapshot(db, nil, created.ID+1, Author{}); err == nil {
+		t.Error("restoring a snapshot that does not exist gave no error")
+	}
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	db := newTestDB(t)
+	var manual []int64
+	for i := 0; i < 5; i++ {
+		if _, err := CreateSnapshot(db, "automatic", true); err != nil {
+			t.Fatal(err)
+		}
+		snapshot, err := CreateSnapshot(db, "manual", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manual = append(manual, snapshot.ID)
+	}
+	if err := PruneSnapshots(db, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, err := GetSnapshots(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var automatic, kept []int64
+	for _, snapshot := range snapshots {
+		if snapshot.Automatic {
+			automatic = append(automatic, snapshot.ID)
+		} else {
+			kept = append(kept, snapshot.ID)
+		}
+	}
+	// the two newest automatic ones are left, listed newest first
+	if len(automatic) != 2 || automatic[0] != manual[4]-1 || automatic[1] != manual[3]-1 {
+		t.Errorf("automatic snapshots left are %v", automatic)
+	}
+	if len(kept) != len(manual) {
+		t.Errorf("snapshots on demand left are %v instead of %v", kept, manual)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// import formats
+const (
+	FormatText    = "text"
+	FormatTodoTxt = "todotxt"
+)
+
+// TextImport is the input and the preview result of a plain text import
+type TextImport struct {
+	Format   string   `json:"format,omitempty"`
+	Text     string   `json:"text,omitempty"`
+	Preview  bool     `json:"preview,omitempty"`
+	Items    []Item   `json:"items,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	// the complete list after the import was applied
+	List *ItemCollection `json:"list,omitempty"`
+}
+
+var (
+	// list markers like "- ", "* ", "+ ", "• " or "1. "
+	listMarker = regexp.MustCompile(`^(?:[-*+•]|\d+[.)])\s+`)
+	// markdown checkboxes like "[ ]" or "[x]"
+	checkbox = regexp.MustCompile(`^\[([ xX]?)\]\s*`)
+	// markdown strike through like "~~milk~~"
+	strikeThrough = regexp.MustCompile(`^~~(.+)~~$`)
+)
+
+// shopsByName builds a lookup of shops by their lower case name
+func shopsByName(shops []Shop) map[string]*Shop {
+	result := make(map[string]*Shop)
+	for i := range shops {
+		result[strings.ToLower(strings.TrimSpace(shops[i].Name))] = &shops[i]
+	}
+	return result
+}
+
+// ParseTextList reads one item per line from plain text or a markdown checklist.
+// [x], ~~strike through~~ and a trailing "(done)" mark items as CHECKED,
+// a trailing @shop assigns an existing shop, as do headings like "## Shop" or "Shop:"
+// for all lines below them. Quantities are parsed from the start or end of each line.
+// Lines that can not be used are reported as warnings.
+func ParseTextList(text string, shops []Shop) ([]Item, []string) {
+	var items []Item
+	var warnings []string
+	shopMap := shopsByName(shops)
+	var currentShop *Shop
+
+	for lineNo, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		// headings switch the shop for everything below
+		if strings.HasPrefix(line, "#") || (strings.HasSuffix(line, ":") && !listMarker.MatchString(line)) {
+			name := strings.ToLower(strings.TrimSpace(strings.Trim(line, "#:")))
+			currentShop = shopMap[name]
+			if currentShop == nil && name != strings.ToLower(NoShopName) {
+				warnings = append(warnings, fmt.Sprintf("line %d: unknown shop %q, items below are not assigned to a shop", lineNo+1, name))
+			}
+			continue
+		}
+
+		item := Item{UId: NewUID(), Status: StatusOpen, Shop: currentShop}
+		line = listMarker.ReplaceAllString(line, "")
+		if match := checkbox.FindStringSubmatch(line); match != nil {
+			if strings.ToLower(match[1]) == "x" {
+				item.Status = StatusChecked
+			}
+			line = line[len(match[0]):]
+		}
+		if match := strikeThrough.FindStringSubmatch(line); match != nil {
+			item.Status = StatusChecked
+			line = match[1]
+		}
+		if strings.HasSuffix(line, "(done)") {
+			item.Status = StatusChecked
+			line = strings.TrimSpace(strings.TrimSuffix(line, "(done)"))
+		}
+
+		// the shop can have spaces in its name, so take everything after the last @
+		if at := strings.LastIndex(line, "@"); at == 0 || (at > 0 && line[at-1] == ' ') {
+			name := strings.ToLower(strings.TrimSpace(line[at+1:]))
+			if shop, ok := shopMap[name]; ok {
+				item.Shop = shop
+			} else {
+				warnings = append(warnings, fmt.Sprintf("line %d: unknown shop %q", lineNo+1, name))
+			}
+			line = strings.TrimSpace(line[:at])
+		}
+
+		item.Quantity, item.Unit, item.Title = ParseQuantity(line)
+		if item.Title == "" {
+			warnings = append(warnings, fmt.Sprintf("line %d: no item found", lineNo+1))
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, warnings
+}
+
+// MergeParsedItems adds parsed items to the existing ones.
+// An existing item with the same id or title is updated instead of adding a duplicate,
+// it keeps its id and position. New items are appended at the end.
+// Returns the merged list and the parsed items with the ids they got.
+func MergeParsedItems(existing []Item, parsed []Item) ([]Item, []Item) {
+	merged := make([]Item, len(existing))
+	copy(merged, existing)
+	index := make(map[string]int)
+	uidIndex := make(map[string]int)
+	orderno := 0
+	for i, item := range merged {
+		index[strings.ToLower(item.Title)] = i
+		uidIndex[item.UId] = i
+		if item.Orderno >= orderno {
+			orderno = item.Orderno + 1
+		}
+	}
+
+	result := make([]Item, 0, len(parsed))
+	for _, item := range parsed {
+		i, ok := uidIndex[item.UId]
+		if !ok {
+			i, ok = index[strings.ToLower(item.Title)]
+		}
+		if ok {
+			orig := merged[i]
+			orig.Title = item.Title
+			orig.Status = item.Status
+			if item.Quantity != 0 {
+				orig.Quantity, orig.Unit = item.Quantity, item.Unit
+			}
+			if item.Category != "" {
+				orig.Category = item.Category
+			}
+			if item.Shop != nil {
+				orig.Shop = item.Shop
+			}
+			merged[i] = orig
+			result = append(result, orig)
+			continue
+		}
+		item.Orderno = orderno
+		orderno++
+		index[strings.ToLower(item.Title)] = len(merged)
+		uidIndex[item.UId] = len(merged)
+		merged = append(merged, item)
+		result = append(result, item)
+	}
+	return merged, result
+}
+
+// AppendParsedItems adds parsed items to the existing ones as new items at the end,
+// without touching existing items. Every parsed item gets a new id, ids from the input are ignored.
+// Returns the new list and the parsed items with the ids they got.
+func AppendParsedItems(existing []Item, parsed []Item) ([]Item, []Item) {
+	merged := make([]Item, len(existing), len(existing)+len(parsed))
+	copy(merged, existing)
+	orderno := 0
+	for _, item := range merged {
+		if item.Orderno >= orderno {
+			orderno = item.Orderno + 1
+		}
+	}
+
+	result := make([]Item, 0, len(parsed))
+	for _, item := range parsed {
+		item.UId = NewUID()
+		item.Orderno = orderno
+		orderno++
+		merged = append(merged, item)
+		result = append(result, item)
+	}
+	return merged, result
+}
+
+// addParsedItems merges or, with appendOnly, appends parsed items to the existing ones
+func addParsedItems(existing []Item, parsed []Item, appendOnly bool) ([]Item, []Item) {
+	if appendOnly {
+		return AppendParsedItems(existing, parsed)
+	}
+	return MergeParsedItems(existing, parsed)
+}
+
+// ImportItems merges parsed items into the item list with one version bump, see UpdateItems.
+// With appendOnly, they are all added as new items instead, see AppendParsedItems.
+// Returns the imported items with the ids they got and the complete list afterwards.
+func ImportItems(db *sql.DB, notifier *Notifier, parsed []Item, appendOnly bool, source string, by Author) ([]Item, ItemCollection, error) {
+	var result []Item
+	items, _, err := UpdateItems(db, notifier, source, by, func(orig []Item) ([]Item, error) {
+		var merged []Item
+		merged, result = addParsedItems(orig, parsed, appendOnly)
+		return merged, nil
+	})
+	return result, items, err
+}
+
+// ********************************** //
+//             handlers:              //
+// ********************************** //
+
+// POST /items/import parses a plain text or markdown list, or a todo.txt file if format is todotxt.
+// With preview set, the result is returned without changing anything,
+// otherwise the items are merged into the list with one version bump.
+// Tokens and share links with the add scope only append new items, share links to their list.
+func importText(db *sql.DB, notifier *Notifier) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+
+		// bind body into struct
+		input := &TextImport{}
+		err := ctx.Bind(input)
+		if err != nil {
+			ctx.Logger().Infof("importText: Bind Error with request %v: %v", ctx.Request().Body, err)
+			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+		}
+
+		shops, err := GetAllShops(db)
+		if err != nil {
+			ctx.Logger().Infof("importText: Database Error on get %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read shops")
+		}
+		var parsed []Item
+		var warnings []string
+		switch input.Format {
+		case "", FormatText:
+			parsed, warnings = ParseTextList(input.Text, shops.Shops)
+		case FormatTodoTxt:
+			parsed, warnings = ParseTodoTxt(input.Text, shops.Shops)
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("format must be %s or %s", FormatText, FormatTodoTxt))
+		}
+		onShareList(ctx, parsed)
+
+		if input.Preview || len(parsed) == 0 {
+			orig, err := GetAllItems(db)
+			if err != nil {
+				ctx.Logger().Infof("importText: Database Error on get %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Could not read items")
+			}
+			_, result := addParsedItems(orig.Items, parsed, addOnly(ctx))
+			return ctx.JSON(http.StatusOK, TextImport{Format: input.Format, Preview: input.Preview, Items: result, Warnings: warnings})
+		}
+
+		// do database operation
+		result, items, err := ImportItems(db, notifier, parsed, addOnly(ctx), "items/import", author(ctx))
+		if err != nil {
+			ctx.Logger().Infof("importText: Database Error on import %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not import items")
+		}
+
+		items.Items = shareItems(ctx, items.Items)
+		return ctx.JSON(http.StatusOK, TextImport{Format: input.Format, Items: result, Warnings: warnings, List: &items})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestParseTextList(t *testing.T) {
+	shops := []Shop{{UId: "s1", Name: "Corner Bakery"}, {UId: "s2", Name: "Market"}}
+	text := `## Corner Bakery
+- [ ] 2 Bread
+- [x] Rolls
+
+Market:
+* ~~Apples~~
+* 500g cheese @corner bakery
+1. Milk (done)
+
+## Other
+Soap
+Candles @Nowhere
+- [ ]
+`
+	items, warnings := ParseTextList(text, shops)
+	want := []struct {
+		title    string
+		status   string
+		shop     string
+		quantity float64
+		unit     string
+	}{
+		{"Bread", StatusOpen, "s1", 2, ""},
+		{"Rolls", StatusChecked, "s1", 0, ""},
+		{"Apples", StatusChecked, "s2", 0, ""},
+		{"cheese", StatusOpen, "s1", 500, "g"},
+		{"Milk", StatusChecked, "s2", 0, ""},
+		{"Soap", StatusOpen, "", 0, ""},
+		{"Candles", StatusOpen, "", 0, ""},
+	}
+	if len(items) != len(want) {
+		t.Fatalf("items are %+v", items)
+	}
+	for i, item := range items {
+		shop := ""
+		if item.Shop != nil {
+			shop = item.Shop.UId
+		}
+		if item.Title != want[i].title || item.Status != want[i].status || shop != want[i].shop ||
+			item.Quantity != want[i].quantity || item.Unit != want[i].unit || item.UId == "" {
+			t.Errorf("item %d is %+v in %q instead of %+v", i, item, shop, want[i])
+		}
+	}
+	// the unknown shop and the empty checkbox
+	if len(warnings) != 2 {
+		t.Errorf("warnings are %v", warnings)
+	}
+
+	// a heading of an unknown shop is reported and leaves the items below without shop
+	items, warnings = ParseTextList("Butcher:\nSausages", shops)
+	if len(items) != 1 || items[0].Shop != nil || len(warnings) != 1 {
+		t.Errorf("items below an unknown shop are %+v with %v", items, warnings)
+	}
+}
+
+func TestMergeParsedItems(t *testing.T) {
+	existing := []Item{{UId: "i1", Title: "Bread", Status: StatusChecked, Orderno: 3}}
+	parsed := []Item{
+		{UId: "n1", Title: "bread", Status: StatusOpen, Quantity: 2},
+		{UId: "n2", Title: "Milk", Status: StatusOpen},
+	}
+	merged, result := MergeParsedItems(existing, parsed)
+	if len(merged) != 2 || merged[0].UId != "i1" || merged[0].Status != StatusOpen || merged[0].Quantity != 2 {
+		t.Errorf("merged list is %+v", merged)
+	}
+	if len(result) != 2 || result[0].UId != "i1" || result[1].UId != "n2" || result[1].Orderno != 4 {
+		t.Errorf("imported items are %+v", result)
+	}
+
+	// appending never touches existing items
+	merged, result = AppendParsedItems(existing, parsed)
+	if len(merged) != 3 || merged[0].Status != StatusChecked || result[0].UId == "n1" {
+		t.Errorf("appended list is %+v", merged)
+	}
+}
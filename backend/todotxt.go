@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// todo.txt, see https://github.com/todotxt/todo.txt
+// Items map to tasks: CHECKED items are completed ("x "), the shop is the @context,
+// the category the +project and the id is kept in a uid: tag, so that a file
+// can be exported, edited and imported again.
+
+var (
+	// dates and priority at the start of a task
+	todoDate     = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}\s+`)
+	todoPriority = regexp.MustCompile(`^\([A-Z]\)\s+`)
+	// key:value tags, the key must not contain anything but letters
+	todoTag = regexp.MustCompile(`^([a-zA-Z]+):(\S+)$`)
+)
+
+// todoTagKeys are the keys of the tags we know, other key:value words like URLs
+// or "at:5pm" are part of the title. uid and shop are read, the rest is dropped.
+var todoTagKeys = map[string]bool{
+	"uid":  true,
+	"shop": true,
+	"due":  true,
+	"t":    true,
+	"rec":  true,
+	"pri":  true,
+	"h":    true,
+}
+
+// todoTxtName turns a name into a single word usable as @context or +project,
+// spaces become _ and an _ of the name is doubled
+func todoTxtName(name string) string {
+	return strings.Join(strings.Fields(strings.ReplaceAll(name, "_", "__")), "_")
+}
+
+// todoTxtUnname reads a name written by todoTxtName
+func todoTxtUnname(word string) string {
+	return strings.NewReplacer("__", "_", "_", " ").Replace(word)
+}
+
+// RenderTodoTxt writes one task per item
+func RenderTodoTxt(w io.Writer, groups []ShopGroup) error {
+	for _, group := range groups {
+		for _, item := range group.Items {
+			line := item.Label()
+			if item.Status == StatusChecked {
+				line = "x " + line
+			}
+			if item.Category != "" {
+				line += " +" + todoTxtName(item.Category)
+			}
+			if item.Shop != nil && item.Shop.Name != "" {
+				line += " @" + todoTxtName(item.Shop.Name)
+			}
+			line += " uid:" + item.UId
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ParseTodoTxt reads one item per task from a todo.txt file.
+// Completed tasks become CHECKED items, @context and a shop: tag are matched against
+// the shop names, the first +project becomes the category and a uid: tag the id.
+// Dates, priorities and the other known key:value tags are dropped.
+func ParseTodoTxt(text string, shops []Shop) ([]Item, []string) {
+	var items []Item
+	var warnings []string
+	shopMap := make(map[string]*Shop)
+	for i := range shops {
+		shopMap[strings.ToLower(strings.Join(strings.Fields(shops[i].Name), " "))] = &shops[i]
+	}
+
+	for lineNo, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		item := Item{UId: NewUID(), Status: StatusOpen}
+		if strings.HasPrefix(line, "x ") {
+			item.Status = StatusChecked
+			line = strings.TrimSpace(line[2:])
+			// completion date
+			line = todoDate.ReplaceAllString(line, "")
+		}
+		line = todoPriority.ReplaceAllString(line, "")
+		// creation date
+		line = todoDate.ReplaceAllString(line, "")
+
+		var words []string
+		for _, word := range strings.Fields(line) {
+			tag := todoTag.FindStringSubmatch(word)
+			if tag != nil && !todoTagKeys[strings.ToLower(tag[1])] {
+				tag = nil
+			}
+			// shop:NAME is the same as @NAME
+			if tag != nil && strings.ToLower(tag[1]) == "shop" {
+				word = "@" + tag[2]
+			}
+			switch {
+			case len(word) > 1 && word[0] == '@':
+				shop, ok := shopMap[strings.ToLower(todoTxtUnname(word[1:]))]
+				if !ok {
+					// written by hand, with the _ of the name as it is
+					shop, ok = shopMap[strings.ToLower(word[1:])]
+				}
+				if !ok {
+					warnings = append(warnings, fmt.Sprintf("line %d: unknown shop %q", lineNo+1, word[1:]))
+				} else if item.Shop == nil {
+					item.Shop = shop
+				}
+			case len(word) > 1 && word[0] == '+':
+				if item.Category == "" {
+					item.Category = todoTxtUnname(word[1:])
+				} else {
+					warnings = append(warnings, fmt.Sprintf("line %d: only one category per item, ignoring %s", lineNo+1, word))
+				}
+			case tag != nil:
+				if strings.ToLower(tag[1]) == "uid" {
+					item.UId = tag[2]
+				}
+			default:
+				words = append(words, word)
+			}
+		}
+
+		item.Quantity, item.Unit, item.Title = ParseQuantity(strings.Join(words, " "))
+		if item.Title == "" {
+			warnings = append(warnings, fmt.Sprintf("line %d: no item found", lineNo+1))
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, warnings
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseTodoTxtTags(t *testing.T) {
+	shops := []Shop{{UId: "s1", Name: "Corner Bakery"}}
+	tests := []struct {
+		line  string
+		title string
+		uid   string
+		shop  string
+	}{
+		{line: "Bread uid:i1 due:2024-01-01", title: "Bread", uid: "i1"},
+		{line: "Rolls shop:corner_bakery t:2024-01-01", title: "Rolls", shop: "s1"},
+		{line: "Cake at:5pm for Anna", title: "Cake at:5pm for Anna"},
+		{line: "Soup see https://example.com/soup @Corner_Bakery", title: "Soup see https://example.com/soup", shop: "s1"},
+	}
+	for _, test := range tests {
+		items, warnings := ParseTodoTxt(test.line, shops)
+		if len(items) != 1 || len(warnings) != 0 {
+			t.Errorf("%q: %+v %v", test.line, items, warnings)
+			continue
+		}
+		item := items[0]
+		if item.Title != test.title {
+			t.Errorf("%q: title %q instead of %q", test.line, item.Title, test.title)
+		}
+		if test.uid != "" && item.UId != test.uid {
+			t.Errorf("%q: uid %q instead of %q", test.line, item.UId, test.uid)
+		}
+		want := test.shop
+		if want == "" {
+			want = ListNone
+		}
+		if list := itemList(&item); list != want {
+			t.Errorf("%q: on list %q instead of %q", test.line, list, want)
+		}
+	}
+}
+
+// TestTodoTxtRoundTrip makes sure categories and shops with spaces and underscores survive export and import
+func TestTodoTxtRoundTrip(t *testing.T) {
+	shops := []Shop{{UId: "s1", Name: "Corner Bakery"}, {UId: "s2", Name: "shop_2"}}
+	items := []Item{
+		{UId: "i1", Title: "Bread", Status: StatusOpen, Category: "baked goods", Shop: &shops[0]},
+		{UId: "i2", Title: "Soap", Status: StatusChecked, Category: "non_food", Shop: &shops[1]},
+		{UId: "i3", Title: "Milk", Status: StatusOpen, Quantity: 2, Unit: "l", Category: "a_ b"},
+	}
+	var buf bytes.Buffer
+	if err := RenderTodoTxt(&buf, GroupItemsByShop(items, shops, false)); err != nil {
+		t.Fatal(err)
+	}
+	parsed, warnings := ParseTodoTxt(buf.String(), shops)
+	if len(parsed) != len(items) || len(warnings) != 0 {
+		t.Fatalf("parsed %+v with %v from\n%s", parsed, warnings, buf.String())
+	}
+	for _, item := range parsed {
+		var orig Item
+		for _, candidate := range items {
+			if candidate.UId == item.UId {
+				orig = candidate
+			}
+		}
+		if item.Title != orig.Title || item.Status != orig.Status || item.Category != orig.Category ||
+			item.Quantity != orig.Quantity || item.Unit != orig.Unit || itemList(&item) != itemList(&orig) {
+			t.Errorf("%+v came back as %+v", orig, item)
+		}
+	}
+
+	// shops written by hand with the underscore of their name
+	parsed, warnings = ParseTodoTxt("Towels @shop_2", shops)
+	if len(parsed) != 1 || itemList(&parsed[0]) != "s2" || len(warnings) != 0 {
+		t.Errorf("handwritten shop gave %+v %v", parsed, warnings)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// what API tokens may do. A token never allows more than its user's role in the household.
+const (
+	// ScopeRead only reads
+	ScopeRead = "read"
+	// ScopeAdd reads and adds items, but does not change or delete anything
+	ScopeAdd = "add"
+	// ScopeFull does everything its user may do, except managing tokens
+	ScopeFull = "full"
+)
+
+// AllowedScopes for checking that scopes are always correct
+var AllowedScopes = []string{ScopeRead, ScopeAdd, ScopeFull}
+
+// TokenPrefix starts every API token, so that they can be recognized e.g. by secret scanners
+const TokenPrefix = "slt_"
+
+// the key under which the token of a request is stored in the echo context
+const contextToken = "token"
+
+// addRoutes are the routes that only add items, method and path as registered.
+// They must not change existing items when addOnly is true.
+var addRoutes = map[string]bool{
+	"POST /api/items/import": true,
+	"POST /api/items/recipe": true,
+}
+
+func isAllowedScope(scope string) bool {
+	for _, allowed := range AllowedScopes {
+		if scope == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Token is a personal API token, the token itself is only shown when it is created
+type Token struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Scope     string `json:"scope"`
+	CreatedAt int64  `json:"created_at"`
+	LastUsed  int64  `json:"last_used,omitempty"`
+	Token     string `json:"token,omitempty"`
+	userID    int64
+}
+
+// Valid tells you whether a token can be created
+func (t *Token) Valid() (bool, []string) {
+	var errors []string
+	if strings.TrimSpace(t.Name) == "" {
+		errors = append(errors, "Name is missing")
+	}
+	if !isAllowedScope(t.Scope) {
+		errors = append(errors, fmt.Sprintf("Scope is of wrong format (%s), only following are allowed: %s", t.Scope, strings.Join(AllowedScopes, ", ")))
+	}
+	if len(errors) > 0 {
+		return false, errors
+	}
+	return true, errors
+}
+
+// scopeAllows tells whether a scope may be used for a request
+func scopeAllows(scope string, ctx echo.Context) bool {
+	switch scope {
+	case ScopeFull:
+		return true
+	case ScopeAdd:
+		return readOnlyMethods[ctx.Request().Method] || addRoutes[ctx.Request().Method+" "+ctx.Path()]
+	}
+	return readOnlyMethods[ctx.Request().Method]
+}
+
+// currentToken returns the API token of the request, ok is false if it did not use one
+func currentToken(ctx echo.Context) (Token, bool) {
+	token, ok := ctx.Get(contextToken).(Token)
+	return token, ok
+}
+
+// requestScope returns the scope of the API token or share link of a request,
+// empty if it was made by a person
+func requestScope(ctx echo.Context) string {
+	if token, ok := currentToken(ctx); ok {
+		return token.Scope
+	}
+	if share, ok := currentShare(ctx); ok {
+		return share.Scope
+	}
+	return ""
+}
+
+// addOnly tells whether a request may only add items, without changing existing ones.
+// Routes in addRoutes check it, so that they append instead of merging into existing items.
+func addOnly(ctx echo.Context) bool {
+	return requestScope(ctx) == ScopeAdd
+}
+
+// tokenAuth logs a request in with an API token sent as bearer token, if it has one.
+// Requests the scope of the token does not allow are rejected.
+func tokenAuth(db *sql.DB, ctx echo.Context) (bool, error) {
+	header := ctx.Request().Header.Get(echo.HeaderAuthorization)
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false, nil
+	}
+	token, user, err := GetTokenByToken(db, strings.TrimPrefix(header, "Bearer "))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !scopeAllows(token.Scope, ctx) {
+		return false, echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("The token is only allowed to %s", token.Scope))
+	}
+	if time.Since(time.Unix(token.LastUsed, 0)) > time.Minute {
+		if err = TouchToken(db, token.ID); err != nil {
+			return false, err
+		}
+	}
+	ctx.Set(contextUser, user)
+	ctx.Set(contextToken, token)
+	return true, nil
+}
+
+// peopleOnly rejects requests made with API tokens or share links, for what only people should do
+func peopleOnly() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if requestScope(ctx) != "" {
+				return echo.NewHTTPError(http.StatusForbidden, "API tokens and share links can not do this")
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// fullAccess rejects share links and API tokens without the full scope, for what only members
+// of the household should see, like the history of the list with the names of who changed it
+func fullAccess() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if scope := requestScope(ctx); scope != "" && scope != ScopeFull {
+				return echo.NewHTTPError(http.StatusForbidden, "Share links and API tokens without full scope can not do this")
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// ********************************** //
+//     database access functions:     //
+// ********************************** //
+
+// CreateToken stores a new token for a user and returns it with the token itself
+func CreateToken(db *sql.DB, userID int64, name, scope string) (Token, error) {
+	token := Token{
+		ID:        NewUID(),
+		Name:      name,
+		Scope:     scope,
+		CreatedAt: time.Now().Unix(),
+		Token:     TokenPrefix + newToken(),
+		userID:    userID,
+	}
+	_, err := db.Exec("INSERT INTO tokens(id, user_id, name, scope, token_hash, created_at) VALUES(?, ?, ?, ?, ?, ?)",
+		token.ID, token.userID, token.Name, token.Scope, hashToken(token.Token), token.CreatedAt)
+	return token, err
+}
+
+// GetTokenByToken loads a token and its user, returns sql.ErrNoRows if there is none
+func GetTokenByToken(db *sql.DB, secret string) (Token, User, error) {
+	token := Token{}
+	user := User{}
+	query := `SELECT tokens.id, tokens.user_id, tokens.name, tokens.scope, tokens.created_at, tokens.last_used,
+			users.id, users.name, users.admin, users.created_at, users.password_hash
+		FROM tokens JOIN users ON users.id = tokens.user_id WHERE tokens.token_hash = ?`
+	err := db.QueryRow(query, hashToken(secret)).Scan(
+		&token.ID, &token.userID, &token.Name, &token.Scope, &token.CreatedAt, &token.LastUsed,
+		&user.ID, &user.Name, &user.Admin, &user.CreatedAt, &user.hash)
+	return token, user, err
+}
+
+// GetTokens loads the tokens of a user, newest first
+func GetTokens(db *sql.DB, userID int64) ([]Token, error) {
+	result := make([]Token, 0)
+	sql := "SELECT id, name, scope, created_at, last_used FROM tokens WHERE user_id = ? ORDER BY created_at DESC, id"
+	rows, err := db.Query(sql, userID)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		token := Token{userID: userID}
+		if err = rows.Scan(&token.ID, &token.Name, &token.Scope, &token.CreatedAt, &token.LastUsed); err != nil {
+			return result, err
+		}
+		result = append(result, token)
+	}
+	return result, rows.Err()
+}
+
+// TouchToken remembers when a token was last used
+func TouchToken(db *sql.DB, id string) error {
+	_, err := db.Exec("UPDATE tokens SET last_used = ? WHERE id = ?", time.Now().Unix(), id)
+	return err
+}
+
+// DeleteToken revokes a token of a user
+func DeleteToken(db *sql.DB, userID int64, id string) (int, error) {
+	result, err := db.Exec("DELETE FROM tokens WHERE user_id = ? AND id = ?", userID, id)
+	if err != nil {
+		return 0, err
+	}
+	num, err := result.RowsAffected()
+	return int(num), err
+}
+
+// ********************************** //
+//             handlers:              //
+// ********************************** //
+
+// GET /tokens lists the API tokens of the logged in user
+func showTokens(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		user, ok := currentUser(ctx)
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Not logged in")
+		}
+		tokens, err := GetTokens(db, user.ID)
+		if err != nil {
+			ctx.Logger().Infof("showTokens: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read tokens")
+		}
+		return ctx.JSON(http.StatusOK, tokens)
+	}
+}
+
+// POST /tokens creates an API token for the logged in user, the answer is the only time it is shown
+func createToken(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		user, ok := currentUser(ctx)
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Not logged in")
+		}
+		input := &Token{}
+		if err := ctx.Bind(input); err != nil {
+			ctx.Logger().Infof("createToken: Bind Error with request %v: %v", ctx.Request().Body, err)
+			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+		}
+		if ok, errors := input.Valid(); !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, strings.Join(errors, "; "))
+		}
+
+		token, err := CreateToken(db, user.ID, strings.TrimSpace(input.Name), input.Scope)
+		if err != nil {
+			ctx.Logger().Infof("createToken: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not create token")
+		}
+		return ctx.JSON(http.StatusCreated, token)
+	}
+}
+
+// DELETE /tokens/:id revokes an API token of the logged in user
+func deleteToken(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		user, ok := currentUser(ctx)
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Not logged in")
+		}
+		num, err := DeleteToken(db, user.ID, ctx.Param("id"))
+		if err != nil {
+			ctx.Logger().Infof("deleteToken: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not revoke token")
+		}
+		if num == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "No such token")
+		}
+		return ctx.NoContent(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// newTokenServer serves the routes the token tests need, like main does
+func newTokenServer(t *testing.T) (*echo.Echo, func(user, scope string) Token) {
+	db := newTestDB(t)
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := CreateUser(db, name, "secret123", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := SetMember(db, "bob", RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	apis := e.Group("/api", userAuth(db, SessionConfig{Lifetime: time.Hour}, false), listAccess(db, apiOwnAccess...))
+	apis.GET("/items", showAllItems(db))
+	apis.POST("/items/sync", syncItems(db, nil))
+	apis.POST("/items/import", importText(db, nil))
+
+	create := func(user, scope string) Token {
+		u, err := GetUserByName(db, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := CreateToken(db, u.ID, scope, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	return e, create
+}
+
+func tokenRequest(e *echo.Echo, token Token, method, path, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	request.Header.Set(echo.HeaderAuthorization, "Bearer "+token.Token)
+	answer := httptest.NewRecorder()
+	e.ServeHTTP(answer, request)
+	return answer
+}
+
+// TestTokenScopes makes sure a token only allows what its scope and the role of its user allow
+func TestTokenScopes(t *testing.T) {
+	e, create := newTokenServer(t)
+	tokens := map[string]Token{
+		"alice read": create("alice", ScopeRead),
+		"alice add":  create("alice", ScopeAdd),
+		"alice full": create("alice", ScopeFull),
+		"bob full":   create("bob", ScopeFull),
+	}
+
+	tests := []struct {
+		token, method, path, body string
+		status                    int
+	}{
+		{"alice read", http.MethodGet, "/api/items", "", http.StatusOK},
+		{"alice read", http.MethodPost, "/api/items/sync", "{}", http.StatusForbidden},
+		{"alice read", http.MethodPost, "/api/items/import", `{"text": "Milk"}`, http.StatusForbidden},
+		{"alice add", http.MethodGet, "/api/items", "", http.StatusOK},
+		{"alice add", http.MethodPost, "/api/items/import", `{"text": "Milk"}`, http.StatusOK},
+		{"alice add", http.MethodPost, "/api/items/sync", "{}", http.StatusForbidden},
+		{"alice full", http.MethodPost, "/api/items/sync", "{}", http.StatusOK},
+		// bob is a viewer, a token can not do more than its user
+		{"bob full", http.MethodGet, "/api/items", "", http.StatusOK},
+		{"bob full", http.MethodPost, "/api/items/sync", "{}", http.StatusForbidden},
+		{"bob full", http.MethodPost, "/api/items/import", `{"text": "Milk"}`, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		answer := tokenRequest(e, tokens[test.token], test.method, test.path, test.body)
+		if answer.Code != test.status {
+			t.Errorf("%q: %s %s answered %d instead of %d: %s", test.token, test.method, test.path, answer.Code, test.status, answer.Body)
+		}
+	}
+}
+
+// TestTokenAddOnly makes sure that tokens with the add scope append items instead of merging them
+func TestTokenAddOnly(t *testing.T) {
+	e, create := newTokenServer(t)
+	full := create("alice", ScopeFull)
+	add := create("alice", ScopeAdd)
+
+	importItems := func(token Token) []Item {
+		answer := tokenRequest(e, token, http.MethodPost, "/api/items/import", `{"text": "Bread"}`)
+		if answer.Code != http.StatusOK {
+			t.Fatalf("import with %s token answered %d: %s", token.Scope, answer.Code, answer.Body)
+		}
+		result := TextImport{}
+		if err := json.Unmarshal(answer.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result.List.Items
+	}
+
+	if items := importItems(full); len(items) != 1 {
+		t.Fatalf("first import made %d items", len(items))
+	}
+	if items := importItems(full); len(items) != 1 {
+		t.Errorf("full token did not merge, list has %d items", len(items))
+	}
+	if items := importItems(add); len(items) != 2 {
+		t.Errorf("add token did not append, list has %d items", len(items))
+	}
+}
+
+// TestTokenRevoked makes sure a deleted token can not log in anymore and used tokens are remembered
+func TestTokenRevoked(t *testing.T) {
+	db := newTestDB(t)
+	user, err := CreateUser(db, "alice", "secret123", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := CreateToken(db, user.ID, "script", ScopeRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	apis := e.Group("/api", userAuth(db, SessionConfig{Lifetime: time.Hour}, false), listAccess(db, apiOwnAccess...))
+	apis.GET("/items", showAllItems(db))
+
+	if answer := tokenRequest(e, token, http.MethodGet, "/api/items", ""); answer.Code != http.StatusOK {
+		t.Fatalf("token answered %d: %s", answer.Code, answer.Body)
+	}
+	tokens, err := GetTokens(db, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].LastUsed == 0 {
+		t.Errorf("last use of token not remembered: %+v", tokens)
+	}
+
+	if num, err := DeleteToken(db, user.ID, token.ID); err != nil || num != 1 {
+		t.Fatalf("could not delete token: %d %v", num, err)
+	}
+	if answer := tokenRequest(e, token, http.MethodGet, "/api/items", ""); answer.Code != http.StatusUnauthorized {
+		t.Errorf("revoked token answered %d", answer.Code)
+	}
+}
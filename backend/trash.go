@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+// TrashedItem is an item that has been deleted but not yet purged
+type TrashedItem struct {
+	Item
+	DeletedAt int64 `json:"deleted_at"`
+}
+
+// TrashedShop is a shop that has been deleted but not yet purged
+type TrashedShop struct {
+	Shop
+	DeletedAt int64 `json:"deleted_at"`
+}
+
+// Trash holds everything that can still be restored
+type Trash struct {
+	Items []TrashedItem `json:"items"`
+	Shops []TrashedShop `json:"shops"`
+}
+
+// ********************************** //
+//     database access functions:     //
+// ********************************** //
+
+// GetTrash loads all deleted items and shops, most recently deleted first
+func GetTrash(db *sql.DB) (Trash, error) {
+	result := Trash{
+		Items: make([]TrashedItem, 0),
+		Shops: make([]TrashedShop, 0),
+	}
+
+	sql := "SELECT uid, title, status, orderno, quantity, unit, category, recipes, revision, shop_id, deleted_at FROM items WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC, uid"
+	rows, err := db.Query(sql)
+	// Exit if the SQL doesn't work for some reason
+	if err != nil {
+		return result, err
+	}
+	// make sure to cleanup when the program exits
+	defer rows.Close()
+
+	var shopIDs []string
+	for rows.Next() {
+		item := TrashedItem{}
+		var shopID, recipes string
+		err = rows.Scan(&item.UId, &item.Title, &item.Status, &item.Orderno, &item.Quantity, &item.Unit, &item.Category, &recipes, &item.Revision, &shopID, &item.DeletedAt)
+		// Exit if we get an error
+		if err != nil {
+			return result, err
+		}
+		item.Recipes = splitRecipeNames(recipes)
+		shopIDs = append(shopIDs, shopID)
+		result.Items = append(result.Items, item)
+	}
+	if err = rows.Err(); err != nil {
+		return result, err
+	}
+	rows.Close()
+
+	// resolve shops after the rows are closed
+	for i, shopID := range shopIDs {
+		if len(shopID) > 0 {
+			shop, err := GetShopByID(db, shopID)
+			if err != nil {
+				return result, err
+			}
+			if shop.UId != "" {
+				result.Items[i].Shop = &shop
+			}
+		}
+	}
+
+	sql = "SELECT uid, name, color, orderno, deleted_at FROM shops WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC, uid"
+	shopRows, err := db.Query(sql)
+	// Exit if the SQL doesn't work for some reason
+	if err != nil {
+		return result, err
+	}
+	// make sure to cleanup when the program exits
+	defer shopRows.Close()
+
+	for shopRows.Next() {
+		shop := TrashedShop{}
+		err = shopRows.Scan(&shop.UId, &shop.Name, &shop.Color, &shop.Orderno, &shop.DeletedAt)
+		// Exit if we get an error
+		if err != nil {
+			return result, err
+		}
+		result.Shops = append(result.Shops, shop)
+	}
+	return result, shopRows.Err()
+}
+
+// RestoreItemByID takes one item out of the trash, identified by its id
+func RestoreItemByID(db queryer, id string) (int, error) {
+	result, err := db.Exec("UPDATE items SET deleted_at = NULL, revision = "+nextRevision+" WHERE uid = ? AND deleted_at IS NOT NULL", id)
+	if err != nil {
+		return 0, err
+	}
+	numRestored, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(numRestored), nil
+}
+
+// RestoreShopByID takes one shop out of the trash, identified by its id
+func RestoreShopByID(db queryer, id string) (int, error) {
+	result, err := db.Exec("UPDATE shops SET deleted_at = NULL WHERE uid = ? AND deleted_at IS NOT NULL", id)
+	if err != nil {
+		return 0, err
+	}
+	numRestored, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(numRestored), nil
+}
+
+// PurgeTrash permanently deletes all items and shops that were deleted before the given time, in one
+// transaction. The remaining items lose the purged shops, so that they do not come back to a shop
+// with the same uid restored later. Purging is not recorded in the audit log, what is purged was already
+// recorded as deleted, and reverting that deletion afterwards creates the entity again.
+func PurgeTrash(db *sql.DB, before time.Time) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE items SET shop_id = '', revision = `+nextRevision+`
+		WHERE shop_id IN (SELECT uid FROM shops WHERE deleted_at IS NOT NULL AND deleted_at < ?)`, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, query := range []string{
+		"DELETE FROM items WHERE deleted_at IS NOT NULL AND deleted_at < ?",
+		"DELETE FROM shops WHERE deleted_at IS NOT NULL AND deleted_at < ?",
+	} {
+		result, err := tx.Exec(query, before.Unix())
+		if err != nil {
+			return 0, err
+		}
+		num, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		total += num
+	}
+	return int(total), tx.Commit()
+}
+
+// schedulePurge regularly removes everything from the trash that is older than the given number of days
+func schedulePurge(db *sql.DB, days int) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		num, err := PurgeTrash(db, time.Now().AddDate(0, 0, -days))
+		if err != nil {
+			log.Errorf("schedulePurge: Could not purge trash %v", err)
+			continue
+		}
+		if num > 0 {
+			log.Infof("schedulePurge: purged %d entries from trash", num)
+		}
+	}
+}
+
+// ********************************** //
+//             handlers:              //
+// ********************************** //
+
+// GET /trash lists all deleted items and shops
+func showTrash(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		trash, err := GetTrash(db)
+		if err != nil {
+			ctx.Logger().Infof("showTrash: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read trash")
+		}
+		return ctx.JSON(http.StatusOK, trash)
+	}
+}
+
+// errNotInTrash is returned when there is nothing to restore
+var errNotInTrash = errors.New("not in trash")
+
+// POST /trash/items/:uid/restore takes an item out of the trash
+func restoreItem(db *sql.DB, notifier *Notifier) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		uid := ctx.Param("uid")
+		var item Item
+		_, _, err := changeLists(db, notifier, "trash/restore", author(ctx), 0, func(tx *sql.Tx) error {
+			num, err := RestoreItemByID(tx, uid)
+			if err != nil {
+				return err
+			}
+			if num == 0 {
+				return errNotInTrash
+			}
+			if err = SetItemVersion(tx, NewVersion()); err != nil {
+				return err
+			}
+			item, err = GetItemByID(tx, uid)
+			return err
+		})
+		if err == errNotInTrash {
+			return echo.NewHTTPError(http.StatusNotFound, "No such item in trash")
+		}
+		if err != nil {
+			ctx.Logger().Infof("restoreItem: Database Error on restore %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not restore item")
+		}
+		return ctx.JSON(http.StatusOK, item)
+	}
+}
+
+// POST /trash/shops/:uid/restore takes a shop out of the trash
+func restoreShop(db *sql.DB, notifier *Notifier) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		uid := ctx.Param("uid")
+		var shop Shop
+		_, _, err := changeLists(db, notifier, "trash/restore", author(ctx), 0, func(tx *sql.Tx) error {
+			num, err := RestoreShopByID(tx, uid)
+			if err != nil {
+				return err
+			}
+			if num == 0 {
+				return errNotInTrash
+			}
+			if err = SetShopVersion(tx, NewVersion()); err != nil {
+				return err
+			}
+			shop, err = GetShopByID(tx, uid)
+			return err
+		})
+		if err == errNotInTrash {
+			return echo.NewHTTPError(http.StatusNotFound, "No such shop in trash")
+		}
+		if err != nil {
+			ctx.Logger().Infof("restoreShop: Database Error on restore %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not restore shop")
+		}
+		return ctx.JSON(http.StatusOK, shop)
+	}
+}
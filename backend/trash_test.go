@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTrashedShop makes sure items are served without their shop while it is in the trash
+func TestTrashedShop(t *testing.T) {
+	db := newTestDB(t)
+	shop := Shop{UId: "s1", Name: "Bakery"}
+	if err := UpsertShop(db, &shop); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpsertItem(db, &Item{UId: "i1", Title: "Bread", Status: StatusOpen, Shop: &shop}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeleteShopByID(db, "s1"); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := GetAllItems(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items.Items) != 1 || items.Items[0].Shop != nil {
+		t.Errorf("items with the shop in the trash: %+v", items.Items)
+	}
+	if item, err := GetItemByID(db, "i1"); err != nil || item.Shop != nil {
+		t.Errorf("item with the shop in the trash: %+v %v", item, err)
+	}
+
+	if _, err = RestoreShopByID(db, "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if item, err := GetItemByID(db, "i1"); err != nil || item.Shop == nil || item.Shop.Name != "Bakery" {
+		t.Errorf("item after restoring the shop: %+v %v", item, err)
+	}
+}
+
+func TestTrashRestoreAndPurge(t *testing.T) {
+	db := newTestDB(t)
+	for _, uid := range []string{"i1", "i2"} {
+		if err := UpsertItem(db, &Item{UId: uid, Title: uid, Status: StatusOpen}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DeleteItemByID(db, uid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := UpsertShop(db, &Shop{UId: "s1", Name: "Bakery"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeleteShopByID(db, "s1"); err != nil {
+		t.Fatal(err)
+	}
+
+	trash, err := GetTrash(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash.Items) != 2 || len(trash.Shops) != 1 {
+		t.Fatalf("trash is %+v", trash)
+	}
+
+	if num, err := RestoreItemByID(db, "i1"); err != nil || num != 1 {
+		t.Fatalf("restored %d: %v", num, err)
+	}
+	if num, err := RestoreItemByID(db, "i1"); err != nil || num != 0 {
+		t.Errorf("restored an item that is not in the trash: %d %v", num, err)
+	}
+	if item, err := GetItemByID(db, "i1"); err != nil || item.UId != "i1" {
+		t.Errorf("restored item is %+v %v", item, err)
+	}
+
+	// entries deleted after the given time stay
+	if num, err := PurgeTrash(db, time.Now().Add(-time.Hour)); err != nil || num != 0 {
+		t.Errorf("purged %d entries deleted within the last hour: %v", num, err)
+	}
+	if num, err := PurgeTrash(db, time.Now().Add(time.Second)); err != nil || num != 2 {
+		t.Errorf("purged %d entries instead of 2: %v", num, err)
+	}
+	trash, err = GetTrash(db)
+	if err != nil || len(trash.Items) != 0 || len(trash.Shops) != 0 {
+		t.Errorf("trash after the purge is %+v %v", trash, err)
+	}
+	if item, err := GetItemByID(db, "i1"); err != nil || item.UId != "i1" {
+		t.Errorf("purge removed the restored item: %+v %v", item, err)
+	}
+}
+
+// TestPurgeShopUnlinksItems makes sure items do not return to a purged shop that is created again
+func TestPurgeShopUnlinksItems(t *testing.T) {
+	db := newTestDB(t)
+	shop := Shop{UId: "s1", Name: "Bakery"}
+	if err := UpsertShop(db, &shop); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpsertItem(db, &Item{UId: "i1", Title: "Bread", Status: StatusOpen, Shop: &shop}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeleteShopByID(db, "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if num, err := PurgeTrash(db, time.Now().Add(time.Second)); err != nil || num != 1 {
+		t.Fatalf("purged %d entries: %v", num, err)
+	}
+
+	if err := UpsertShop(db, &shop); err != nil {
+		t.Fatal(err)
+	}
+	if item, err := GetItemByID(db, "i1"); err != nil || item.Shop != nil {
+		t.Errorf("item after the shop came back is %+v %v", item, err)
+	}
+}
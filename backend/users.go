@@ -0,0 +1,506 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// the key under which the user of a request is stored in the echo context
+const contextUser = "user"
+
+// ErrLastAdmin is returned when a change would leave no admin
+var ErrLastAdmin = errors.New("can not remove the last admin")
+
+var userName = regexp.MustCompile(`^[A-Za-z0-9._@-]+$`)
+
+// User is a person with an account, passwords are only stored as bcrypt hash
+type User struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Admin     bool   `json:"admin"`
+	CreatedAt int64  `json:"created_at"`
+	hash      []byte
+}
+
+// UserInput is what the admin API takes for creating and changing users.
+// Password and Admin are left alone on changes if not given.
+type UserInput struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Admin    *bool  `json:"admin"`
+}
+
+// Valid tells you whether the input can create a user
+func (u *UserInput) Valid() (bool, []string) {
+	var errors []string
+	if !userName.MatchString(u.Name) {
+		errors = append(errors, "Name is missing or has characters other than letters, digits and . _ @ -")
+	}
+	if len(u.Password) < 8 {
+		errors = append(errors, "Password needs at least 8 characters")
+	}
+	if len(errors) > 0 {
+		return false, errors
+	}
+	return true, errors
+}
+
+// passwordCache remembers passwords that were checked already, so that not every request
+// pays for bcrypt. It maps a hash of name and password to the bcrypt hash they matched,
+// changing the password makes the entry useless. Entries are forgotten after passwordCacheTTL,
+// and all of them once there are passwordCacheSize.
+var passwordCache = struct {
+	sync.Mutex
+	checked map[[32]byte]cachedPassword
+}{checked: make(map[[32]byte]cachedPassword)}
+
+const (
+	passwordCacheTTL  = 15 * time.Minute
+	passwordCacheSize = 1000
+)
+
+// dummyHash is compared against for unknown users, it has the cost of the stored hashes
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("no such user"), bcrypt.DefaultCost)
+
+type cachedPassword struct {
+	hash    string
+	checked time.Time
+}
+
+// CheckPassword returns the user with the given name if the password is right
+func CheckPassword(db *sql.DB, name, password string) (User, bool, error) {
+	user, err := GetUserByName(db, name)
+	if err == sql.ErrNoRows {
+		// costs as much as a wrong password, so that the time does not tell which names exist
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return user, false, nil
+	}
+	if err != nil {
+		return user, false, err
+	}
+
+	key := sha256.Sum256([]byte(name + "\x00" + password))
+	passwordCache.Lock()
+	cached, known := passwordCache.checked[key]
+	known = known && cached.hash == string(user.hash) && time.Since(cached.checked) < passwordCacheTTL
+	passwordCache.Unlock()
+	if known {
+		return user, true, nil
+	}
+	if bcrypt.CompareHashAndPassword(user.hash, []byte(password)) != nil {
+		return user, false, nil
+	}
+	passwordCache.Lock()
+	if len(passwordCache.checked) >= passwordCacheSize {
+		passwordCache.checked = make(map[[32]byte]cachedPassword)
+	}
+	passwordCache.checked[key] = cachedPassword{hash: string(user.hash), checked: time.Now()}
+	passwordCache.Unlock()
+	return user, true, nil
+}
+
+// currentUser returns the user who sent the request, ok is false without login
+func currentUser(ctx echo.Context) (User, bool) {
+	user, ok := ctx.Get(contextUser).(User)
+	return user, ok
+}
+
+// pathBelow tells whether a route path is one of the given paths or below one of them
+func pathBelow(path string, paths []string) bool {
+	for _, p := range paths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// userAuth makes every request log in as one of the users, unless there are none yet.
+// Requests log in with an API token, a session cookie, a share link or HTTP Base Authentication, the challenge for the
+// latter makes browsers ask for a password and is only sent if asked for.
+// Routes are skipped by their path, including those below it.
+func userAuth(db *sql.DB, config SessionConfig, challenge bool, skip ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if pathBelow(ctx.Path(), skip) {
+				return next(ctx)
+			}
+			count, err := CountUsers(db)
+			if err != nil {
+				ctx.Logger().Errorf("userAuth: Database Error %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Could not check login")
+			}
+			if count == 0 {
+				return next(ctx)
+			}
+			ok, err := tokenAuth(db, ctx)
+			if err == nil && !ok {
+				ok, err = sessionAuth(db, ctx, config)
+			}
+			if err == nil && !ok {
+				ok, err = shareAuth(db, ctx, config)
+			}
+			if err != nil {
+				if _, isHTTP := err.(*echo.HTTPError); isHTTP {
+					return err
+				}
+				ctx.Logger().Errorf("userAuth: Database Error %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Could not check login")
+			}
+			if ok {
+				return next(ctx)
+			}
+			name, password, ok := ctx.Request().BasicAuth()
+			if ok {
+				user, valid, err := CheckPassword(db, name, password)
+				if err != nil {
+					ctx.Logger().Errorf("userAuth: Database Error %v", err)
+					return echo.NewHTTPError(http.StatusInternalServerError, "Could not check login")
+				}
+				if valid {
+					ctx.Set(contextUser, user)
+					return next(ctx)
+				}
+			}
+			if challenge {
+				ctx.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="shoppinglist"`)
+			}
+			return echo.ErrUnauthorized
+		}
+	}
+}
+
+// requireAdmin only lets admins through. Without users everybody is allowed,
+// so that the first user can be created.
+func requireAdmin(db *sql.DB) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if user, ok := currentUser(ctx); ok {
+				if !user.Admin {
+					return echo.NewHTTPError(http.StatusForbidden, "Only admins can do this")
+				}
+				return next(ctx)
+			}
+			count, err := CountUsers(db)
+			if err != nil {
+				ctx.Logger().Errorf("requireAdmin: Database Error %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Could not check login")
+			}
+			if count > 0 {
+				return echo.ErrUnauthorized
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// ********************************** //
+//     database access functions:     //
+// ********************************** //
+
+// CountUsers returns how many users there are
+func CountUsers(db *sql.DB) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	return count, err
+}
+
+// GetUsers loads all users, ordered by name
+func GetUsers(db *sql.DB) ([]User, error) {
+	result := make([]User, 0)
+	sql := "SELECT id, name, admin, created_at, password_hash FROM users ORDER BY name"
+	rows, err := db.Query(sql)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user := User{}
+		if err = rows.Scan(&user.ID, &user.Name, &user.Admin, &user.CreatedAt, &user.hash); err != nil {
+			return result, err
+		}
+		result = append(result, user)
+	}
+	return result, rows.Err()
+}
+
+// GetUserByName loads one user, returns sql.ErrNoRows if there is none with that name
+func GetUserByName(db *sql.DB, name string) (User, error) {
+	user := User{}
+	sql := "SELECT id, name, admin, created_at, password_hash FROM users WHERE name = ?"
+	err := db.QueryRow(sql, name).Scan(&user.ID, &user.Name, &user.Admin, &user.CreatedAt, &user.hash)
+	return user, err
+}
+
+// CreateUser stores a new user with the hash of the given password
+func CreateUser(db *sql.DB, name, password string, admin bool) (User, error) {
+	user := User{Name: name, Admin: admin, CreatedAt: time.Now().Unix()}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return user, err
+	}
+	user.hash = hash
+	result, err := db.Exec("INSERT INTO users(name, password_hash, admin, created_at) VALUES(?, ?, ?, ?)",
+		user.Name, user.hash, user.Admin, user.CreatedAt)
+	if err != nil {
+		return user, err
+	}
+	user.ID, err = result.LastInsertId()
+	if err != nil {
+		return user, err
+	}
+	// the first user owns the household, the others have to be invited
+	_, err = db.Exec("INSERT INTO members(user_id, role, joined_at) SELECT ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM members)",
+		user.ID, RoleOwner, user.CreatedAt)
+	return user, err
+}
+
+// SetPassword replaces the password of a user, ends all its sessions and revokes its API tokens
+func SetPassword(db *sql.DB, name, password string) (int, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE users SET password_hash = ? WHERE name = ?", hash, name)
+	if err != nil {
+		return 0, err
+	}
+	num, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	for _, table := range []string{"sessions", "tokens"} {
+		if _, err = tx.Exec("DELETE FROM "+table+" WHERE user_id = (SELECT id FROM users WHERE name = ?)", name); err != nil {
+			return 0, err
+		}
+	}
+	return int(num), tx.Commit()
+}
+
+// SetAdmin makes a user an admin or takes it back, unless that would leave no admin
+func SetAdmin(db *sql.DB, name string, admin bool) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE users SET admin = ? WHERE name = ?", admin, name)
+	if err != nil {
+		return 0, err
+	}
+	if err = checkAdminLeft(tx); err != nil {
+		return 0, err
+	}
+	num, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(num), tx.Commit()
+}
+
+// DeleteUserByName removes a user with its membership and sessions, unless it is the last admin or owner
+func DeleteUserByName(db *sql.DB, name string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"members", "sessions", "tokens", "identities"} {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id = (SELECT id FROM users WHERE name = ?)", table), name)
+		if err != nil {
+			return 0, err
+		}
+	}
+	result, err := tx.Exec("DELETE FROM users WHERE name = ?", name)
+	if err != nil {
+		return 0, err
+	}
+	if err = checkAdminLeft(tx); err != nil {
+		return 0, err
+	}
+	if err = checkOwnerLeft(tx); err != nil {
+		return 0, err
+	}
+	num, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(num), tx.Commit()
+}
+
+// checkAdminLeft returns ErrLastAdmin if there are users, but none of them is admin
+func checkAdminLeft(tx *sql.Tx) error {
+	var users, admins int
+	err := tx.QueryRow("SELECT COUNT(*), COALESCE(SUM(admin), 0) FROM users").Scan(&users, &admins)
+	if err != nil {
+		return err
+	}
+	if users > 0 && admins == 0 {
+		return ErrLastAdmin
+	}
+	return nil
+}
+
+// EnsureUser creates the user with the given password as admin, or makes an existing one admin
+// and sets its password. The password is only set if it changed, because that ends all sessions
+// and revokes the API tokens of the user.
+func EnsureUser(db *sql.DB, name, password string) error {
+	user, valid, err := CheckPassword(db, name, password)
+	if err != nil {
+		return err
+	}
+	if user.ID == 0 {
+		_, err = CreateUser(db, name, password, true)
+		return err
+	}
+	if !user.Admin {
+		if _, err = SetAdmin(db, name, true); err != nil {
+			return err
+		}
+	}
+	if valid {
+		return nil
+	}
+	_, err = SetPassword(db, name, password)
+	return err
+}
+
+// ********************************** //
+//             handlers:              //
+// ********************************** //
+
+// GET /users lists all users
+func showUsers(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		users, err := GetUsers(db)
+		if err != nil {
+			ctx.Logger().Infof("showUsers: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read users")
+		}
+		return ctx.JSON(http.StatusOK, users)
+	}
+}
+
+// POST /users creates a user. The first one is always an admin.
+func createUser(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		input := &UserInput{}
+		if err := ctx.Bind(input); err != nil {
+			ctx.Logger().Infof("createUser: Bind Error with request %v: %v", ctx.Request().Body, err)
+			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+		}
+		if ok, errors := input.Valid(); !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, strings.Join(errors, "; "))
+		}
+		if _, err := GetUserByName(db, input.Name); err == nil {
+			return echo.NewHTTPError(http.StatusConflict, "User exists already")
+		}
+		count, err := CountUsers(db)
+		if err != nil {
+			ctx.Logger().Infof("createUser: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not create user")
+		}
+		admin := count == 0 || (input.Admin != nil && *input.Admin)
+
+		user, err := CreateUser(db, input.Name, input.Password, admin)
+		if err != nil {
+			ctx.Logger().Infof("createUser: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not create user")
+		}
+		return ctx.JSON(http.StatusCreated, user)
+	}
+}
+
+// PUT /users/:name changes the password or the admin flag of a user
+func updateUser(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		name := ctx.Param("name")
+		input := &UserInput{}
+		if err := ctx.Bind(input); err != nil {
+			ctx.Logger().Infof("updateUser: Bind Error with request %v: %v", ctx.Request().Body, err)
+			return echo.NewHTTPError(http.StatusBadRequest, "Wrong Input")
+		}
+		if _, err := GetUserByName(db, name); err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusNotFound, "No such user")
+		}
+
+		if input.Password != "" {
+			input.Name = name
+			if ok, errors := input.Valid(); !ok {
+				return echo.NewHTTPError(http.StatusBadRequest, strings.Join(errors, "; "))
+			}
+			if _, err := SetPassword(db, name, input.Password); err != nil {
+				ctx.Logger().Infof("updateUser: Database Error %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Could not change user")
+			}
+		}
+		if input.Admin != nil {
+			_, err := SetAdmin(db, name, *input.Admin)
+			if errors.Is(err, ErrLastAdmin) {
+				return echo.NewHTTPError(http.StatusConflict, "Can not take away the last admin")
+			}
+			if err != nil {
+				ctx.Logger().Infof("updateUser: Database Error %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Could not change user")
+			}
+		}
+
+		user, err := GetUserByName(db, name)
+		if err != nil {
+			ctx.Logger().Infof("updateUser: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not read user")
+		}
+		return ctx.JSON(http.StatusOK, user)
+	}
+}
+
+// DELETE /users/:name removes a user
+func deleteUser(db *sql.DB) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		num, err := DeleteUserByName(db, ctx.Param("name"))
+		if errors.Is(err, ErrLastAdmin) {
+			return echo.NewHTTPError(http.StatusConflict, "Can not delete the last admin")
+		}
+		if errors.Is(err, ErrLastOwner) {
+			return echo.NewHTTPError(http.StatusConflict, "Can not delete the last owner of the household")
+		}
+		if err != nil {
+			ctx.Logger().Infof("deleteUser: Database Error %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not delete user")
+		}
+		if num == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "No such user")
+		}
+		return ctx.NoContent(http.StatusNoContent)
+	}
+}
+
+// GET /me shows the logged in user
+func showMe() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		user, ok := currentUser(ctx)
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Not logged in")
+		}
+		return ctx.JSON(http.StatusOK, user)
+	}
+}
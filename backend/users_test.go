@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestEnsureUserKeepsLogins makes sure that starting the server again with the same password
+// neither ends the sessions nor revokes the API tokens of the user
+func TestEnsureUserKeepsLogins(t *testing.T) {
+	db := newTestDB(t)
+	if err := EnsureUser(db, "admin", "secret123"); err != nil {
+		t.Fatal(err)
+	}
+	user, err := GetUserByName(db, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = CreateSession(db, user, "test", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = CreateToken(db, user.ID, "script", ScopeRead); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = EnsureUser(db, "admin", "secret123"); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, err := GetSessions(db, user.ID); err != nil || len(sessions) != 1 {
+		t.Errorf("sessions after the restart: %+v %v", sessions, err)
+	}
+	if tokens, err := GetTokens(db, user.ID); err != nil || len(tokens) != 1 {
+		t.Errorf("tokens after the restart: %+v %v", tokens, err)
+	}
+}
+
+// TestEnsureUserAdmin makes sure an existing user becomes admin
+func TestEnsureUserAdmin(t *testing.T) {
+	db := newTestDB(t)
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := CreateUser(db, name, "secret123", name == "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := EnsureUser(db, "bob", "secret123"); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := GetUserByName(db, "bob"); err != nil || !user.Admin {
+		t.Errorf("bob is %+v %v", user, err)
+	}
+}
+
+// TestCheckPasswordUnknownUser makes sure unknown names cost a bcrypt compare like known ones
+func TestCheckPasswordUnknownUser(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := CreateUser(db, "alice", "secret123", true); err != nil {
+		t.Fatal(err)
+	}
+	timed := func(name string) time.Duration {
+		start := time.Now()
+		if _, valid, err := CheckPassword(db, name, "wrong password"); err != nil || valid {
+			t.Fatalf("%s: %v %v", name, valid, err)
+		}
+		return time.Since(start)
+	}
+	known, unknown := timed("alice"), timed("mallory")
+	if unknown < known/4 {
+		t.Errorf("checking an unknown user took %v, a known one %v", unknown, known)
+	}
+}
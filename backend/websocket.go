@@ -0,0 +1,325 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+// WebSocket clients get the same events as the event stream and can change items and shops.
+// Every frame is a JSON object, the server sends SocketFrames and takes SocketRequests.
+
+// kinds of frames the server sends
+const (
+	FrameEvent     = "event"
+	FrameHeartbeat = "heartbeat"
+	FrameResult    = "result"
+	FrameError     = "error"
+)
+
+// actions clients can request
+const (
+	ActionPutItem    = "item.put"
+	ActionDeleteItem = "item.delete"
+	ActionPutShop    = "shop.put"
+	ActionDeleteShop = "shop.delete"
+)
+
+// SocketFrame is a frame sent to WebSocket clients.
+// Events have the event id and the event as sent over the event stream,
+// results and errors have the id of the request they answer.
+type SocketFrame struct {
+	Kind    string          `json:"kind"`
+	ID      string          `json:"id,omitempty"`
+	Event   json.RawMessage `json:"event,omitempty"`
+	Request string          `json:"request,omitempty"`
+	Item    *Item           `json:"item,omitempty"`
+	Shop    *Shop           `json:"shop,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// SocketRequest is a change requested by a WebSocket client.
+// item.put and shop.put create or replace the given item or shop, a new one gets an id
+// if it has none. item.delete and shop.delete move the one with the given uid to the trash.
+type SocketRequest struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	Item   *Item  `json:"item,omitempty"`
+	Shop   *Shop  `json:"shop,omitempty"`
+	UId    string `json:"uid,omitempty"`
+}
+
+// errors of socket requests that are the fault of the client
+var (
+	errSocketInvalid   = errors.New("invalid request")
+	errSocketNotFound  = errors.New("not found")
+	errSocketForbidden = errors.New("forbidden")
+)
+
+// checkSocketOrigin lets browsers only connect from the allowed origins or the own host,
+// clients that are no browsers send no origin
+func checkSocketOrigin(req *http.Request, origins []string) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	for _, allowed := range origins {
+		if origin == allowed {
+			return nil
+		}
+	}
+	if originURL, err := url.Parse(origin); err == nil && originURL.Host == req.Host {
+		return nil
+	}
+	return fmt.Errorf("origin %s not allowed", origin)
+}
+
+// HandleSocketRequest applies a change requested over a WebSocket through UpdateItems or UpdateShops
+func HandleSocketRequest(db *sql.DB, notifier *Notifier, by Author, request SocketRequest) (SocketFrame, error) {
+	result := SocketFrame{Kind: FrameResult, Request: request.ID}
+	switch request.Action {
+
+	case ActionPutItem:
+		if request.Item == nil {
+			return result, fmt.Errorf("%w: item is missing", errSocketInvalid)
+		}
+		item := *request.Item
+		if item.UId == "" {
+			item.UId = NewUID()
+		}
+		if ok, errs := item.Valid(); !ok {
+			return result, fmt.Errorf("%w: %s", errSocketInvalid, strings.Join(errs, "; "))
+		}
+		items, _, err := UpdateItems(db, notifier, "websocket", by, func(items []Item) ([]Item, error) {
+			orderno := 0
+			for i := range items {
+				if items[i].UId == item.UId {
+					items[i] = item
+					return items, nil
+				}
+				if items[i].Orderno >= orderno {
+					orderno = items[i].Orderno + 1
+				}
+			}
+			// new items go to the end, unless the client says otherwise
+			if item.Orderno == 0 {
+				item.Orderno = orderno
+			}
+			return append(items, item), nil
+		})
+		if err != nil {
+			return result, err
+		}
+		for i := range items.Items {
+			if items.Items[i].UId == item.UId {
+				result.Item = &items.Items[i]
+			}
+		}
+
+	case ActionDeleteItem:
+		_, _, err := UpdateItems(db, notifier, "websocket", by, func(items []Item) ([]Item, error) {
+			for i := range items {
+				if items[i].UId == request.UId {
+					return append(items[:i], items[i+1:]...), nil
+				}
+			}
+			return nil, fmt.Errorf("%w: no item %s", errSocketNotFound, request.UId)
+		})
+		if err != nil {
+			return result, err
+		}
+
+	case ActionPutShop:
+		if request.Shop == nil || request.Shop.Name == "" {
+			return result, fmt.Errorf("%w: shop or its name is missing", errSocketInvalid)
+		}
+		shop := *request.Shop
+		if shop.UId == "" {
+			shop.UId = NewUID()
+		}
+		shops, _, err := UpdateShops(db, notifier, "websocket", by, func(shops []Shop) ([]Shop, error) {
+			orderno := 0
+			for i := range shops {
+				if shops[i].UId == shop.UId {
+					shops[i] = shop
+					return shops, nil
+				}
+				if shops[i].Orderno >= orderno {
+					orderno = shops[i].Orderno + 1
+				}
+			}
+			if shop.Orderno == 0 {
+				shop.Orderno = orderno
+			}
+			return append(shops, shop), nil
+		})
+		if err != nil {
+			return result, err
+		}
+		for i := range shops.Shops {
+			if shops.Shops[i].UId == shop.UId {
+				result.Shop = &shops.Shops[i]
+			}
+		}
+
+	case ActionDeleteShop:
+		_, _, err := UpdateShops(db, notifier, "websocket", by, func(shops []Shop) ([]Shop, error) {
+			for i := range shops {
+				if shops[i].UId == request.UId {
+					return append(shops[:i], shops[i+1:]...), nil
+				}
+			}
+			return nil, fmt.Errorf("%w: no shop %s", errSocketNotFound, request.UId)
+		})
+		if err != nil {
+			return result, err
+		}
+
+	default:
+		return result, fmt.Errorf("%w: unknown action %q", errSocketInvalid, request.Action)
+	}
+	return result, nil
+}
+
+// ********************************** //
+//             handlers:              //
+// ********************************** //
+
+// GET /events/ws upgrades to a WebSocket. The client id for the events caused by the socket
+// and the id of the last event seen before reconnecting can be given as client and
+// last_event_id query parameters, as browsers can not send headers with WebSockets.
+func eventsSocket(db *sql.DB, notifier *Notifier, config StreamConfig, origins []string) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		ctx.Logger().Infof("eventsSocket called")
+		receiver, err := newReceiver(ctx, notifier, config)
+		if err != nil {
+			return err
+		}
+		// connection closed or stalled, do cleanup
+		defer notifier.RemoveReceiver(receiver)
+		defer joinPresence(ctx, notifier)()
+
+		server := websocket.Server{
+			Handshake: func(_ *websocket.Config, req *http.Request) error {
+				return checkSocketOrigin(req, origins)
+			},
+			Handler: func(ws *websocket.Conn) {
+				serveSocket(ctx, ws, db, notifier, receiver, config)
+			},
+		}
+		server.ServeHTTP(ctx.Response(), ctx.Request())
+		return nil
+	}
+}
+
+// serveSocket sends the events to the socket and applies the requests coming in
+func serveSocket(ctx echo.Context, ws *websocket.Conn, db *sql.DB, notifier *Notifier, receiver *Receiver, config StreamConfig) {
+	// browsers can not send the client id as header with WebSockets
+	by := author(ctx)
+	by.Client = ctx.QueryParam("client")
+	// the reader below must not touch ctx, echo reuses it for other requests once the handler returned
+	scope, editor, logger := requestScope(ctx), canEdit(ctx), ctx.Logger()
+
+	// requests are read and applied one after the other, the answers are sent by the loop below,
+	// so that only one goroutine writes to the socket
+	replies := make(chan SocketFrame)
+	closed := make(chan struct{})
+	stop := make(chan struct{})
+	// closing the socket ends the reader, it is waited for so that it does not outlive the handler
+	defer func() {
+		close(stop)
+		ws.Close()
+		<-closed
+	}()
+	go func() {
+		defer close(closed)
+		for {
+			var request SocketRequest
+			if err := websocket.JSON.Receive(ws, &request); err != nil {
+				return
+			}
+			var reply SocketFrame
+			var err error
+			if scope != "" && scope != ScopeFull {
+				err = fmt.Errorf("%w: this is only allowed to %s", errSocketForbidden, scope)
+			} else if editor {
+				reply, err = HandleSocketRequest(db, notifier, by, request)
+			} else {
+				err = fmt.Errorf("%w: viewers can not change the list", errSocketForbidden)
+			}
+			if err != nil {
+				reply = SocketFrame{Kind: FrameError, Request: request.ID, Error: err.Error()}
+				if !errors.Is(err, errSocketInvalid) && !errors.Is(err, errSocketNotFound) && !errors.Is(err, errSocketForbidden) {
+					logger.Infof("serveSocket: Database Error %v", err)
+					reply.Error = "Could not apply change"
+				}
+			}
+			select {
+			case replies <- reply:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	send := func(frame SocketFrame) error {
+		if config.WriteTimeout > 0 {
+			ws.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+		}
+		return websocket.JSON.Send(ws, frame)
+	}
+	event := func(msg Message) SocketFrame {
+		return SocketFrame{Kind: FrameEvent, ID: notifier.EventID(msg), Event: json.RawMessage(msg.Data)}
+	}
+
+	// a reconnecting client gets what it missed, see eventsStream
+	var lastID uint64
+	for _, msg := range missedMessages(ctx, notifier, receiver, ctx.QueryParam("last_event_id")) {
+		if err := send(event(msg)); err != nil {
+			ctx.Logger().Infof("serveSocket: Error writing to socket: %v", err)
+			return
+		}
+		lastID = msg.ID
+	}
+
+	var heartbeat <-chan time.Time
+	if config.Heartbeat > 0 {
+		ticker := time.NewTicker(config.Heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	for {
+		var frame SocketFrame
+		select {
+		case <-closed:
+			ctx.Logger().Infof("serveSocket: socket closed")
+			return
+		case <-receiver.Done():
+			ctx.Logger().Infof("serveSocket: receiver dropped, it did not keep up")
+			return
+		case <-heartbeat:
+			frame = SocketFrame{Kind: FrameHeartbeat}
+		case frame = <-replies:
+		case msg := <-receiver.Messages():
+			if msg.ID <= lastID {
+				continue
+			}
+			frame = event(msg)
+		}
+
+		// a client that does not take the frame in time is dropped
+		if err := send(frame); err != nil {
+			ctx.Logger().Infof("serveSocket: Error writing to socket: %v", err)
+			return
+		}
+	}
+}
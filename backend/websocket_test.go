@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+func TestHandleSocketRequest(t *testing.T) {
+	db := newTestDB(t)
+	by := Author{User: "alice", Client: "phone"}
+	request := func(request SocketRequest) SocketFrame {
+		t.Helper()
+		frame, err := HandleSocketRequest(db, nil, by, request)
+		if err != nil {
+			t.Fatalf("%q: %v", request.ID, err)
+		}
+		if frame.Kind != FrameResult || frame.Request != request.ID {
+			t.Errorf("%q: answered %+v", request.ID, frame)
+		}
+		return frame
+	}
+
+	// new items get an id and go to the end
+	first := request(SocketRequest{ID: "1", Action: ActionPutItem, Item: &Item{Title: "Bread", Status: StatusOpen}})
+	if first.Item == nil || first.Item.UId == "" {
+		t.Fatalf("new item is %+v", first.Item)
+	}
+	second := request(SocketRequest{ID: "2", Action: ActionPutItem, Item: &Item{UId: "i2", Title: "Milk", Status: StatusOpen}})
+	if second.Item == nil || second.Item.UId != "i2" || second.Item.Orderno != first.Item.Orderno+1 {
+		t.Errorf("second item is %+v", second.Item)
+	}
+	placed := request(SocketRequest{ID: "3", Action: ActionPutItem, Item: &Item{UId: "i3", Title: "Eggs", Status: StatusOpen, Orderno: 7}})
+	if placed.Item == nil || placed.Item.Orderno != 7 {
+		t.Errorf("item with orderno is %+v", placed.Item)
+	}
+
+	// an item with a known uid replaces it
+	replaced := request(SocketRequest{ID: "4", Action: ActionPutItem, Item: &Item{UId: "i2", Title: "Oat milk", Status: StatusChecked, Orderno: 1}})
+	if replaced.Item == nil || replaced.Item.Title != "Oat milk" || replaced.Item.Status != StatusChecked {
+		t.Errorf("replaced item is %+v", replaced.Item)
+	}
+	items, err := GetAllItems(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items.Items) != 3 {
+		t.Errorf("list has %d items instead of 3", len(items.Items))
+	}
+
+	request(SocketRequest{ID: "5", Action: ActionDeleteItem, UId: "i2"})
+	if item, err := GetItemByID(db, "i2"); err != nil || item.UId != "" {
+		t.Errorf("deleted item is still there: %+v %v", item, err)
+	}
+
+	shop := request(SocketRequest{ID: "6", Action: ActionPutShop, Shop: &Shop{Name: "Bakery"}})
+	if shop.Shop == nil || shop.Shop.UId == "" || shop.Shop.Name != "Bakery" {
+		t.Fatalf("new shop is %+v", shop.Shop)
+	}
+	renamed := request(SocketRequest{ID: "7", Action: ActionPutShop, Shop: &Shop{UId: shop.Shop.UId, Name: "Baker"}})
+	if renamed.Shop == nil || renamed.Shop.Name != "Baker" {
+		t.Errorf("renamed shop is %+v", renamed.Shop)
+	}
+	request(SocketRequest{ID: "8", Action: ActionDeleteShop, UId: shop.Shop.UId})
+	if shop, err := GetShopByID(db, shop.Shop.UId); err != nil || shop.UId != "" {
+		t.Errorf("deleted shop is still there: %+v %v", shop, err)
+	}
+
+	failures := []struct {
+		request SocketRequest
+		err     error
+	}{
+		{SocketRequest{ID: "no item", Action: ActionPutItem}, errSocketInvalid},
+		{SocketRequest{ID: "invalid item", Action: ActionPutItem, Item: &Item{Title: "Bread", Status: "GONE"}}, errSocketInvalid},
+		{SocketRequest{ID: "unknown item", Action: ActionDeleteItem, UId: "nope"}, errSocketNotFound},
+		{SocketRequest{ID: "no shop name", Action: ActionPutShop, Shop: &Shop{}}, errSocketInvalid},
+		{SocketRequest{ID: "unknown shop", Action: ActionDeleteShop, UId: "nope"}, errSocketNotFound},
+		{SocketRequest{ID: "unknown action", Action: "item.touch"}, errSocketInvalid},
+	}
+	for _, test := range failures {
+		if _, err := HandleSocketRequest(db, nil, by, test.request); !errors.Is(err, test.err) {
+			t.Errorf("%q: error is %v instead of %v", test.request.ID, err, test.err)
+		}
+	}
+}
+
+func TestCheckSocketOrigin(t *testing.T) {
+	origins := []string{"https://app.example.org"}
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true},
+		{"https://app.example.org", true},
+		{"http://list.example.org", true},
+		{"https://list.example.org.evil.com", false},
+		{"https://evil.com", false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://list.example.org/events/ws", nil)
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		if err := checkSocketOrigin(req, origins); (err == nil) != test.ok {
+			t.Errorf("%q: error is %v", test.origin, err)
+		}
+	}
+}
+
+// TestSocketPermissions makes sure only editors with full access change the list over a WebSocket
+func TestSocketPermissions(t *testing.T) {
+	db := newTestDB(t)
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := CreateUser(db, name, "secret123", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := SetMember(db, "bob", RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := GetUserByName(db, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := CreateToken(db, alice.ID, "read", ScopeRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add, err := CreateToken(db, alice.ID, "add", ScopeAdd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notifier := NewNotifier(NotifierConfig{Backlog: 16, QueueSize: 8})
+	e := echo.New()
+	events := e.Group("/events", userAuth(db, SessionConfig{Lifetime: time.Hour}, false), listAccess(db))
+	events.GET("/ws", eventsSocket(db, notifier, StreamConfig{WriteTimeout: time.Second}, []string{"https://app.example.org"}))
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	basic := func(user string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":secret123"))
+	}
+	dial := func(authorization, origin string) (*websocket.Conn, error) {
+		config, err := websocket.NewConfig("ws"+strings.TrimPrefix(server.URL, "http")+"/events/ws", origin)
+		if err != nil {
+			return nil, err
+		}
+		config.Header.Set(echo.HeaderAuthorization, authorization)
+		return websocket.DialConfig(config)
+	}
+
+	tests := []struct {
+		name, authorization, err string
+	}{
+		{"owner", basic("alice"), ""},
+		{"viewer", basic("bob"), "viewers can not change the list"},
+		{"read token", "Bearer " + read.Token, "only allowed to read"},
+		{"add token", "Bearer " + add.Token, "only allowed to add"},
+	}
+	for _, test := range tests {
+		ws, err := dial(test.authorization, server.URL)
+		if err != nil {
+			t.Errorf("%q: could not connect: %v", test.name, err)
+			continue
+		}
+		ws.SetDeadline(time.Now().Add(5 * time.Second))
+		request := SocketRequest{ID: test.name, Action: ActionPutItem, Item: &Item{Title: "Bread", Status: StatusOpen}}
+		if err = websocket.JSON.Send(ws, request); err != nil {
+			t.Fatal(err)
+		}
+		// events of the own change may come before the result
+		var frame SocketFrame
+		for frame.Kind != FrameResult && frame.Kind != FrameError {
+			if err = websocket.JSON.Receive(ws, &frame); err != nil {
+				t.Fatalf("%q: %v", test.name, err)
+			}
+		}
+		ws.Close()
+		if frame.Request != test.name {
+			t.Errorf("%q: answer is for %q", test.name, frame.Request)
+		}
+		if test.err == "" && frame.Kind != FrameResult {
+			t.Errorf("%q: answered %+v", test.name, frame)
+		}
+		if test.err != "" && (frame.Kind != FrameError || !strings.Contains(frame.Error, test.err)) {
+			t.Errorf("%q: answered %+v instead of %s", test.name, frame, test.err)
+		}
+	}
+
+	items, err := GetAllItems(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items.Items) != 1 {
+		t.Errorf("list has %d items instead of the one of the owner", len(items.Items))
+	}
+
+	if _, err = dial(basic("alice"), "https://evil.com"); err == nil {
+		t.Error("connected from another origin")
+	}
+	ws, err := dial(basic("alice"), "https://app.example.org")
+	if err != nil {
+		t.Fatalf("could not connect from an allowed origin: %v", err)
+	}
+	ws.Close()
+}
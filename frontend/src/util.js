@@ -4,9 +4,12 @@ export const httpOptions = (m, obj) => {
     method: m !== undefined ? m : "GET",
     mode: "cors",
     cache: "no-cache",
-    credentials: "same-origin",
+    credentials: "include",
     headers: {
       "Content-Type": "application/json",
+      "X-Client-ID": clientId,
+      "X-CSRF-Token": csrfToken(),
+      "X-Share-Token": shareToken,
     },
     redirect: "follow",
   };
@@ -33,6 +36,34 @@ export const uid = () => {
   );
 };
 
+// identifies this browser tab, so that we can ignore the events caused by ourselves
+export const clientId = uid();
+
+// share links carry their token after the #, we keep it while the tab is open
+// and remove it from the address bar, so that it is not bookmarked or copied along
+export const shareToken = (() => {
+  let token = new URLSearchParams(window.location.hash.substring(1)).get(
+    "share"
+  );
+  if (token) {
+    sessionStorage.setItem("share", token);
+    history.replaceState(
+      null,
+      "",
+      window.location.pathname + window.location.search
+    );
+  }
+  return sessionStorage.getItem("share") || "";
+})();
+
+// the backend wants the token of our session with every change
+export const csrfToken = () => {
+  let cookie = document.cookie
+    .split("; ")
+    .find((c) => c.startsWith("csrf_token="));
+  return cookie ? cookie.substring("csrf_token=".length) : "";
+};
+
 export const reorderStore = (store, start, target) => {
   const newStore = store;
 